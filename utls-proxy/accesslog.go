@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 访问日志：每个 /proxy 请求一行，独立于运行日志的文件与轮转
+//
+// combined 格式 = Apache combined 日志 + key=value 扩展字段：
+//   127.0.0.1 - - [02/Jan/2006:15:04:05 -0700] "GET /proxy?url=... HTTP/1.1" 200 1234 "-" "curl/8.0" target_host=kh.google.com ...
+// json 格式每行一个对象，字段与 accessRecord 的 json tag 一致
+
+var accessLog *rotatingLog // 访问日志文件（未启用时为 nil）
+
+// 单个请求的访问记录
+type accessRecord struct {
+	Time           string `json:"time"`
+	RemoteAddr     string `json:"remote_addr"`     // 调用方地址
+	Method         string `json:"method"`          // 调用方请求方法
+	URI            string `json:"uri"`             // 调用方请求 URI
+	Proto          string `json:"proto"`           // 调用方协议
+	UserAgent      string `json:"user_agent"`      // 调用方 User-Agent
+	Referer        string `json:"referer"`         // 调用方 Referer
+	RequestID      string `json:"request_id"`      // 请求 ID
+	TargetHost     string `json:"target_host"`     // 目标域名
+	TargetPath     string `json:"target_path"`     // 目标路径
+	Addr           string `json:"addr"`            // 出口 IPv6（无绑定时为 default）
+	Profile        string `json:"profile"`         // 浏览器指纹
+	UpstreamStatus int    `json:"upstream_status"` // 最后一次上游响应状态码（无响应为 0）
+	Status         int    `json:"status"`          // 返回给调用方的状态码
+	Bytes          int64  `json:"bytes"`           // 返回给调用方的字节数
+	DurationMs     int64  `json:"duration_ms"`     // 总耗时
+	Attempts       int    `json:"attempts"`        // 上游尝试次数
+	Error          string `json:"error"`           // 最终错误分类（成功为空）
+
+	start time.Time
+}
+
+// 打开访问日志
+func initAccessLog() {
+	if config.accessLogFile == "" {
+		slog.Info("访问日志已关闭")
+		return
+	}
+
+	logFile, err := openRotatingLog(config.accessLogFile, config.accessLogMaxSize, config.accessLogMaxBackups, config.accessLogMaxAge)
+	if err != nil {
+		// 访问日志不可用不影响代理功能
+		slog.Warn("访问日志不可用", "file", config.accessLogFile, "error", err)
+		return
+	}
+
+	accessLog = logFile
+	slog.Info("访问日志已配置", "file", config.accessLogFile, "format", config.accessLogFormat,
+		"max_size_mb", config.accessLogMaxSize, "max_backups", config.accessLogMaxBackups,
+		"max_age_days", config.accessLogMaxAge)
+}
+
+func closeAccessLog() {
+	if accessLog != nil {
+		accessLog.Close()
+	}
+}
+
+// 请求开始时创建访问记录
+func newAccessRecord(r *http.Request, reqID string) *accessRecord {
+	remote := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+
+	return &accessRecord{
+		RemoteAddr: remote,
+		Method:     r.Method,
+		URI:        r.RequestURI,
+		Proto:      r.Proto,
+		UserAgent:  r.UserAgent(),
+		Referer:    r.Referer(),
+		RequestID:  reqID,
+		Addr:       defaultAddressKey,
+		start:      time.Now(),
+	}
+}
+
+// 请求结束时写入访问日志
+func (a *accessRecord) finish(tw *timingResponseWriter) {
+	if accessLog == nil {
+		return
+	}
+
+	end := time.Now()
+	a.Time = end.Format(time.RFC3339Nano)
+	a.Status = tw.status
+	if a.Status == 0 {
+		a.Status = http.StatusOK
+	}
+	a.Bytes = tw.bytes
+	a.DurationMs = end.Sub(a.start).Milliseconds()
+
+	var line []byte
+	if config.accessLogFormat == "json" {
+		data, err := json.Marshal(a)
+		if err != nil {
+			return
+		}
+		line = append(data, '\n')
+	} else {
+		line = a.appendCombined(nil, end)
+	}
+
+	// 整行一次写入，轮转期间也不会产生半行
+	accessLog.Write(line)
+}
+
+func (a *accessRecord) appendCombined(b []byte, end time.Time) []byte {
+	b = append(b, a.RemoteAddr...)
+	b = append(b, " - - ["...)
+	b = end.AppendFormat(b, "02/Jan/2006:15:04:05 -0700")
+	b = append(b, "] "...)
+	b = strconv.AppendQuote(b, a.Method+" "+a.URI+" "+a.Proto)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, int64(a.Status), 10)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, a.Bytes, 10)
+	b = append(b, ' ')
+	b = strconv.AppendQuote(b, orDash(a.Referer))
+	b = append(b, ' ')
+	b = strconv.AppendQuote(b, orDash(a.UserAgent))
+
+	fields := []struct{ key, value string }{
+		{"request_id", a.RequestID},
+		{"target_host", a.TargetHost},
+		{"target_path", a.TargetPath},
+		{"addr", a.Addr},
+		{"profile", a.Profile},
+		{"upstream_status", strconv.Itoa(a.UpstreamStatus)},
+		{"attempts", strconv.Itoa(a.Attempts)},
+		{"duration_ms", strconv.FormatInt(a.DurationMs, 10)},
+		{"error", a.Error},
+	}
+	for _, f := range fields {
+		b = append(b, ' ')
+		b = append(b, f.key...)
+		b = append(b, '=')
+		b = appendLogValue(b, orDash(f.value))
+	}
+
+	return append(b, '\n')
+}
+
+// 含空白、引号或控制字符的值加引号转义，保证一行一条记录
+func appendLogValue(b []byte, value string) []byte {
+	if strings.ContainsFunc(value, func(r rune) bool { return r <= ' ' || r == '"' || r == 0x7f }) {
+		return strconv.AppendQuote(b, value)
+	}
+	return append(b, value...)
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// combined 格式：请求行和 User-Agent 加引号转义，含空白的扩展字段加引号，空值为 -
+func TestAccessLogCombined(t *testing.T) {
+	a := &accessRecord{
+		RemoteAddr:     "::1",
+		Method:         http.MethodGet,
+		URI:            "/proxy?url=x",
+		Proto:          "HTTP/1.1",
+		UserAgent:      `curl/8.0 "test"`,
+		RequestID:      "req-1",
+		TargetHost:     "kh.google.com",
+		TargetPath:     "/rt/earth/a b",
+		Addr:           "default",
+		Profile:        "Chrome 133 (Windows 11)",
+		UpstreamStatus: 200,
+		Status:         200,
+		Bytes:          1234,
+		DurationMs:     15,
+		Attempts:       1,
+	}
+	end := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	want := `::1 - - [02/Jan/2024:15:04:05 +0000] "GET /proxy?url=x HTTP/1.1" 200 1234 "-" "curl/8.0 \"test\"" ` +
+		`request_id=req-1 target_host=kh.google.com target_path="/rt/earth/a b" addr=default profile="Chrome 133 (Windows 11)" ` +
+		`upstream_status=200 attempts=1 duration_ms=15 error=-` + "\n"
+	if got := string(a.appendCombined(nil, end)); got != want {
+		t.Errorf("combined:\n\tgot  %s\twant %s", got, want)
+	}
+}
+
+// json 格式：每个 /proxy 请求一行，字段与 accessRecord 一致
+func TestAccessLogJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	logFile, err := openRotatingLog(path, 100, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedLog, savedFile, savedFormat := accessLog, config.accessLogFile, config.accessLogFormat
+	accessLog, config.accessLogFile, config.accessLogFormat = logFile, path, "json"
+	defer func() {
+		logFile.Close()
+		accessLog, config.accessLogFile, config.accessLogFormat = savedLog, savedFile, savedFormat
+	}()
+
+	const reqID = "access-log-json"
+	req := httptest.NewRequest(http.MethodGet, "/proxy?url="+url.QueryEscape("https://example.com/a"), nil)
+	req.Header.Set("X-Request-Id", reqID)
+	req.Header.Set("User-Agent", "access-log-test")
+	proxyHandler(httptest.NewRecorder(), req)
+
+	record := readAccessRecord(t, reqID)
+	if record.Method != http.MethodGet || record.URI != req.RequestURI || record.UserAgent != "access-log-test" ||
+		record.Status != http.StatusBadRequest || record.Addr != defaultAddressKey || record.Bytes <= 0 || record.Error != "not_allowed" {
+		t.Errorf("访问记录: %+v", record)
+	}
+}
+
+// 批量请求的各项记录目标 URL，而不是内部请求的 /batch
+func TestAccessLogBatchURI(t *testing.T) {
+	_, proxy := startMockProxy(t)
+	if accessLog == nil {
+		t.Skip("访问日志未启用")
+	}
+	saved := config.accessLogFormat
+	config.accessLogFormat = "json"
+	defer func() { config.accessLogFormat = saved }()
+
+	const target = "https://kh.google.com/rt/earth/NodeData/pb=!1m2!1s0!2u31"
+	reqID := "access-log-batch-" + time.Now().Format("150405.000000")
+	req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/batch", strings.NewReader(`[{"url": "`+target+`"}]`))
+	req.Header.Set("X-Request-Id", reqID)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if record := readAccessRecord(t, reqID+".0"); record.URI != target || record.Status != http.StatusOK {
+		t.Errorf("访问记录: %+v", record)
+	}
+}
+
+// 访问日志中请求 ID 为 reqID 的记录（json 格式）
+func readAccessRecord(t *testing.T, reqID string) accessRecord {
+	t.Helper()
+	// 访问记录在处理函数返回时写入，可能晚于客户端读完响应
+	waitFor(t, "请求未结束", func() bool { return activeRequests.Load() == 0 })
+	f, err := os.Open(config.accessLogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var record accessRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if strings.Contains(scanner.Text(), `"request_id":"`+reqID+`"`) {
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				t.Fatalf("%v: %s", err, scanner.Text())
+			}
+		}
+	}
+	return record
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// 管理接口（修改运行时状态或开销较大的接口：/loglevel、/profiles/assignments、/profiles/verify）与代理共用监听，需要限制调用方：
+//   - 设置了 UTLS_ADMIN_TOKEN 时，要求 Authorization: Bearer <token>
+//   - 否则只允许本机（回环地址或 Unix socket）访问
+
+func adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdminRequest(r) {
+			slog.Warn("拒绝管理接口请求", "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func isAdminRequest(r *http.Request) bool {
+	if config.adminToken != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		return ok && subtle.ConstantTimeCompare([]byte(token), []byte(config.adminToken)) == 1
+	}
+
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && addr.Network() == "unix" {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// 未设置令牌时只允许回环地址；设置令牌后只认令牌
+func TestAdminOnly(t *testing.T) {
+	saved := config.adminToken
+	defer func() { config.adminToken = saved }()
+
+	handler := adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	call := func(remoteAddr, authorization string) int {
+		req := httptest.NewRequest(http.MethodPut, "/loglevel?level=debug", nil)
+		req.RemoteAddr = remoteAddr
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec.Code
+	}
+
+	config.adminToken = ""
+	for remoteAddr, want := range map[string]int{
+		"127.0.0.1:40000":    http.StatusNoContent,
+		"[::1]:40000":        http.StatusNoContent,
+		"192.0.2.10:40000":   http.StatusForbidden,
+		"[2001:db8::1]:4000": http.StatusForbidden,
+		"":                   http.StatusForbidden,
+	} {
+		if code := call(remoteAddr, ""); code != want {
+			t.Errorf("%q: %d，应为 %d", remoteAddr, code, want)
+		}
+	}
+
+	config.adminToken = "secret"
+	for _, tc := range []struct {
+		remoteAddr, authorization string
+		want                      int
+	}{
+		{"192.0.2.10:40000", "Bearer secret", http.StatusNoContent},
+		{"192.0.2.10:40000", "Bearer wrong", http.StatusForbidden},
+		{"192.0.2.10:40000", "secret", http.StatusForbidden},
+		{"127.0.0.1:40000", "", http.StatusForbidden},
+	} {
+		if code := call(tc.remoteAddr, tc.authorization); code != tc.want {
+			t.Errorf("%q %q: %d，应为 %d", tc.remoteAddr, tc.authorization, code, tc.want)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// 地址 -> 浏览器指纹的分配策略（UTLS_PROFILE_ASSIGNMENT）：
+//   - hash（默认）：按 UTLS_PROFILE_SALT 和地址做加权 rendezvous 哈希，同一地址在资源清理和重启后得到相同的指纹；
+//     指纹库增删时只有原本分到（或新分到）变动指纹的地址会改变
+//   - random：首次使用时按权重随机选择（资源清理后可能变化）
+//
+// 两种策略下新地址分到某个指纹的概率都是它的权重占启用指纹总权重的比例（见 profiles.go）
+//
+// 覆盖优先于策略：UTLS_PROFILE_OVERRIDES 配置，或运行时通过 /profiles/assignments 设置（不持久化）
+// 无 IPv6 的默认出口使用地址 "default"
+
+const (
+	assignHash   = "hash"
+	assignRandom = "random"
+
+	defaultAddressKey = "default" // 默认出口（无 IPv6）的地址
+)
+
+var profileOverrides sync.Map // 地址 -> 指纹名称
+
+// 加载 UTLS_PROFILE_OVERRIDES：分号分隔的 address=profile
+//
+//	2001:db8::1=chrome-133-windows-11;default=firefox-120-windows-10
+func initProfileOverrides(spec string) error {
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		// IPv6 地址中有冒号，用最后一个 = 分隔
+		i := strings.LastIndex(entry, "=")
+		if i <= 0 {
+			return fmt.Errorf("无效的指纹覆盖 %q（格式 address=profile）", entry)
+		}
+		addr, err := assignmentKey(entry[:i])
+		if err != nil {
+			return err
+		}
+		profile, ok := findBrowserProfile(entry[i+1:])
+		if !ok {
+			return fmt.Errorf("指纹覆盖中的指纹不存在或已停用: %s", strings.TrimSpace(entry[i+1:]))
+		}
+		profileOverrides.Store(addr, profile.Name)
+		slog.Info("指纹覆盖", "addr", addr, "profile", profile.Name)
+	}
+	return nil
+}
+
+// 地址的规范形式（"" 和 "default" 表示默认出口）
+func assignmentKey(addr string) (string, error) {
+	addr = strings.TrimSpace(addr)
+	if addr == "" || addr == defaultAddressKey {
+		return defaultAddressKey, nil
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil || ip.To4() != nil {
+		return "", fmt.Errorf("无效的 IPv6 地址: %s", addr)
+	}
+	return ip.String(), nil
+}
+
+// 地址在指纹、客户端、会话和熔断状态中使用的 key：规范形式（无 IPv6 时为 default），
+// 无法规范化的地址原样使用
+func addressKey(ipv6 string) string {
+	key, err := assignmentKey(ipv6)
+	if err != nil {
+		return ipv6
+	}
+	return key
+}
+
+// 按覆盖和分配策略为地址选择指纹（不缓存，见 getBrowserProfileForIPv6）
+func assignBrowserProfile(key string) (BrowserProfile, string) {
+	if profile, source, ok := plannedBrowserProfile(key); ok {
+		return profile, source
+	}
+	return weightedRandomProfile(), assignRandom
+}
+
+// 不消耗随机数即可确定的分配：覆盖或 hash 策略；random 策略下没有覆盖时 ok 为 false
+func plannedBrowserProfile(key string) (BrowserProfile, string, bool) {
+	if name, ok := profileOverrides.Load(key); ok {
+		if profile, ok := findBrowserProfile(name.(string)); ok {
+			return profile, "override", true
+		}
+	}
+	if config.profileAssignment == assignRandom {
+		return BrowserProfile{}, assignRandom, false
+	}
+	return rendezvousProfile(key), assignHash, true
+}
+
+// 按权重随机选择
+func weightedRandomProfile() BrowserProfile {
+	var total float64
+	for _, profile := range browserProfiles {
+		total += profile.Weight
+	}
+	r := rng.Float64() * total
+	for _, profile := range browserProfiles {
+		if r -= profile.Weight; r < 0 {
+			return profile
+		}
+	}
+	return browserProfiles[len(browserProfiles)-1]
+}
+
+// 加权 rendezvous（最高随机权重）哈希：每个指纹对地址打分 -weight/ln(u)，取最高分，
+// 分到各指纹的概率与权重成正比。u 只取决于盐、地址和指纹名称，增删一个指纹或调整它的权重
+// 只影响分数最高的是（或变成）它的那些地址
+func rendezvousProfile(key string) BrowserProfile {
+	var best BrowserProfile
+	var bestScore float64
+	for i, profile := range browserProfiles {
+		score := -profile.Weight / math.Log(assignmentHash(key, profile.Name))
+		if i == 0 || score > bestScore {
+			best, bestScore = profile, score
+		}
+	}
+	return best
+}
+
+// 盐、地址和指纹名称的哈希，映射到 (0, 1)
+func assignmentHash(key, profile string) float64 {
+	sum := sha256.Sum256([]byte(config.profileSalt + "\x00" + key + "\x00" + profile))
+	return (float64(binary.BigEndian.Uint64(sum[:8])>>11) + 0.5) / (1 << 53)
+}
+
+// 修改覆盖后让地址重新分配：丢弃已固定的指纹、用旧指纹建立的客户端和会话（Cookie 属于旧的 User-Agent）
+func resetAddressProfile(key string) {
+	browserProfileMap.Delete(key)
+	sessionManager.Delete(key)
+	if key == defaultAddressKey {
+		defaultClients.retire()
+		return
+	}
+	if client, ok := ipv6ClientCache.LoadAndDelete(key); ok {
+		client.(*http.Client).CloseIdleConnections()
+	}
+}
+
+// 地址的指纹分配
+type assignmentInfo struct {
+	Address  string `json:"address"`
+	Profile  string `json:"profile,omitempty"`  // 当前使用（或下次使用）的指纹，random 策略下未固定时为空
+	Source   string `json:"source"`             // override / hash / random
+	Override string `json:"override,omitempty"` // 覆盖的指纹
+	Pinned   bool   `json:"pinned"`             // 是否已固定（使用过）
+}
+
+func describeAssignment(key string) assignmentInfo {
+	info := assignmentInfo{Address: key}
+	if name, ok := profileOverrides.Load(key); ok {
+		info.Override = name.(string)
+	}
+
+	// 只查看不分配：random 策略下不能为了展示而抽取随机数（会改变固定种子下的分配序列）
+	assigned, source, _ := plannedBrowserProfile(key)
+	info.Profile, info.Source = assigned.Name, source
+	if pinned, ok := browserProfileMap.Load(key); ok {
+		info.Pinned = true
+		if pinned.(BrowserProfile).Name != assigned.Name {
+			// 首次使用时的 X-Utls-Profile 提示，或 random 策略下已经选定的指纹
+			info.Profile, info.Source = pinned.(BrowserProfile).Name, "pinned"
+		}
+	}
+	return info
+}
+
+// 指纹分配管理：
+//
+//	GET    /profiles/assignments                      所有覆盖和已固定的地址
+//	GET    /profiles/assignments?ipv6=2001:db8::1     某个地址的分配
+//	PUT    /profiles/assignments?ipv6=...&profile=... 设置覆盖（ipv6 为空或 default 表示默认出口）
+//	DELETE /profiles/assignments?ipv6=...             删除覆盖，恢复按策略分配
+func profileAssignmentsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	switch r.Method {
+	case http.MethodGet:
+		if query.Has("ipv6") {
+			key, err := assignmentKey(query.Get("ipv6"))
+			if err != nil {
+				writeError(w, errorResponse{Code: codeInvalidRequest, Message: err.Error(), Status: http.StatusBadRequest})
+				return
+			}
+			writeJSON(w, http.StatusOK, describeAssignment(key))
+			return
+		}
+
+		keys := make(map[string]bool)
+		for _, m := range []*sync.Map{&profileOverrides, &browserProfileMap} {
+			m.Range(func(key, _ interface{}) bool {
+				keys[key.(string)] = true
+				return true
+			})
+		}
+		list := make([]assignmentInfo, 0, len(keys))
+		for key := range keys {
+			list = append(list, describeAssignment(key))
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Address < list[j].Address })
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"strategy":    config.profileAssignment,
+			"assignments": list,
+		})
+
+	case http.MethodPut, http.MethodPost:
+		key, err := assignmentKey(query.Get("ipv6"))
+		if err != nil {
+			writeError(w, errorResponse{Code: codeInvalidRequest, Message: err.Error(), Status: http.StatusBadRequest})
+			return
+		}
+		profile, ok := findBrowserProfile(query.Get("profile"))
+		if !ok {
+			writeError(w, errorResponse{Code: codeInvalidRequest, Message: "Unknown browser profile", Status: http.StatusBadRequest})
+			return
+		}
+
+		old, _ := profileOverrides.Swap(key, profile.Name)
+		if current, ok := browserProfileMap.Load(key); !ok || current.(BrowserProfile).Name != profile.Name {
+			resetAddressProfile(key)
+		}
+		slog.Warn("指纹覆盖已设置", "addr", key, "profile", profile.Name, "previous", old)
+		writeJSON(w, http.StatusOK, describeAssignment(key))
+
+	case http.MethodDelete:
+		key, err := assignmentKey(query.Get("ipv6"))
+		if err != nil {
+			writeError(w, errorResponse{Code: codeInvalidRequest, Message: err.Error(), Status: http.StatusBadRequest})
+			return
+		}
+		if old, loaded := profileOverrides.LoadAndDelete(key); loaded {
+			if assigned, _, ok := plannedBrowserProfile(key); !ok || assigned.Name != old.(string) {
+				resetAddressProfile(key)
+			}
+			slog.Warn("指纹覆盖已删除", "addr", key, "profile", old)
+		}
+		writeJSON(w, http.StatusOK, describeAssignment(key))
+
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST, DELETE")
+		writeError(w, errorResponse{Code: codeNotAllowed, Message: "Method not allowed", Status: http.StatusMethodNotAllowed})
+	}
+}
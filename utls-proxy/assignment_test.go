@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+)
+
+// hash 策略：同一地址始终分到同一指纹，指纹库减少一个时只有原本分到它的地址改变
+func TestRendezvousAssignmentStable(t *testing.T) {
+	saved := browserProfiles
+	defer func() { browserProfiles = saved }()
+
+	addrs := make([]string, 2000)
+	for i := range addrs {
+		addrs[i] = fmt.Sprintf("2001:db8::%x", i+1)
+	}
+
+	before := make(map[string]string, len(addrs))
+	counts := make(map[string]int)
+	for _, addr := range addrs {
+		name := rendezvousProfile(addr).Name
+		if again := rendezvousProfile(addr).Name; again != name {
+			t.Fatalf("%s 两次分配不同: %s / %s", addr, name, again)
+		}
+		before[addr] = name
+		counts[name]++
+	}
+	if len(counts) != len(browserProfiles) {
+		t.Errorf("%d 个地址只分到了 %d 个指纹: %v", len(addrs), len(counts), counts)
+	}
+
+	removed := browserProfiles[3].Name
+	browserProfiles = slices.Delete(slices.Clone(saved), 3, 4)
+	for _, addr := range addrs {
+		after := rendezvousProfile(addr).Name
+		if before[addr] != removed && after != before[addr] {
+			t.Errorf("%s 不应改变: %s -> %s", addr, before[addr], after)
+		}
+		if after == removed {
+			t.Errorf("%s 仍分到已删除的指纹", addr)
+		}
+	}
+}
+
+// 不同的盐得到不同的分配
+func TestRendezvousSalt(t *testing.T) {
+	saved := config.profileSalt
+	defer func() { config.profileSalt = saved }()
+
+	assign := func(salt string) []string {
+		config.profileSalt = salt
+		var names []string
+		for i := 1; i <= 50; i++ {
+			names = append(names, rendezvousProfile(fmt.Sprintf("2001:db8::%x", i)).Name)
+		}
+		return names
+	}
+	if slices.Equal(assign("a"), assign("b")) {
+		t.Error("不同的盐得到了相同的分配")
+	}
+}
+
+// 同一地址的不同写法共用固定的指纹，覆盖和重置按规范形式生效
+func TestAssignmentCanonicalKey(t *testing.T) {
+	startMockProxy(t)
+	const raw, canonical = "2001:DB8::0:0047", "2001:db8::47"
+	defer resetAddressProfile(canonical)
+
+	first := getBrowserProfileForIPv6(raw)
+	if pinned, ok := browserProfileMap.Load(canonical); !ok || pinned.(BrowserProfile).Name != first.Name {
+		t.Fatalf("%s 的指纹应固定在 %s 下", raw, canonical)
+	}
+	if info := describeAssignment(canonical); !info.Pinned || info.Profile != first.Name {
+		t.Errorf("分配信息: %+v", info)
+	}
+
+	other := browserProfiles[0]
+	if other.Name == first.Name {
+		other = browserProfiles[1]
+	}
+	rec := httptest.NewRecorder()
+	profileAssignmentsHandler(rec, httptest.NewRequest(http.MethodPut, "/profiles/assignments?ipv6="+url.QueryEscape(raw)+"&profile="+url.QueryEscape(other.Name), nil))
+	defer profileOverrides.Delete(canonical)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("设置覆盖: 状态码 %d", rec.Code)
+	}
+	for _, addr := range []string{raw, canonical} {
+		if got := getBrowserProfileForIPv6(addr); got.Name != other.Name {
+			t.Errorf("覆盖后 %s 仍使用 %s，应为 %s", addr, got.Name, other.Name)
+		}
+	}
+}
+
+// random 策略下查看分配不抽取随机数，固定种子时的分配序列不变
+func TestDescribeRandomAssignment(t *testing.T) {
+	startMockProxy(t)
+	config.profileAssignment = assignRandom
+	savedRng := rng
+	defer func() {
+		config.profileAssignment = assignHash
+		rng = savedRng
+	}()
+
+	const addr = "2001:db8::48"
+	defer resetAddressProfile(addr)
+
+	rng = newLockedRand(7)
+	want := weightedRandomProfile()
+	rng = newLockedRand(7)
+
+	if info := describeAssignment(addr); info.Pinned || info.Profile != "" || info.Source != assignRandom {
+		t.Errorf("未固定的地址: %+v", info)
+	}
+	if got := getBrowserProfileForIPv6(addr); got.Name != want.Name {
+		t.Errorf("查看分配后首次使用得到 %s，应为 %s", got.Name, want.Name)
+	}
+	if info := describeAssignment(addr); !info.Pinned || info.Profile != want.Name {
+		t.Errorf("已固定的地址: %+v", info)
+	}
+}
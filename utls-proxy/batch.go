@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 批量请求：POST /batch，一次提交多个 URL，结果按完成顺序流式返回
+//
+//	[{"url": "https://kh.google.com/...", "ipv6": "2001:db8::1", "priority": "high"}, ...]
+//
+// 每一项都与 /proxy 走同一处理流程（白名单、会话、熔断器、并发控制、重试），响应为 mirror 格式。
+// 同一批次内最多 UTLS_BATCH_CONCURRENCY 项同时处理（?concurrency=N 可以调低）。
+//
+// 结果格式（?format= 或 Accept 选择）：
+//   - ndjson（默认，application/x-ndjson）：每行一个 JSON，响应体 base64 编码在 body 字段
+//   - frames（application/x-utls-frames）：每帧为 4 字节大端头部长度 + JSON 头部 + 4 字节大端响应体长度 + 响应体
+//
+// 所有项完成后再输出一条 summary 记录，调用方据此判断结果是否完整
+
+const (
+	batchContentNDJSON = "application/x-ndjson"
+	batchContentFrames = "application/x-utls-frames"
+)
+
+// 批量请求中的一项
+type batchItem struct {
+	URL      string `json:"url"`
+	IPv6     string `json:"ipv6,omitempty"`
+	Priority string `json:"priority,omitempty"`
+}
+
+// 一项的结果（frames 格式下 Body 单独写在头部之后）
+type batchResult struct {
+	Index          int                 `json:"index"`
+	URL            string              `json:"url"`
+	Status         int                 `json:"status"`
+	UpstreamStatus int                 `json:"upstreamStatus,omitempty"`
+	Headers        map[string][]string `json:"headers"`
+	DurationMs     int64               `json:"durationMs"`
+	Attempts       int                 `json:"attempts,omitempty"`
+	Error          string              `json:"error,omitempty"`
+	Message        string              `json:"message,omitempty"`
+	BodyLength     int                 `json:"bodyLength"`
+	Body           []byte              `json:"body,omitempty"` // ndjson 中为 base64
+}
+
+// 批次汇总（最后一条记录）
+type batchSummary struct {
+	Items      int   `json:"items"`
+	Succeeded  int   `json:"succeeded"`
+	Failed     int   `json:"failed"`
+	DurationMs int64 `json:"durationMs"`
+}
+
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, errorResponse{Code: codeNotAllowed, Message: "Method not allowed", Status: http.StatusMethodNotAllowed})
+		return
+	}
+	if shutdownFlag.Load() {
+		writeError(w, errorResponse{Code: codeShuttingDown, Message: "Server is shutting down", Status: http.StatusServiceUnavailable})
+		return
+	}
+
+	batchID := requestID(r)
+	items, err := readBatchItems(r)
+	if err != nil {
+		writeError(w, errorResponse{Code: codeInvalidRequest, Message: err.Error(), Status: http.StatusBadRequest, RequestID: batchID})
+		return
+	}
+
+	concurrency := config.batchConcurrency
+	if v, err := strconv.Atoi(r.URL.Query().Get("concurrency")); err == nil && v > 0 && v < concurrency {
+		concurrency = v
+	}
+
+	frames := r.URL.Query().Get("format") == "frames" ||
+		(r.URL.Query().Get("format") == "" && strings.Contains(r.Header.Get("Accept"), batchContentFrames))
+
+	// 结果按完成顺序写出，整个批次可能超过服务器的写超时
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("X-Request-Id", batchID)
+	w.Header().Set("Cache-Control", "no-store")
+	if frames {
+		w.Header().Set("Content-Type", batchContentFrames)
+	} else {
+		w.Header().Set("Content-Type", batchContentNDJSON)
+	}
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	start := time.Now()
+	results := make(chan batchResult)
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	go func() {
+		defer close(results)
+		for i, item := range items {
+			select {
+			case sem <- struct{}{}:
+			case <-r.Context().Done():
+				// 调用方已断开，剩余的项不再发起
+				wg.Wait()
+				return
+			}
+			wg.Add(1)
+			go func(index int, item batchItem) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				results <- fetchBatchItem(r, batchID, index, item)
+			}(i, item)
+		}
+		wg.Wait()
+	}()
+
+	summary := batchSummary{Items: len(items)}
+	for result := range results {
+		if result.Error == "" {
+			summary.Succeeded++
+		} else {
+			summary.Failed++
+		}
+		if err := writeBatchResult(w, result, frames); err == nil {
+			rc.Flush()
+		}
+	}
+
+	summary.DurationMs = time.Since(start).Milliseconds()
+	writeBatchSummary(w, summary, frames)
+	rc.Flush()
+
+	slog.Info("批量请求完成", "request_id", batchID, "items", summary.Items, "succeeded", summary.Succeeded,
+		"failed", summary.Failed, "concurrency", concurrency, "duration_ms", summary.DurationMs)
+}
+
+// 请求体：项的数组，或 {"items": [...]}
+func readBatchItems(r *http.Request) ([]batchItem, error) {
+	data, err := io.ReadAll(io.LimitReader(r.Body, 4<<20))
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimSpace(data)
+
+	var items []batchItem
+	if len(data) > 0 && data[0] == '{' {
+		var wrapped struct {
+			Items []batchItem `json:"items"`
+		}
+		err = json.Unmarshal(data, &wrapped)
+		items = wrapped.Items
+	} else {
+		err = json.Unmarshal(data, &items)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("无效的 JSON: %w", err)
+	}
+
+	if len(items) == 0 {
+		return nil, errors.New("批量请求为空")
+	}
+	if len(items) > config.batchMaxItems {
+		return nil, fmt.Errorf("批量请求最多 %d 项", config.batchMaxItems)
+	}
+	return items, nil
+}
+
+// 以 mirror 格式处理一项：构造内部请求交给 serveProxy，记录它写出的响应
+func fetchBatchItem(parent *http.Request, batchID string, index int, item batchItem) batchResult {
+	start := time.Now()
+
+	req, _ := http.NewRequestWithContext(parent.Context(), http.MethodGet, "/batch", nil)
+	req.RemoteAddr = parent.RemoteAddr
+	req.RequestURI = "/batch"
+	req.Header.Set("User-Agent", parent.UserAgent())
+	req.Header.Set("X-Request-Id", batchID+"."+strconv.Itoa(index))
+	req.Header.Set("X-Utls-Response", responseMirror)
+	if item.Priority != "" {
+		req.Header.Set("X-Priority", item.Priority)
+	}
+	if traceparent := parent.Header.Get("Traceparent"); traceparent != "" {
+		req.Header.Set("Traceparent", traceparent)
+	}
+
+	rec := &batchRecorder{header: make(http.Header)}
+	serveProxy(rec, req, proxyTarget{url: item.URL, ipv6: item.IPv6, batch: true})
+
+	result := batchResult{
+		Index:      index,
+		URL:        item.URL,
+		Status:     rec.status,
+		Headers:    rec.header,
+		DurationMs: time.Since(start).Milliseconds(),
+	}
+
+	if code := rec.header.Get("X-Utls-Error"); code != "" {
+		// 代理自身的错误：响应体为 JSON 错误，拆到结果的字段中
+		var e errorResponse
+		json.Unmarshal(rec.body.Bytes(), &e)
+		result.Error = code
+		result.Message = e.Message
+		result.UpstreamStatus = e.UpstreamStatus
+		result.Attempts = e.Attempts
+		return result
+	}
+
+	result.UpstreamStatus = rec.status
+	result.Body = rec.body.Bytes()
+	result.BodyLength = len(result.Body)
+	if rec.status >= 400 {
+		// 上游的错误响应（mirror 格式原样返回）：保留响应体，同时按状态码计为失败
+		result.Error = statusErrorCode(rec.status)
+	}
+	return result
+}
+
+func writeBatchResult(w io.Writer, result batchResult, frames bool) error {
+	if !frames {
+		return writeNDJSON(w, result)
+	}
+
+	body := result.Body
+	result.Body = nil
+	return writeFrame(w, result, body)
+}
+
+func writeBatchSummary(w io.Writer, summary batchSummary, frames bool) error {
+	record := struct {
+		Summary batchSummary `json:"summary"`
+	}{summary}
+	if frames {
+		return writeFrame(w, record, nil)
+	}
+	return writeNDJSON(w, record)
+}
+
+func writeNDJSON(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// 帧：头部长度 + JSON 头部 + 响应体长度 + 响应体（长度均为 4 字节大端）
+func writeFrame(w io.Writer, header interface{}, body []byte) error {
+	data, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+
+	frame := make([]byte, 0, 8+len(data)+len(body))
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(data)))
+	frame = append(frame, data...)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(body)))
+	frame = append(frame, body...)
+
+	_, err = w.Write(frame)
+	return err
+}
+
+// 记录 serveProxy 写出的响应
+type batchRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *batchRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *batchRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *batchRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.body.Write(b)
+}
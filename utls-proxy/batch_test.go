@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"zeromaps-utls-proxy/mockupstream"
+)
+
+// frames 格式：成功、上游 404、不在白名单中的项分别返回，404 保留响应体但计为失败
+func TestBatchFrames(t *testing.T) {
+	_, proxy := startMockProxy(t)
+
+	const tile = "/rt/earth/NodeData/pb=!1m2!1s0!2u41"
+	body := `{"items": [
+		{"url": "https://kh.google.com` + tile + `"},
+		{"url": "https://kh.google.com/missing"},
+		{"url": "https://example.com/"}
+	]}`
+	req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/batch", strings.NewReader(body))
+	req.Header.Set("Accept", batchContentFrames)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != batchContentFrames {
+		t.Fatalf("状态码 %d，Content-Type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	results := make(map[int]batchResult)
+	var summary *batchSummary
+	for {
+		header, payload, err := readFrame(resp.Body)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var record struct {
+			batchResult
+			Summary *batchSummary `json:"summary"`
+		}
+		if err := json.Unmarshal(header, &record); err != nil {
+			t.Fatalf("无效的帧头部 %q: %v", header, err)
+		}
+		if record.Summary != nil {
+			summary = record.Summary
+			continue
+		}
+		if record.BodyLength != len(payload) {
+			t.Errorf("第 %d 项: bodyLength %d，实际 %d 字节", record.Index, record.BodyLength, len(payload))
+		}
+		record.Body = payload
+		results[record.Index] = record.batchResult
+	}
+
+	if r := results[0]; r.Status != http.StatusOK || r.Error != "" || !bytes.Equal(r.Body, mockupstream.Payload(tile, 1024)) {
+		t.Errorf("成功的项: %+v", r)
+	}
+	if r := results[1]; r.Status != http.StatusNotFound || r.UpstreamStatus != http.StatusNotFound ||
+		r.Error != codeUpstream4xx || len(r.Body) == 0 {
+		t.Errorf("上游 404: %+v", r)
+	}
+	if r := results[2]; r.Status != http.StatusBadRequest || r.Error != codeNotAllowed || r.Message == "" || len(r.Body) != 0 {
+		t.Errorf("不在白名单中: %+v", r)
+	}
+	if summary == nil || summary.Items != 3 || summary.Succeeded != 1 || summary.Failed != 2 {
+		t.Errorf("summary: %+v", summary)
+	}
+}
+
+// 请求方法或请求体无效时整个批次返回错误
+func TestBatchInvalid(t *testing.T) {
+	_, proxy := startMockProxy(t)
+
+	resp, err := http.Get(proxy.URL + "/batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != http.MethodPost {
+		t.Errorf("GET: 状态码 %d", resp.StatusCode)
+	}
+
+	tooMany := "[" + strings.Repeat(`{"url": "https://kh.google.com/"},`, config.batchMaxItems) + `{"url": "https://kh.google.com/"}]`
+	for name, body := range map[string]string{
+		"空批次":     `[]`,
+		"空 items": `{"items": []}`,
+		"无效 JSON": `[{"url": `,
+		"超过上限":    tooMany,
+	} {
+		resp, err := http.Post(proxy.URL+"/batch", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest || resp.Header.Get("X-Utls-Error") != codeInvalidRequest {
+			t.Errorf("%s: 状态码 %d，%q", name, resp.StatusCode, resp.Header.Get("X-Utls-Error"))
+		}
+	}
+}
+
+func readFrame(r io.Reader) (header, body []byte, err error) {
+	read := func() ([]byte, error) {
+		var length [4]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return nil, err
+		}
+		data := make([]byte, binary.BigEndian.Uint32(length[:]))
+		_, err := io.ReadFull(r, data)
+		return data, err
+	}
+	if header, err = read(); err != nil {
+		return nil, nil, err
+	}
+	if body, err = read(); err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return header, body, err
+}
+
+// 重试后仍是 5xx 的项计为失败
+func TestBatchUpstream5xx(t *testing.T) {
+	mock, proxy := startMockProxy(t)
+	saved := mock.Behavior()
+	defer mock.SetBehavior(saved)
+	b := saved
+	b.UnavailableNext = config.maxRetries + 1
+	b.FaultHosts = []string{"kh.google.com"}
+	mock.SetBehavior(b)
+
+	resp, err := http.Post(proxy.URL+"/batch", "application/json",
+		strings.NewReader(`[{"url": "https://kh.google.com/rt/earth/NodeData/pb=!1m2!1s0!2u42"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	var result batchResult
+	var summary struct {
+		Summary batchSummary `json:"summary"`
+	}
+	if err := dec.Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if err := dec.Decode(&summary); err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != http.StatusServiceUnavailable || result.Error != codeUpstream5xx {
+		t.Errorf("上游 503: %+v", result)
+	}
+	if summary.Summary.Succeeded != 0 || summary.Summary.Failed != 1 {
+		t.Errorf("summary: %+v", summary.Summary)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 默认出口（无 IPv6）的客户端：固定数量（UTLS_DEFAULT_CLIENTS）的长期客户端，轮流使用
+//   - 全部使用默认会话固定的浏览器指纹，与共享的 Cookie 保持一致
+//   - 默认会话过期被清理、指纹重新分配后，整组客户端按新指纹重建；旧客户端在处理中的请求结束后断开连接
+//   - 关闭时断开所有连接（见 shutdown.go）
+
+var defaultClients = &defaultClientSet{}
+
+type defaultClientSet struct {
+	mu      sync.Mutex
+	profile string           // 当前这组客户端使用的指纹（空 = 尚未创建）
+	clients []*defaultClient // 当前这组客户端
+	next    atomic.Uint64    // 轮询位置
+
+	created  atomic.Int64 // 创建的客户端总数
+	retired  atomic.Int64 // 因指纹变更、会话过期或关闭而退役的客户端总数
+	requests atomic.Int64 // 借出次数
+}
+
+type defaultClient struct {
+	client   *http.Client
+	inFlight atomic.Int64
+	requests atomic.Int64
+}
+
+// 借出一个默认客户端，用完后调用 release；同时返回它使用的指纹
+func (s *defaultClientSet) acquire() (*http.Client, BrowserProfile, func()) {
+	profile := getBrowserProfileForIPv6("")
+
+	s.mu.Lock()
+	if s.profile != profile.Name {
+		s.rebuildLocked(profile)
+	}
+	c := s.clients[s.next.Add(1)%uint64(len(s.clients))]
+	s.mu.Unlock()
+
+	c.inFlight.Add(1)
+	c.requests.Add(1)
+	s.requests.Add(1)
+	return c.client, profile, func() { c.inFlight.Add(-1) }
+}
+
+// 按指纹创建一组新的客户端，旧的一组退役
+func (s *defaultClientSet) rebuildLocked(profile BrowserProfile) {
+	if s.profile != "" {
+		slog.Info("默认出口指纹已变更，重建默认客户端", "from", s.profile, "to", profile.Name)
+	}
+	s.retireLocked()
+
+	s.clients = make([]*defaultClient, config.defaultClients)
+	for i := range s.clients {
+		s.clients[i] = &defaultClient{client: newUTLSClient(newUpstreamDialer(nil), profile)}
+	}
+	s.profile = profile.Name
+	s.created.Add(int64(len(s.clients)))
+}
+
+// 默认会话过期后调用：退役当前这组客户端，下次使用时按重新分配的指纹创建
+func (s *defaultClientSet) retire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.profile != "" {
+		slog.Debug("默认会话已过期，退役默认客户端", "profile", s.profile)
+	}
+	s.retireLocked()
+}
+
+func (s *defaultClientSet) retireLocked() {
+	for _, c := range s.clients {
+		go closeWhenIdle(c)
+	}
+	s.retired.Add(int64(len(s.clients)))
+	s.clients = nil
+	s.profile = ""
+}
+
+// 等处理中的请求结束（最多一个请求超时）后断开连接
+func closeWhenIdle(c *defaultClient) {
+	deadline := time.Now().Add(config.requestTimeout)
+	for c.inFlight.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+	}
+	c.client.CloseIdleConnections()
+}
+
+// 关闭时断开所有连接
+func (s *defaultClientSet) close() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := len(s.clients)
+	for _, c := range s.clients {
+		c.client.CloseIdleConnections()
+	}
+	s.retired.Add(int64(n))
+	s.clients = nil
+	s.profile = ""
+	return n
+}
+
+// 默认客户端统计（用于 /health）
+type defaultClientStats struct {
+	Size      int     `json:"size"`    // 配置的客户端数
+	Live      int     `json:"live"`    // 当前这组客户端数（首次使用前为 0）
+	Profile   string  `json:"profile"` // 当前使用的指纹
+	InFlight  int64   `json:"inFlight"`
+	Requests  int64   `json:"requests"`
+	PerClient []int64 `json:"perClientRequests"` // 当前这组中每个客户端的借出次数
+	Created   int64   `json:"created"`
+	Retired   int64   `json:"retired"`
+}
+
+func (s *defaultClientSet) snapshot() defaultClientStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := defaultClientStats{
+		Size:      config.defaultClients,
+		Live:      len(s.clients),
+		Profile:   s.profile,
+		Requests:  s.requests.Load(),
+		PerClient: make([]int64, 0, len(s.clients)),
+		Created:   s.created.Load(),
+		Retired:   s.retired.Load(),
+	}
+	for _, c := range s.clients {
+		st.InFlight += c.inFlight.Load()
+		st.PerClient = append(st.PerClient, c.requests.Load())
+	}
+	return st
+}
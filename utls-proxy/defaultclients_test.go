@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+// 默认客户端轮流借出；会话过期退役后、指纹变更后按新指纹重建整组
+func TestDefaultClientSet(t *testing.T) {
+	startMockProxy(t)
+	saved, _ := browserProfileMap.Load(defaultAddressKey)
+	defer func() {
+		if saved != nil {
+			browserProfileMap.Store(defaultAddressKey, saved)
+		} else {
+			browserProfileMap.Delete(defaultAddressKey)
+		}
+	}()
+
+	s := &defaultClientSet{}
+	size := config.defaultClients
+	if size < 2 {
+		t.Skip("UTLS_DEFAULT_CLIENTS < 2")
+	}
+
+	var clients []*http.Client
+	var releases []func()
+	for range 2 * size {
+		client, profile, release := s.acquire()
+		if profile.Name != getBrowserProfileForIPv6("").Name {
+			t.Errorf("借出的指纹 %s，默认出口为 %s", profile.Name, getBrowserProfileForIPv6("").Name)
+		}
+		clients = append(clients, client)
+		releases = append(releases, release)
+	}
+	for i := range size {
+		if clients[i] != clients[i+size] || (i > 0 && clients[i] == clients[i-1]) {
+			t.Fatalf("应当轮流借出 %d 个客户端", size)
+		}
+	}
+	st := s.snapshot()
+	if st.Live != size || st.InFlight != int64(2*size) || st.Created != int64(size) ||
+		slices.ContainsFunc(st.PerClient, func(n int64) bool { return n != 2 }) {
+		t.Errorf("借出后: %+v", st)
+	}
+	for _, release := range releases {
+		release()
+	}
+
+	// 借出的客户端可以直接请求上游
+	resp, err := clients[0].Get("https://www.google.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("状态码 %d", resp.StatusCode)
+	}
+
+	// 会话过期：退役，下次借出时重建
+	s.retire()
+	if st := s.snapshot(); st.Live != 0 || st.Profile != "" || st.Retired != int64(size) {
+		t.Errorf("退役后: %+v", st)
+	}
+	client, _, release := s.acquire()
+	release()
+	if slices.Contains(clients, client) || s.snapshot().Created != int64(2*size) {
+		t.Errorf("退役后应创建新的客户端: %+v", s.snapshot())
+	}
+
+	// 指纹变更：整组按新指纹重建
+	current := getBrowserProfileForIPv6("")
+	other := browserProfiles[0]
+	if other.Name == current.Name {
+		other = browserProfiles[1]
+	}
+	browserProfileMap.Store(defaultAddressKey, other)
+	_, profile, release := s.acquire()
+	release()
+	if profile.Name != other.Name {
+		t.Errorf("指纹变更后借出 %s，应为 %s", profile.Name, other.Name)
+	}
+	if st := s.snapshot(); st.Profile != other.Name || st.Created != int64(3*size) || st.Retired != int64(2*size) {
+		t.Errorf("指纹变更后: %+v", st)
+	}
+
+	if n := s.close(); n != size || s.snapshot().Live != 0 {
+		t.Errorf("关闭: %d", n)
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// 内置 DNS 解析器：
+//   - A / AAAA 分别查询、分别缓存，缓存时间遵循记录的 TTL（限制在 min/max 之间）
+//   - 解析失败短暂缓存（negative TTL），避免故障时反复查询
+//   - 上游服务器由 UTLS_DNS_SERVERS 指定，按顺序重试，UDP 截断时改用 TCP
+//   - 同一域名的并发查询合并为一次
+//
+// 未设置 UTLS_DNS_SERVERS 时不启用，仍由系统解析（遵循 /etc/hosts 和 nsswitch）
+
+var resolver *dnsResolver // nil = 系统解析
+
+type dnsCacheKey struct {
+	host  string
+	qtype dnsmessage.Type
+}
+
+type dnsCacheEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// 正在进行的查询（并发请求共享结果）
+type dnsCall struct {
+	done  chan struct{}
+	entry dnsCacheEntry
+}
+
+type dnsResolver struct {
+	servers     []string // ip:port
+	minTTL      time.Duration
+	maxTTL      time.Duration
+	negativeTTL time.Duration
+	timeout     time.Duration // 单个服务器的查询超时
+
+	mu       sync.Mutex
+	cache    map[dnsCacheKey]dnsCacheEntry
+	inflight map[dnsCacheKey]*dnsCall
+
+	queries   atomic.Int64 // 调用次数
+	cacheHits atomic.Int64
+	lookups   atomic.Int64 // 实际发往上游的查询
+	failures  atomic.Int64 // 解析失败次数
+	serverErr sync.Map     // 服务器 -> *atomic.Int64 失败次数
+}
+
+func newDNSResolver(servers []string) *dnsResolver {
+	normalized := make([]string, 0, len(servers))
+	for _, server := range servers {
+		server = strings.TrimSpace(server)
+		if server == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+		}
+		normalized = append(normalized, server)
+	}
+
+	return &dnsResolver{
+		servers:     normalized,
+		minTTL:      config.dnsMinTTL,
+		maxTTL:      config.dnsMaxTTL,
+		negativeTTL: config.dnsNegativeTTL,
+		timeout:     3 * time.Second,
+		cache:       make(map[dnsCacheKey]dnsCacheEntry),
+		inflight:    make(map[dnsCacheKey]*dnsCall),
+	}
+}
+
+// 按网络类型解析：tcp6 只查 AAAA，tcp4 只查 A，tcp 先 A 后 AAAA
+func (r *dnsResolver) lookupHost(ctx context.Context, network, host string) ([]net.IP, error) {
+	switch network {
+	case "tcp6":
+		return r.lookup(ctx, host, dnsmessage.TypeAAAA)
+	case "tcp4":
+		return r.lookup(ctx, host, dnsmessage.TypeA)
+	}
+
+	ips4, err4 := r.lookup(ctx, host, dnsmessage.TypeA)
+	ips6, err6 := r.lookup(ctx, host, dnsmessage.TypeAAAA)
+	if len(ips4)+len(ips6) > 0 {
+		return append(ips4, ips6...), nil
+	}
+	if err4 != nil {
+		return nil, err4
+	}
+	return nil, err6
+}
+
+func (r *dnsResolver) lookup(ctx context.Context, host string, qtype dnsmessage.Type) ([]net.IP, error) {
+	r.queries.Add(1)
+	key := dnsCacheKey{host: strings.ToLower(strings.TrimSuffix(host, ".")), qtype: qtype}
+
+	r.mu.Lock()
+	if entry, ok := r.cache[key]; ok && time.Now().Before(entry.expires) {
+		r.mu.Unlock()
+		r.cacheHits.Add(1)
+		return entry.ips, entry.err
+	}
+	if call, ok := r.inflight[key]; ok {
+		r.mu.Unlock()
+		select {
+		case <-call.done:
+			return call.entry.ips, call.entry.err
+		case <-ctx.Done():
+			return nil, &net.DNSError{Err: ctx.Err().Error(), Name: host, IsTimeout: true}
+		}
+	}
+	call := &dnsCall{done: make(chan struct{})}
+	r.inflight[key] = call
+	r.mu.Unlock()
+
+	// 查询不随单个请求取消，结果供所有等待者使用
+	queryCtx, cancel := context.WithTimeout(context.Background(), r.timeout*time.Duration(len(r.servers)+1))
+	entry := r.query(queryCtx, key.host, qtype)
+	cancel()
+
+	r.mu.Lock()
+	r.cache[key] = entry
+	delete(r.inflight, key)
+	r.mu.Unlock()
+
+	call.entry = entry
+	close(call.done)
+
+	return entry.ips, entry.err
+}
+
+// 依次向上游服务器查询
+func (r *dnsResolver) query(ctx context.Context, host string, qtype dnsmessage.Type) dnsCacheEntry {
+	r.lookups.Add(1)
+
+	if len(r.servers) == 0 {
+		return r.querySystem(ctx, host, qtype)
+	}
+
+	var lastErr *net.DNSError
+	for _, server := range r.servers {
+		ips, ttl, err := r.exchange(ctx, server, host, qtype)
+		if err == nil {
+			return dnsCacheEntry{ips: ips, expires: time.Now().Add(r.clampTTL(ttl))}
+		}
+
+		lastErr = err
+		if err.IsNotFound {
+			break // 权威的“不存在”，不必再问其他服务器
+		}
+		counter, _ := r.serverErr.LoadOrStore(server, new(atomic.Int64))
+		counter.(*atomic.Int64).Add(1)
+	}
+
+	r.failures.Add(1)
+	return dnsCacheEntry{err: lastErr, expires: time.Now().Add(r.negativeTTL)}
+}
+
+// 未配置服务器时使用系统解析（拿不到 TTL，按 minTTL 缓存）
+func (r *dnsResolver) querySystem(ctx context.Context, host string, qtype dnsmessage.Type) dnsCacheEntry {
+	network := "ip4"
+	if qtype == dnsmessage.TypeAAAA {
+		network = "ip6"
+	}
+
+	ips, err := net.DefaultResolver.LookupIP(ctx, network, host)
+	if err != nil {
+		r.failures.Add(1)
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) {
+			dnsErr = &net.DNSError{Err: err.Error(), Name: host}
+		}
+		return dnsCacheEntry{err: dnsErr, expires: time.Now().Add(r.negativeTTL)}
+	}
+	return dnsCacheEntry{ips: ips, expires: time.Now().Add(r.minTTL)}
+}
+
+func (r *dnsResolver) clampTTL(ttl time.Duration) time.Duration {
+	if ttl < r.minTTL {
+		return r.minTTL
+	}
+	if r.maxTTL > 0 && ttl > r.maxTTL {
+		return r.maxTTL
+	}
+	return ttl
+}
+
+// 向单个服务器查询：先 UDP，响应被截断时改用 TCP
+func (r *dnsResolver) exchange(ctx context.Context, server, host string, qtype dnsmessage.Type) ([]net.IP, time.Duration, *net.DNSError) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: "invalid name", Name: host, Server: server, IsNotFound: true}
+	}
+
+	id := binary.BigEndian.Uint16(randomID(8))
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: host, Server: server}
+	}
+
+	resp, err := r.roundTrip(ctx, "udp", server, packed)
+	if err == nil && resp.Truncated {
+		resp, err = r.roundTrip(ctx, "tcp", server, packed)
+	}
+	if err != nil {
+		var netErr net.Error
+		timeout := errors.As(err, &netErr) && netErr.Timeout()
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: host, Server: server, IsTimeout: timeout, IsTemporary: true}
+	}
+	if resp.ID != id {
+		return nil, 0, &net.DNSError{Err: "response id mismatch", Name: host, Server: server, IsTemporary: true}
+	}
+
+	switch resp.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host, Server: server, IsNotFound: true}
+	default:
+		return nil, 0, &net.DNSError{Err: "server returned " + resp.RCode.String(), Name: host, Server: server, IsTemporary: true}
+	}
+
+	var ips []net.IP
+	var minTTL uint32
+	for _, answer := range resp.Answers {
+		var ip net.IP
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			ip = net.IP(body.A[:])
+		case *dnsmessage.AAAAResource:
+			ip = net.IP(body.AAAA[:])
+		default:
+			continue // CNAME 等：递归服务器已经给出最终记录
+		}
+		if answer.Header.Type != qtype {
+			continue
+		}
+		if len(ips) == 0 || answer.Header.TTL < minTTL {
+			minTTL = answer.Header.TTL
+		}
+		ips = append(ips, ip)
+	}
+
+	if len(ips) == 0 {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host, Server: server, IsNotFound: true}
+	}
+	return ips, time.Duration(minTTL) * time.Second, nil
+}
+
+func (r *dnsResolver) roundTrip(ctx context.Context, network, server string, query []byte) (*dnsmessage.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	var buf []byte
+	if network == "tcp" {
+		// TCP 报文带 2 字节长度前缀
+		framed := make([]byte, 2+len(query))
+		binary.BigEndian.PutUint16(framed, uint16(len(query)))
+		copy(framed[2:], query)
+		if _, err := conn.Write(framed); err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		buf = make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		buf = make([]byte, 4096)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		buf = buf[:n]
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(buf); err != nil {
+		return nil, fmt.Errorf("解析 DNS 响应失败: %w", err)
+	}
+	return &msg, nil
+}
+
+// 清理过期缓存（由定期资源清理任务调用）
+func (r *dnsResolver) cleanExpired() int {
+	if r == nil {
+		return 0
+	}
+	now := time.Now()
+	removed := 0
+	r.mu.Lock()
+	for key, entry := range r.cache {
+		if now.After(entry.expires) {
+			delete(r.cache, key)
+			removed++
+		}
+	}
+	r.mu.Unlock()
+	return removed
+}
+
+// DNS 解析统计（用于 /health）
+type dnsStats struct {
+	Servers      []string         `json:"servers"` // 空 = 系统解析（以下计数均为 0）
+	Queries      int64            `json:"queries"`
+	CacheHits    int64            `json:"cacheHits"`
+	Lookups      int64            `json:"lookups"`
+	Failures     int64            `json:"failures"`
+	CacheEntries int              `json:"cacheEntries"`
+	ServerErrors map[string]int64 `json:"serverErrors"`
+	EdgePins     int64            `json:"edgePins"`   // 固定边缘 IP 的次数
+	EdgeUnpins   int64            `json:"edgeUnpins"` // 固定的边缘 IP 失效的次数
+}
+
+func dnsSnapshot() dnsStats {
+	s := dnsStats{
+		ServerErrors: make(map[string]int64),
+		EdgePins:     edgePinCount.Load(),
+		EdgeUnpins:   edgeUnpinCount.Load(),
+	}
+	r := resolver
+	if r == nil {
+		return s
+	}
+
+	s.Servers = r.servers
+	s.Queries = r.queries.Load()
+	s.CacheHits = r.cacheHits.Load()
+	s.Lookups = r.lookups.Load()
+	s.Failures = r.failures.Load()
+	r.mu.Lock()
+	s.CacheEntries = len(r.cache)
+	r.mu.Unlock()
+	r.serverErr.Range(func(key, value interface{}) bool {
+		s.ServerErrors[key.(string)] = value.(*atomic.Int64).Load()
+		return true
+	})
+	return s
+}
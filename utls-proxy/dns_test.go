@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// 测试用 DNS 服务器（同一端口上的 UDP 和 TCP），记录每个域名收到的查询
+type fakeDNS struct {
+	addr string
+	udp  net.PacketConn
+	tcp  net.Listener
+
+	mu      sync.Mutex
+	delay   time.Duration  // 每个响应的延迟
+	queries map[string]int // "udp big.test." -> 次数
+}
+
+func startFakeDNS(t *testing.T) *fakeDNS {
+	t.Helper()
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		udp.Close()
+		t.Skipf("无法在同一端口监听 TCP: %v", err)
+	}
+	f := &fakeDNS{addr: udp.LocalAddr().String(), udp: udp, tcp: tcp, queries: make(map[string]int)}
+	t.Cleanup(func() {
+		udp.Close()
+		tcp.Close()
+	})
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := f.answer("udp", buf[:n]); resp != nil {
+				udp.WriteTo(resp, from)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var length [2]byte
+				if _, err := io.ReadFull(conn, length[:]); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				resp := f.answer("tcp", query)
+				binary.BigEndian.PutUint16(length[:], uint16(len(resp)))
+				conn.Write(append(length[:], resp...))
+			}()
+		}
+	}()
+	return f
+}
+
+// 记录：
+//   - edge.test  A 127.0.0.1（TTL 5）
+//   - long.test  A 127.0.0.2（TTL 3600）
+//   - big.test   UDP 返回截断，TCP 返回两条 A 记录
+//   - 其他域名   NXDOMAIN
+//
+// 没有 AAAA 记录
+func (f *fakeDNS) answer(network string, query []byte) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil || len(msg.Questions) != 1 {
+		return nil
+	}
+	q := msg.Questions[0]
+	name := q.Name.String()
+
+	f.mu.Lock()
+	f.queries[network+" "+name]++
+	delay := f.delay
+	f.mu.Unlock()
+	time.Sleep(delay)
+
+	resp := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: msg.ID, Response: true, RecursionAvailable: true},
+		Questions: msg.Questions,
+	}
+	a := func(ttl uint32, ip ...byte) dnsmessage.Resource {
+		return dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+			Body:   &dnsmessage.AResource{A: [4]byte(ip)},
+		}
+	}
+	switch {
+	case q.Type != dnsmessage.TypeA:
+		// NOERROR，没有记录
+	case name == "edge.test.":
+		resp.Answers = []dnsmessage.Resource{a(5, 127, 0, 0, 1)}
+	case name == "long.test.":
+		resp.Answers = []dnsmessage.Resource{a(3600, 127, 0, 0, 2)}
+	case name == "big.test." && network == "udp":
+		resp.Truncated = true
+	case name == "big.test.":
+		resp.Answers = []dnsmessage.Resource{a(300, 127, 0, 0, 3), a(60, 127, 0, 0, 4)}
+	default:
+		resp.RCode = dnsmessage.RCodeNameError
+	}
+
+	packed, _ := resp.Pack()
+	return packed
+}
+
+func (f *fakeDNS) count(key string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.queries[key]
+}
+
+func newTestResolver(servers ...string) *dnsResolver {
+	r := newDNSResolver(servers)
+	r.minTTL = 30 * time.Second
+	r.maxTTL = 10 * time.Minute
+	r.negativeTTL = time.Minute
+	r.timeout = time.Second
+	return r
+}
+
+// 缓存时间取记录的 TTL 并限制在 min/max 之间；命中缓存时不再查询
+func TestDNSResolverTTL(t *testing.T) {
+	f := startFakeDNS(t)
+	r := newTestResolver(f.addr)
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		host string
+		ip   string
+		ttl  time.Duration
+	}{
+		{"edge.test", "127.0.0.1", r.minTTL},
+		{"long.test", "127.0.0.2", r.maxTTL},
+	} {
+		for range 2 {
+			ips, err := r.lookupHost(ctx, "tcp4", tc.host)
+			if err != nil || len(ips) != 1 || ips[0].String() != tc.ip {
+				t.Fatalf("%s: %v %v", tc.host, ips, err)
+			}
+		}
+		if n := f.count("udp " + tc.host + "."); n != 1 {
+			t.Errorf("%s: 查询了 %d 次，第二次应命中缓存", tc.host, n)
+		}
+
+		r.mu.Lock()
+		remaining := time.Until(r.cache[dnsCacheKey{host: tc.host, qtype: dnsmessage.TypeA}].expires)
+		r.mu.Unlock()
+		if remaining > tc.ttl || remaining < tc.ttl-5*time.Second {
+			t.Errorf("%s: 缓存剩余 %v，应为 %v", tc.host, remaining, tc.ttl)
+		}
+	}
+	if r.cacheHits.Load() != 2 || r.lookups.Load() != 2 {
+		t.Errorf("命中 %d，实际查询 %d", r.cacheHits.Load(), r.lookups.Load())
+	}
+
+	// tcp 同时查 A 和 AAAA，没有 AAAA 记录不影响结果
+	if ips, err := r.lookupHost(ctx, "tcp", "Edge.test."); err != nil || len(ips) != 1 {
+		t.Errorf("tcp: %v %v", ips, err)
+	}
+	if _, err := r.lookupHost(ctx, "tcp6", "edge.test"); !isNotFound(err) {
+		t.Errorf("tcp6 没有 AAAA 记录: %v", err)
+	}
+}
+
+// UDP 响应被截断时改用 TCP，TTL 取所有记录中最小的
+func TestDNSResolverTruncated(t *testing.T) {
+	f := startFakeDNS(t)
+	r := newTestResolver(f.addr)
+
+	ips, err := r.lookupHost(context.Background(), "tcp4", "big.test")
+	if err != nil || len(ips) != 2 {
+		t.Fatalf("%v %v", ips, err)
+	}
+	if f.count("udp big.test.") != 1 || f.count("tcp big.test.") != 1 {
+		t.Errorf("UDP %d 次，TCP %d 次", f.count("udp big.test."), f.count("tcp big.test."))
+	}
+
+	r.mu.Lock()
+	remaining := time.Until(r.cache[dnsCacheKey{host: "big.test", qtype: dnsmessage.TypeA}].expires)
+	r.mu.Unlock()
+	if remaining > time.Minute || remaining < 55*time.Second {
+		t.Errorf("缓存剩余 %v，应为 60s", remaining)
+	}
+}
+
+// 不存在的域名短暂缓存；不可用的服务器计入错误后换下一个
+func TestDNSResolverFailures(t *testing.T) {
+	f := startFakeDNS(t)
+
+	// 先占用再释放一个端口，作为不可用的服务器
+	dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := dead.LocalAddr().String()
+	dead.Close()
+
+	r := newTestResolver(deadAddr, f.addr)
+	r.timeout = 200 * time.Millisecond
+	ctx := context.Background()
+
+	if ips, err := r.lookupHost(ctx, "tcp4", "edge.test"); err != nil || len(ips) != 1 {
+		t.Fatalf("第二个服务器: %v %v", ips, err)
+	}
+	if n, ok := r.serverErr.Load(deadAddr); !ok || n.(*atomic.Int64).Load() != 1 {
+		t.Errorf("不可用的服务器未计入错误")
+	}
+
+	for range 2 {
+		_, err := r.lookupHost(ctx, "tcp4", "missing.test")
+		if !isNotFound(err) {
+			t.Fatalf("不存在的域名: %v", err)
+		}
+	}
+	if n := f.count("udp missing.test."); n != 1 {
+		t.Errorf("不存在的域名查询了 %d 次，应命中负缓存", n)
+	}
+	if r.failures.Load() != 1 {
+		t.Errorf("失败次数 %d", r.failures.Load())
+	}
+}
+
+// 同一域名的并发查询合并为一次
+func TestDNSResolverSingleflight(t *testing.T) {
+	f := startFakeDNS(t)
+	f.mu.Lock()
+	f.delay = 100 * time.Millisecond
+	f.mu.Unlock()
+	r := newTestResolver(f.addr)
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := r.lookupHost(context.Background(), "tcp4", "edge.test"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := f.count("udp edge.test."); n != 1 {
+		t.Errorf("并发查询发出了 %d 次", n)
+	}
+}
+
+// UTLS_DNS_PIN_EDGE：同一出口首次连上的边缘 IP 固定下来（多个客户端共用），连接失败时重新解析
+func TestUpstreamDialerPinEdge(t *testing.T) {
+	f := startFakeDNS(t)
+	savedResolver, savedPin := resolver, config.dnsPinEdge
+	resolver = newTestResolver(f.addr)
+	config.dnsPinEdge = true
+	defer func() { resolver, config.dnsPinEdge = savedResolver, savedPin }()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	addr := net.JoinHostPort("edge.test", port)
+
+	// 默认出口的两个客户端
+	d1, d2 := newUpstreamDialer(nil), newUpstreamDialer(nil)
+	key := d1.pinKey(addr)
+	defer edgePins.Delete(key)
+	pins, unpins := edgePinCount.Load(), edgeUnpinCount.Load()
+	for _, d := range []*upstreamDialer{d1, d2, d1} {
+		conn, err := d.dial(context.Background(), addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	if pinned, ok := edgePins.Load(key); !ok || pinned != ln.Addr().String() || edgePinCount.Load() != pins+1 {
+		t.Errorf("固定的边缘 IP: %v，固定 %d 次", pinned, edgePinCount.Load()-pins)
+	}
+	if d2.pinKey(addr) != key || newUpstreamDialer(&net.TCPAddr{IP: net.ParseIP("::1")}).pinKey(addr) == key {
+		t.Error("同一出口的客户端应共用固定的边缘 IP，不同出口分别固定")
+	}
+
+	// 固定的 IP 不可用：丢弃后重新解析（解析结果同样不可用，连接失败）
+	ln.Close()
+	if _, err := d2.dial(context.Background(), addr); err == nil {
+		t.Error("监听已关闭，连接应失败")
+	}
+	if _, ok := edgePins.Load(key); ok || edgeUnpinCount.Load() != unpins+1 {
+		t.Error("连接失败后应取消固定")
+	}
+}
+
+// 未设置 UTLS_DNS_SERVERS 时由系统解析（/etc/hosts 生效），统计为空
+func TestSystemResolver(t *testing.T) {
+	saved := resolver
+	resolver = nil
+	defer func() { resolver = saved }()
+
+	ips, err := lookupUpstream(context.Background(), "tcp4", "localhost")
+	if err != nil || len(ips) == 0 || !ips[0].IsLoopback() {
+		t.Errorf("localhost: %v %v", ips, err)
+	}
+	if s := dnsSnapshot(); s.Servers != nil || s.Queries != 0 || s.CacheEntries != 0 {
+		t.Errorf("系统解析时的统计: %+v", s)
+	}
+	if n := resolver.cleanExpired(); n != 0 {
+		t.Errorf("cleanExpired: %d", n)
+	}
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
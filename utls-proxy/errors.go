@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+
+	"golang.org/x/net/http2"
+)
+
+// 错误分类：稳定的错误码，同时用于 JSON 错误响应、X-Utls-Error 响应头、访问日志的 error 字段和 Span 的 error.type
+// 网络错误只按类型分类（errors.Is / errors.As / net.Error），不解析错误字符串
+const (
+	codeInvalidRequest     = "invalid_request"        // 参数、URL 或请求体无效
+	codeNotAllowed         = "not_allowed"            // 域名或请求方法不在白名单中
+	codeAddressUnavailable = "address_unavailable"    // 出口地址无效或不在本机
+	codeBreakerOpen        = "breaker_open"           // 该地址熔断中
+	codeOverloaded         = "overloaded"             // 排队已满或排队超时
+	codeShuttingDown       = "shutting_down"          // 正在关闭
+	codeSessionRefresh     = "session_refresh_failed" // 403 后强制刷新会话失败
+	codeUpstreamTimeout    = "upstream_timeout"       // 连接或请求上游超时
+	codeDNS                = "dns"                    // 上游域名解析失败
+	codeTLSHandshake       = "tls_handshake"          // uTLS 握手失败（含证书校验）
+	codeConnectionReset    = "connection_reset"       // 连接被重置或提前关闭（含 HTTP/2 GOAWAY、RST_STREAM）
+	codeNetwork            = "network"                // 其他网络错误（如连接被拒绝）
+	codeUpstream4xx        = "upstream_4xx"           // 上游 4xx（重试后仍失败）
+	codeUpstream5xx        = "upstream_5xx"           // 上游 5xx（重试后仍失败）
+	codeDecode             = "decode_failed"          // 响应体解压失败
+	codeClientCancelled    = "client_cancelled"       // 调用方已断开
+)
+
+// 调用方断开时记录的状态码（与 nginx 一致，只出现在访问日志中）
+const statusClientClosedRequest = 499
+
+// 调用方稍后重试可能成功的错误
+var retryableCodes = map[string]bool{
+	codeBreakerOpen:     true,
+	codeOverloaded:      true,
+	codeShuttingDown:    true,
+	codeSessionRefresh:  true,
+	codeUpstreamTimeout: true,
+	codeDNS:             true,
+	codeTLSHandshake:    true,
+	codeConnectionReset: true,
+	codeNetwork:         true,
+	codeUpstream5xx:     true,
+}
+
+// uTLS 握手失败（与 TCP 连接阶段的错误区分）
+type tlsHandshakeError struct {
+	err error
+}
+
+func (e *tlsHandshakeError) Error() string {
+	return "TLS 握手失败: " + e.err.Error()
+}
+
+func (e *tlsHandshakeError) Unwrap() error {
+	return e.err
+}
+
+// 上游请求错误的分类
+func errorClass(err error) string {
+	var dnsErr *net.DNSError
+	var handshakeErr *tlsHandshakeError
+	var netErr net.Error
+	var goAway http2.GoAwayError
+	var streamErr http2.StreamError
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return codeClientCancelled
+	case errors.As(err, &dnsErr):
+		return codeDNS
+	case errors.As(err, &handshakeErr):
+		return codeTLSHandshake
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return codeUpstreamTimeout
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNABORTED), errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.As(err, &goAway), errors.As(err, &streamErr):
+		return codeConnectionReset
+	case errors.Is(err, syscall.EADDRNOTAVAIL):
+		return codeAddressUnavailable
+	}
+	return codeNetwork
+}
+
+// 上游状态码的分类
+func statusErrorCode(status int) string {
+	if status >= 500 {
+		return codeUpstream5xx
+	}
+	return codeUpstream4xx
+}
+
+// JSON 错误响应
+type errorResponse struct {
+	Code           string `json:"code"`
+	Message        string `json:"message"`
+	Status         int    `json:"status"`
+	UpstreamStatus int    `json:"upstreamStatus,omitempty"` // 最后一次尝试的上游状态码
+	Attempts       int    `json:"attempts"`                 // 已发出的上游请求次数
+	Retryable      bool   `json:"retryable"`                // 稍后重试是否可能成功
+	RequestID      string `json:"requestId,omitempty"`
+}
+
+func writeError(w http.ResponseWriter, e errorResponse) {
+	e.Retryable = retryableCodes[e.Code] || e.UpstreamStatus == http.StatusTooManyRequests
+
+	w.Header().Set("X-Utls-Error", e.Code)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(e)
+}
+
+// 代理请求的错误：尝试次数和上游状态码取自访问日志记录，错误码同时记入访问日志
+func writeProxyError(w http.ResponseWriter, access *accessRecord, code, message string, status int) {
+	access.Error = code
+	writeError(w, errorResponse{
+		Code:           code,
+		Message:        message,
+		Status:         status,
+		UpstreamStatus: access.UpstreamStatus,
+		Attempts:       access.Attempts,
+		RequestID:      access.RequestID,
+	})
+}
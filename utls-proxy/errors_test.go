@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+// 错误按类型分类（经过 url.Error / net.OpError 等包装后仍然可以识别）
+func TestErrorClass(t *testing.T) {
+	wrap := func(err error) error {
+		return &url.Error{Op: "Get", URL: "https://kh.google.com/", Err: err}
+	}
+	opErr := func(err error) error {
+		return &net.OpError{Op: "read", Net: "tcp", Err: err}
+	}
+
+	for _, tc := range []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"取消", wrap(context.Canceled), codeClientCancelled},
+		{"DNS", wrap(opErr(&net.DNSError{Err: "no such host", Name: "kh.google.com", IsNotFound: true})), codeDNS},
+		{"证书", wrap(&tlsHandshakeError{err: x509.UnknownAuthorityError{}}), codeTLSHandshake},
+		{"握手超时", wrap(&tlsHandshakeError{err: os.ErrDeadlineExceeded}), codeTLSHandshake},
+		{"请求超时", wrap(context.DeadlineExceeded), codeUpstreamTimeout},
+		{"读超时", wrap(opErr(os.ErrDeadlineExceeded)), codeUpstreamTimeout},
+		{"连接重置", wrap(opErr(os.NewSyscallError("read", syscall.ECONNRESET))), codeConnectionReset},
+		{"提前关闭", wrap(io.ErrUnexpectedEOF), codeConnectionReset},
+		{"GOAWAY", wrap(http2.GoAwayError{ErrCode: http2.ErrCodeNo}), codeConnectionReset},
+		{"RST_STREAM", wrap(http2.StreamError{StreamID: 1, Code: http2.ErrCodeRefusedStream}), codeConnectionReset},
+		{"地址不可用", wrap(opErr(os.NewSyscallError("bind", syscall.EADDRNOTAVAIL))), codeAddressUnavailable},
+		{"连接被拒绝", wrap(opErr(os.NewSyscallError("connect", syscall.ECONNREFUSED))), codeNetwork},
+		{"其他", fmt.Errorf("unexpected"), codeNetwork},
+	} {
+		if got := errorClass(tc.err); got != tc.want {
+			t.Errorf("%s: %s，应为 %s", tc.name, got, tc.want)
+		}
+	}
+
+	// 真实的连接被拒绝
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	if _, err := net.Dial("tcp", addr); errorClass(err) != codeNetwork {
+		t.Errorf("连接被拒绝: %s (%v)", errorClass(err), err)
+	}
+}
+
+// JSON 错误响应：错误码同时放在 X-Utls-Error 中，retryable 按错误码（或上游 429）决定
+func TestWriteError(t *testing.T) {
+	for _, tc := range []struct {
+		e         errorResponse
+		retryable bool
+	}{
+		{errorResponse{Code: codeUpstream5xx, Status: http.StatusBadGateway, UpstreamStatus: 502}, true},
+		{errorResponse{Code: codeUpstream4xx, Status: http.StatusNotFound, UpstreamStatus: 404}, false},
+		{errorResponse{Code: codeUpstream4xx, Status: http.StatusTooManyRequests, UpstreamStatus: 429}, true},
+		{errorResponse{Code: codeNotAllowed, Status: http.StatusForbidden}, false},
+		{errorResponse{Code: codeOverloaded, Status: http.StatusServiceUnavailable}, true},
+	} {
+		rec := httptest.NewRecorder()
+		writeError(rec, tc.e)
+
+		var got errorResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != tc.e.Status || rec.Header().Get("X-Utls-Error") != tc.e.Code || got.Code != tc.e.Code ||
+			got.UpstreamStatus != tc.e.UpstreamStatus || got.Retryable != tc.retryable {
+			t.Errorf("%s: 状态码 %d，%+v", tc.e.Code, rec.Code, got)
+		}
+	}
+
+	if statusErrorCode(http.StatusServiceUnavailable) != codeUpstream5xx || statusErrorCode(http.StatusForbidden) != codeUpstream4xx {
+		t.Error("statusErrorCode")
+	}
+}
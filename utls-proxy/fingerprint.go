@@ -0,0 +1,345 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ClientHello 解析和 JA3 / JA4 指纹：
+//   - JA3：md5(版本,密码套件,扩展,曲线,点格式)，扩展按发送顺序，忽略 GREASE
+//   - JA3N：同 JA3，扩展排序后计算（Chrome 106 起每个连接随机打乱扩展顺序，JA3 不再稳定）
+//   - JA4：t<版本><d|i><套件数><扩展数><ALPN>_<排序后套件的 sha256>_<排序后扩展和签名算法的 sha256>
+
+// 从连接上收到的原始字节中解析出的 ClientHello
+type clientHello struct {
+	version             uint16 // legacy_version
+	ciphers             []uint16
+	extensions          []uint16 // 发送顺序
+	serverName          string
+	groups              []uint16
+	pointFormats        []uint8
+	signatureAlgorithms []uint16
+	alpn                []string
+	supportedVersions   []uint16
+	keyShares           []uint16
+}
+
+// 解析 TLS 记录中的第一个 ClientHello（可能跨多个记录）
+func parseClientHello(data []byte) (*clientHello, error) {
+	var msg []byte
+	for {
+		if len(data) < 5 {
+			return nil, errors.New("ClientHello 不完整")
+		}
+		if data[0] != 22 {
+			return nil, fmt.Errorf("不是握手记录: %d", data[0])
+		}
+		n := int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < 5+n {
+			return nil, errors.New("ClientHello 不完整")
+		}
+		msg = append(msg, data[5:5+n]...)
+		data = data[5+n:]
+		if len(msg) >= 4 && len(msg) >= 4+handshakeLen(msg) {
+			break
+		}
+	}
+	if msg[0] != 1 {
+		return nil, fmt.Errorf("不是 ClientHello: %d", msg[0])
+	}
+
+	r := newByteReader(msg[4 : 4+handshakeLen(msg)])
+	ch := &clientHello{version: r.u16()}
+	r.take(32)           // random
+	r.vec8()             // session_id
+	ciphers := r.vec16() // cipher_suites
+	r.vec8()             // compression_methods
+	exts := r.vec16()    // extensions
+	ch.ciphers = ciphers.u16s()
+
+	for !exts.empty() {
+		typ := exts.u16()
+		body := exts.vec16()
+		ch.extensions = append(ch.extensions, typ)
+
+		switch typ {
+		case 0: // server_name
+			list := body.vec16()
+			if list.u8() == 0 {
+				ch.serverName = string(list.vec16().b)
+			}
+		case 10: // supported_groups
+			ch.groups = body.vec16().u16s()
+		case 11: // ec_point_formats
+			ch.pointFormats = body.vec8()
+		case 13: // signature_algorithms
+			ch.signatureAlgorithms = body.vec16().u16s()
+		case 16: // application_layer_protocol_negotiation
+			list := body.vec16()
+			for !list.empty() {
+				ch.alpn = append(ch.alpn, string(list.vec8()))
+			}
+		case 43: // supported_versions
+			ch.supportedVersions = (&byteReader{b: body.vec8(), bad: r.bad}).u16s()
+		case 51: // key_share
+			list := body.vec16()
+			for !list.empty() {
+				ch.keyShares = append(ch.keyShares, list.u16())
+				list.vec16()
+			}
+		}
+	}
+	if *r.bad {
+		return nil, errors.New("ClientHello 格式错误")
+	}
+	return ch, nil
+}
+
+// 握手消息头中的 24 位长度
+func handshakeLen(msg []byte) int {
+	return int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+}
+
+// 按顺序读取 TLS 编码的字段；越界时返回零值，并在同一个 ClientHello 的所有 reader 上标记错误
+type byteReader struct {
+	b   []byte
+	bad *bool
+}
+
+func newByteReader(b []byte) *byteReader {
+	return &byteReader{b: b, bad: new(bool)}
+}
+
+func (r *byteReader) empty() bool { return len(r.b) == 0 }
+
+func (r *byteReader) take(n int) []byte {
+	if n > len(r.b) {
+		*r.bad = true
+		r.b = nil
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *byteReader) u8() uint8 {
+	if b := r.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *byteReader) u16() uint16 {
+	if b := r.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *byteReader) vec8() []byte { return r.take(int(r.u8())) }
+
+func (r *byteReader) vec16() *byteReader {
+	return &byteReader{b: r.take(int(r.u16())), bad: r.bad}
+}
+
+func (r *byteReader) u16s() []uint16 {
+	out := make([]uint16, 0, len(r.b)/2)
+	for !r.empty() {
+		out = append(out, r.u16())
+	}
+	return out
+}
+
+// GREASE（RFC 8701）：0x0a0a、0x1a1a … 0xfafa
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	out := make([]uint16, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func ja3String(ch *clientHello, sortExtensions bool) string {
+	exts := withoutGREASE(ch.extensions)
+	if sortExtensions {
+		slices.Sort(exts)
+	}
+	formats := make([]uint16, len(ch.pointFormats))
+	for i, f := range ch.pointFormats {
+		formats[i] = uint16(f)
+	}
+	return strings.Join([]string{
+		strconv.Itoa(int(ch.version)),
+		joinDecimal(withoutGREASE(ch.ciphers)),
+		joinDecimal(exts),
+		joinDecimal(withoutGREASE(ch.groups)),
+		joinDecimal(formats),
+	}, ",")
+}
+
+func ja3Hash(ch *clientHello, sortExtensions bool) string {
+	sum := md5.Sum([]byte(ja3String(ch, sortExtensions)))
+	return hex.EncodeToString(sum[:])
+}
+
+func ja4(ch *clientHello) string {
+	// 有 supported_versions 时取其中最高的版本
+	version := ch.version
+	if versions := withoutGREASE(ch.supportedVersions); len(versions) > 0 {
+		version = slices.Max(versions)
+	}
+	versionCode := map[uint16]string{0x0304: "13", 0x0303: "12", 0x0302: "11", 0x0301: "10", 0x0300: "s3"}[version]
+	if versionCode == "" {
+		versionCode = "00"
+	}
+
+	sni := "i"
+	if ch.serverName != "" {
+		sni = "d"
+	}
+
+	alpn := "00"
+	if len(ch.alpn) > 0 && ch.alpn[0] != "" {
+		first := ch.alpn[0]
+		alpn = string(first[0]) + string(first[len(first)-1])
+	}
+
+	ciphers := withoutGREASE(ch.ciphers)
+	exts := withoutGREASE(ch.extensions)
+
+	sortedCiphers := slices.Sorted(slices.Values(ciphers))
+	var hashedExts []uint16
+	for _, e := range exts {
+		if e != 0 && e != 16 { // SNI 和 ALPN 已体现在第一部分
+			hashedExts = append(hashedExts, e)
+		}
+	}
+	slices.Sort(hashedExts)
+	extPart := joinHex(hashedExts)
+	if sigs := withoutGREASE(ch.signatureAlgorithms); len(sigs) > 0 {
+		extPart += "_" + joinHex(sigs)
+	}
+
+	return fmt.Sprintf("t%s%s%02d%02d%s_%s_%s", versionCode, sni, min(len(ciphers), 99), min(len(exts), 99), alpn,
+		ja4Hash(joinHex(sortedCiphers), len(sortedCiphers)), ja4Hash(extPart, len(hashedExts)))
+}
+
+func ja4Hash(s string, n int) string {
+	if n == 0 {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func joinDecimal(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(parts, "-")
+}
+
+func joinHex(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(parts, ",")
+}
+
+// 便于阅读的名称（用于报告和 golden 文件）
+
+var extensionNames = map[uint16]string{
+	0:     "server_name",
+	5:     "status_request",
+	10:    "supported_groups",
+	11:    "ec_point_formats",
+	13:    "signature_algorithms",
+	16:    "alpn",
+	17:    "status_request_v2",
+	18:    "signed_certificate_timestamp",
+	21:    "padding",
+	22:    "encrypt_then_mac",
+	23:    "extended_master_secret",
+	27:    "compress_certificate",
+	28:    "record_size_limit",
+	34:    "delegated_credentials",
+	35:    "session_ticket",
+	41:    "pre_shared_key",
+	42:    "early_data",
+	43:    "supported_versions",
+	45:    "psk_key_exchange_modes",
+	49:    "post_handshake_auth",
+	51:    "key_share",
+	13172: "next_protocol_negotiation",
+	17513: "application_settings",
+	17613: "application_settings_new",
+	30032: "channel_id",
+	65037: "encrypted_client_hello",
+	65281: "renegotiation_info",
+}
+
+func extensionName(v uint16) string {
+	if isGREASE(v) {
+		return "GREASE"
+	}
+	if name, ok := extensionNames[v]; ok {
+		return fmt.Sprintf("%s (%d)", name, v)
+	}
+	return strconv.Itoa(int(v))
+}
+
+func cipherName(v uint16) string {
+	if isGREASE(v) {
+		return "GREASE"
+	}
+	return tls.CipherSuiteName(v)
+}
+
+func groupName(v uint16) string {
+	if isGREASE(v) {
+		return "GREASE"
+	}
+	if name := tls.CurveID(v).String(); !strings.HasPrefix(name, "CurveID(") {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+func signatureName(v uint16) string {
+	if name := tls.SignatureScheme(v).String(); !strings.HasPrefix(name, "SignatureScheme(") {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+func versionName(v uint16) string {
+	if isGREASE(v) {
+		return "GREASE"
+	}
+	return tls.VersionName(v)
+}
+
+func names(values []uint16, name func(uint16) string) []string {
+	out := make([]string, len(values))
+	for i, v := range values {
+		out[i] = name(v)
+	}
+	return out
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"log/slog"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"zeromaps-utls-proxy/certauth"
+)
+
+// 标准正向代理：支持 HTTP_PROXY / HTTPS_PROXY 的工具（curl、Go 的 http.ProxyURL 等）可以直接使用
+//   - 绝对 URI 请求（GET https://kh.google.com/... HTTP/1.1）：经 uTLS 客户端转发，http:// 按 https:// 处理
+//   - CONNECT：用本地 CA（UTLS_FORWARD_CA_DIR）签发的证书终止调用方的 TLS，隧道内的请求再经 uTLS 客户端转发
+//     （不终止 TLS 就无法换成浏览器指纹；调用方需要信任该 CA）
+//
+// 两种方式与 /proxy 走同一处理流程（白名单、会话、熔断器、重试），响应使用 mirror 模式（见 response.go）
+//
+// 出口地址与指纹提示（请求头优先于 Proxy-Authorization）：
+//
+//	X-Utls-Ipv6: 2001:db8::1
+//	X-Utls-Profile: chrome-133-windows-11
+//	Proxy-Authorization: Basic base64("ipv6=2001:db8::1;profile=chrome-133-windows-11")
+
+var (
+	forwardCA       *certauth.CA // CONNECT 模式签发证书的 CA（nil = 不支持 CONNECT）
+	forwardCerts    sync.Map     // host -> *tls.Certificate
+	forwardRequests atomic.Int64 // 绝对 URI 请求数
+	connectTotal    atomic.Int64 // CONNECT 隧道总数
+	connectActive   atomic.Int64 // 当前打开的 CONNECT 隧道
+
+	tunnels = newTunnelRegistry() // 服务中的隧道（接管后的连接不受外层 server.Shutdown 管理）
+)
+
+func initForwardProxy() {
+	if !config.forwardProxy {
+		return
+	}
+	if config.forwardCADir == "" {
+		slog.Info("正向代理已启用（未配置 UTLS_FORWARD_CA_DIR，不支持 CONNECT）")
+		return
+	}
+
+	ca, err := certauth.LoadOrCreate(config.forwardCADir, "zeromaps utls-proxy CA")
+	if err != nil {
+		slog.Warn("加载正向代理 CA 失败，不支持 CONNECT", "dir", config.forwardCADir, "error", err)
+		return
+	}
+	forwardCA = ca
+	slog.Info("正向代理已启用", "ca_file", filepath.Join(config.forwardCADir, certauth.CertFile))
+}
+
+// 绝对 URI 请求和 CONNECT 交给正向代理，其余请求交给 next（/proxy、/health 等）
+func withForwardProxy(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config.forwardProxy {
+			if r.Method == http.MethodConnect {
+				connectHandler(w, r)
+				return
+			}
+			if r.URL.IsAbs() {
+				forwardRequests.Add(1)
+				serveProxy(w, r, forwardTarget(r, r.URL.Host, proxyTarget{}))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// CONNECT host:443：终止调用方的 TLS，在隧道内提供 HTTP/1.1 服务
+func connectHandler(w http.ResponseWriter, r *http.Request) {
+	if shutdownFlag.Load() {
+		writeError(w, errorResponse{Code: codeShuttingDown, Message: "Server is shutting down", Status: http.StatusServiceUnavailable})
+		return
+	}
+	if forwardCA == nil {
+		http.Error(w, "CONNECT not enabled", http.StatusNotImplemented)
+		return
+	}
+
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil || port != "443" || allowedDomains[strings.ToLower(host)] == nil {
+		slog.Warn("CONNECT 目标不在白名单中", "target", r.Host, "remote", r.RemoteAddr)
+		http.Error(w, "Host not allowed", http.StatusForbidden)
+		return
+	}
+	host = strings.ToLower(host)
+
+	cert, err := forwardCertificate(host)
+	if err != nil {
+		slog.Error("签发 CONNECT 证书失败", "host", host, "error", err)
+		http.Error(w, "Certificate issue failed", http.StatusInternalServerError)
+		return
+	}
+
+	// CONNECT 请求上的提示作为隧道内请求的默认值
+	var base proxyTarget
+	applyForwardHints(r, &base)
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		slog.Warn("CONNECT 接管连接失败", "error", err)
+		return
+	}
+	// 接管后的连接可能还带着外层服务器设置的读写超时
+	conn.SetDeadline(time.Time{})
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		conn.Close()
+		return
+	}
+
+	var tunnel net.Conn = conn
+	if rw.Reader.Buffered() > 0 {
+		tunnel = &bufferedConn{Conn: conn, r: rw.Reader}
+	}
+
+	connectTotal.Add(1)
+	connectActive.Add(1)
+	defer connectActive.Add(-1)
+	slog.Debug("CONNECT 隧道已建立", "host", host, "remote", r.RemoteAddr)
+
+	tlsConn := tls.Server(tunnel, &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		NextProtos:   []string{"http/1.1"},
+	})
+	serveTunnel(tlsConn, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveProxy(w, r, forwardTarget(r, host, base))
+	}))
+}
+
+// 正向代理请求的上游 URL 与提示；base 为 CONNECT 请求携带的提示（隧道内的请求头可以覆盖）
+func forwardTarget(r *http.Request, host string, base proxyTarget) proxyTarget {
+	target := base
+	target.forward = true
+	target.url = "https://" + upstreamHost(host) + r.URL.RequestURI()
+	applyForwardHints(r, &target)
+	return target
+}
+
+// 去掉默认端口（上游只有 HTTPS，http:// 的 80 端口同样指向 443）
+func upstreamHost(hostport string) string {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return strings.ToLower(hostport)
+	}
+	if port == "443" || port == "80" {
+		return strings.ToLower(host)
+	}
+	return strings.ToLower(hostport)
+}
+
+// 从请求头和 Proxy-Authorization 中读取出口地址与指纹提示
+func applyForwardHints(r *http.Request, target *proxyTarget) {
+	parseProxyAuthHints(r.Header.Get("Proxy-Authorization"), target)
+
+	if v := r.Header.Get("X-Utls-Ipv6"); v != "" {
+		target.ipv6 = v
+	}
+	if v := r.Header.Get("X-Utls-Profile"); v != "" {
+		target.profile = v
+	}
+}
+
+// Basic 凭据整体按 key=value 解析（; 或 , 分隔），不按 user:password 拆分，IPv6 中的冒号不受影响
+func parseProxyAuthHints(header string, target *proxyTarget) {
+	scheme, encoded, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return
+	}
+
+	fields := strings.FieldsFunc(string(decoded), func(c rune) bool { return c == ';' || c == ',' })
+	for _, field := range fields {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "ipv6":
+			// 只填用户名时凭据以 ":"（空密码）结尾
+			if net.ParseIP(value) == nil {
+				value = strings.TrimSuffix(value, ":")
+			}
+			target.ipv6 = value
+		case "profile":
+			target.profile = value // 名称匹配时忽略标点，结尾的 ":" 不影响
+		}
+	}
+}
+
+// 每个域名签发一次证书（只会是白名单中的域名）
+func forwardCertificate(host string) (*tls.Certificate, error) {
+	if cached, ok := forwardCerts.Load(host); ok {
+		return cached.(*tls.Certificate), nil
+	}
+
+	cert, err := forwardCA.Issue([]string{host})
+	if err != nil {
+		return nil, err
+	}
+	actual, _ := forwardCerts.LoadOrStore(host, &cert)
+	return actual.(*tls.Certificate), nil
+}
+
+// 在单个连接上提供 HTTP 服务，连接关闭后返回
+func serveTunnel(conn net.Conn, handler http.Handler) {
+	listener := &tunnelListener{conn: conn, done: make(chan struct{})}
+	connDone := make(chan struct{})
+	server := &http.Server{
+		Handler:      handler,
+		ReadTimeout:  60 * time.Second,
+		WriteTimeout: 60 * time.Second,
+		IdleTimeout:  120 * time.Second,
+		ErrorLog:     slog.NewLogLogger(slog.Default().Handler(), slog.LevelDebug),
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				listener.Close()
+				close(connDone)
+			}
+		},
+	}
+	if !tunnels.add(server) {
+		conn.Close()
+		return
+	}
+	defer tunnels.remove(server)
+
+	server.Serve(listener)
+	// Shutdown 关闭 Listener 后 Serve 立即返回，隧道内的请求仍在处理，等到连接关闭
+	if listener.accepted {
+		<-connDone
+	} else {
+		conn.Close() // 登记后、Serve 之前就被 Shutdown
+	}
+}
+
+// 服务中的隧道 http.Server 集合；关闭后不再接受新隧道
+type tunnelRegistry struct {
+	mu      sync.Mutex
+	servers map[*http.Server]struct{}
+	closed  bool
+}
+
+func newTunnelRegistry() *tunnelRegistry {
+	return &tunnelRegistry{servers: make(map[*http.Server]struct{})}
+}
+
+// 登记隧道；已开始关闭时返回 false
+func (t *tunnelRegistry) add(server *http.Server) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false
+	}
+	t.servers[server] = struct{}{}
+	return true
+}
+
+func (t *tunnelRegistry) remove(server *http.Server) {
+	t.mu.Lock()
+	delete(t.servers, server)
+	t.mu.Unlock()
+}
+
+// 关闭所有隧道：等待隧道内处理中的请求完成，ctx 截止后强制关闭剩余连接
+func (t *tunnelRegistry) shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	t.closed = true
+	servers := make([]*http.Server, 0, len(t.servers))
+	for server := range t.servers {
+		servers = append(servers, server)
+	}
+	t.mu.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(servers))
+	for _, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				server.Close()
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// 只产出一个连接的 Listener：第二次 Accept 阻塞到连接关闭
+type tunnelListener struct {
+	conn     net.Conn
+	accepted bool
+	once     sync.Once
+	done     chan struct{}
+}
+
+func (l *tunnelListener) Accept() (net.Conn, error) {
+	if !l.accepted {
+		l.accepted = true
+		return l.conn, nil
+	}
+	<-l.done
+	return nil, net.ErrClosed
+}
+
+func (l *tunnelListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *tunnelListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// 接管连接时 bufio.Reader 中可能已经读入了 TLS ClientHello
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// 正向代理统计（用于 /health）
+type forwardStats struct {
+	Enabled        bool  `json:"enabled"`
+	ConnectEnabled bool  `json:"connectEnabled"`
+	Requests       int64 `json:"requests"`       // 绝对 URI 请求
+	ConnectTunnels int64 `json:"connectTunnels"` // CONNECT 隧道总数
+	ActiveTunnels  int64 `json:"activeTunnels"`
+}
+
+func forwardSnapshot() forwardStats {
+	return forwardStats{
+		Enabled:        config.forwardProxy,
+		ConnectEnabled: config.forwardProxy && forwardCA != nil,
+		Requests:       forwardRequests.Load(),
+		ConnectTunnels: connectTotal.Load(),
+		ActiveTunnels:  connectActive.Load(),
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"zeromaps-utls-proxy/certauth"
+	"zeromaps-utls-proxy/mockupstream"
+)
+
+// 经 HTTP_PROXY 方式使用代理的客户端（CONNECT 时信任 ca 签发的证书）
+func forwardClient(t *testing.T, proxyURL string, ca *certauth.CA) *http.Client {
+	t.Helper()
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := &http.Transport{Proxy: http.ProxyURL(u), DisableKeepAlives: true}
+	if ca != nil {
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(ca.CertPEM())
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	t.Cleanup(transport.CloseIdleConnections)
+	return &http.Client{Transport: transport, Timeout: 10 * time.Second}
+}
+
+// 临时启用正向代理（默认关闭）
+func enableForwardProxy(t *testing.T) {
+	t.Helper()
+	saved := config.forwardProxy
+	config.forwardProxy = true
+	t.Cleanup(func() { config.forwardProxy = saved })
+}
+
+// 临时启用 CONNECT，测试结束时等隧道全部断开后恢复
+func enableConnect(t *testing.T) *certauth.CA {
+	t.Helper()
+	enableForwardProxy(t)
+	ca, err := certauth.LoadOrCreate(t.TempDir(), "test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forwardCA = ca
+	forwardCerts.Clear()
+	t.Cleanup(func() {
+		for connectActive.Load() > 0 {
+			time.Sleep(5 * time.Millisecond)
+		}
+		forwardCA = nil
+		forwardCerts.Clear()
+		tunnels = newTunnelRegistry()
+	})
+	return ca
+}
+
+// 绝对 URI 请求经 uTLS 客户端转发（http:// 按 https:// 处理），Proxy-Authorization 中的提示生效
+func TestForwardProxyAbsoluteURI(t *testing.T) {
+	mock, proxy := startMockProxy(t)
+	enableForwardProxy(t)
+	client := forwardClient(t, proxy.URL, nil)
+
+	const tile = "/rt/earth/NodeData/pb=!1m2!1s0!2u36"
+	before := forwardRequests.Load()
+	resp, err := client.Get("http://kh.google.com" + tile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK || !bytes.Equal(body, mockupstream.Payload(tile, mock.Behavior().BodySize)) {
+		t.Errorf("状态码 %d，响应体 %d 字节，%v", resp.StatusCode, len(body), err)
+	}
+	if forwardRequests.Load() != before+1 {
+		t.Error("绝对 URI 请求未计数")
+	}
+
+	// 提示固定该地址首次分配的指纹（本机没有这个地址，请求本身失败）
+	hinted, _ := findBrowserProfile("firefox-120-windows-10")
+	req, _ := http.NewRequest(http.MethodGet, "http://kh.google.com"+tile, nil)
+	req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("ipv6=2001:db8::36;profile=firefox-120-windows-10:")))
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if pinned, ok := browserProfileMap.Load(addressKey("2001:db8::36")); !ok || pinned.(BrowserProfile).Name != hinted.Name {
+		t.Errorf("Proxy-Authorization 中的指纹提示未生效: %v", pinned)
+	}
+
+	resp, err = client.Get("http://example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || resp.Header.Get("X-Utls-Error") == "" {
+		t.Errorf("白名单外的域名: 状态码 %d，X-Utls-Error %q", resp.StatusCode, resp.Header.Get("X-Utls-Error"))
+	}
+}
+
+// CONNECT 隧道内处理中的请求在关闭时完成，之后的隧道被拒绝
+func TestConnectTunnelShutdown(t *testing.T) {
+	mock, proxy := startMockProxy(t)
+	ca := enableConnect(t)
+
+	saved := mock.Behavior()
+	defer mock.SetBehavior(saved)
+	b := saved
+	b.DelayMs = 300
+	mock.SetBehavior(b)
+
+	client := forwardClient(t, proxy.URL, ca)
+	type result struct {
+		status int
+		body   []byte
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := client.Get("https://kh.google.com/rt/earth/NodeData/pb=!1m2!1s0!2u36")
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		done <- result{status: resp.StatusCode, body: body, err: err}
+	}()
+
+	waitFor(t, "隧道内的请求未开始", func() bool { return activeRequests.Load() > 0 && connectActive.Load() > 0 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tunnels.shutdown(ctx); err != nil {
+		t.Fatalf("关闭隧道: %v", err)
+	}
+
+	select {
+	case res := <-done:
+		if res.err != nil || res.status != http.StatusOK || len(res.body) != b.BodySize {
+			t.Errorf("处理中的请求未完成: 状态码 %d，%d 字节，%v", res.status, len(res.body), res.err)
+		}
+	default:
+		t.Error("shutdown 返回时隧道内的请求仍未完成")
+	}
+
+	mock.SetBehavior(saved)
+	if _, err := client.Get("https://kh.google.com/rt/earth/NodeData/pb=!1m2!1s0!2u36"); err == nil {
+		t.Error("关闭后不应再建立隧道")
+	}
+}
@@ -1,17 +1,15 @@
 module zeromaps-utls-proxy
 
-go 1.21
+go 1.24
 
 require (
+	github.com/andybalholm/brotli v1.0.6
 	github.com/refraction-networking/utls v1.8.1
 	golang.org/x/net v0.38.0
 )
 
 require (
-	github.com/andybalholm/brotli v1.0.6 // indirect
-	github.com/cloudflare/circl v1.3.7 // indirect
 	github.com/klauspost/compress v1.17.4 // indirect
-	github.com/quic-go/quic-go v0.37.4 // indirect
 	golang.org/x/crypto v0.36.0 // indirect
 	golang.org/x/sys v0.31.0 // indirect
 	golang.org/x/text v0.23.0 // indirect
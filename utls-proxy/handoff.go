@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// 零停机重启：
+//   - systemd socket 激活：监听由 systemd 持有，通过 LISTEN_FDS 传入（见 listeners.go），重启期间新连接在内核队列中等待
+//   - SIGUSR2 交接：用同样的参数启动新的可执行文件并传入监听，新进程开始服务后通知旧进程，
+//     旧进程停止接受新连接，处理完已接受的请求后退出（见 shutdown.go）
+//
+// 在 systemd 下新进程通过 sd_notify 的 MAINPID 成为主进程（服务需要 NotifyAccess=all）；
+// PM2 只跟踪自己启动的进程，会把旧进程的退出视为崩溃并重新拉起，因此在 PM2 下拒绝交接
+
+// 新进程用于通知旧进程“已开始服务”的 fd
+const handoffFDEnv = "UTLS_HANDOFF_FD"
+
+var (
+	handingOff  atomic.Bool           // 交接进行中（同一时间只启动一个新进程）
+	handedOff   atomic.Bool           // 监听已由新进程接管
+	handoffDone = make(chan struct{}) // 新进程接管后关闭，触发优雅关闭
+)
+
+// 收到 SIGUSR2 时把监听交给新进程
+func startHandoffHandler(ctx context.Context, listeners []net.Listener) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGUSR2)
+	defer signal.Stop(sigChan)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigChan:
+		}
+
+		if !handingOff.CompareAndSwap(false, true) {
+			slog.Warn("监听交接正在进行，忽略 SIGUSR2")
+			continue
+		}
+		if err := handoff(listeners); err != nil {
+			slog.Error("监听交接失败，继续服务", "error", err)
+			handingOff.Store(false)
+		}
+	}
+}
+
+// 启动新进程：监听作为 fd 3 起的 LISTEN_FDS 传入，最后一个 fd 是通知管道
+func handoff(listeners []net.Listener) error {
+	if underPM2() {
+		return fmt.Errorf("在 PM2 下运行，不支持交接（需要 systemd 并设置 NotifyAccess=all）")
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	files := make([]*os.File, 0, len(listeners)+1)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, ln := range listeners {
+		fl, ok := ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("监听 %s 不支持交接", ln.Addr())
+		}
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+
+	readyRead, readyWrite, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	files = append(files, readyWrite)
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(handoffEnv(),
+		"LISTEN_FDS="+strconv.Itoa(len(listeners)),
+		handoffFDEnv+"="+strconv.Itoa(listenFDsStart+len(listeners)))
+
+	if err := cmd.Start(); err != nil {
+		readyRead.Close()
+		return err
+	}
+	slog.Info("已启动新进程，等待其接管监听", "pid", cmd.Process.Pid, "executable", executable)
+
+	// 新进程开始服务后写入一个字节；进程退出时管道关闭，读到 EOF
+	go func() {
+		defer readyRead.Close()
+		buf := make([]byte, 1)
+		if _, err := io.ReadFull(readyRead, buf); err != nil {
+			slog.Error("新进程在接管监听前退出，继续服务", "pid", cmd.Process.Pid, "error", cmd.Wait())
+			handingOff.Store(false)
+			return
+		}
+
+		slog.Info("新进程已接管监听", "pid", cmd.Process.Pid)
+		for _, ln := range listeners {
+			// socket 文件已属于新进程，关闭监听时不能删除
+			if ul, ok := ln.(*net.UnixListener); ok {
+				ul.SetUnlinkOnClose(false)
+			}
+		}
+		handedOff.Store(true)
+		close(handoffDone)
+		go cmd.Wait()
+	}()
+	return nil
+}
+
+// PM2 启动的进程带有 PM2_HOME 和 pm_id 环境变量
+func underPM2() bool {
+	return os.Getenv("PM2_HOME") != "" || os.Getenv("pm_id") != ""
+}
+
+// 新进程的环境变量：去掉上一轮的 LISTEN_* 和只属于本进程的 WATCHDOG_PID
+func handoffEnv() []string {
+	env := make([]string, 0, len(os.Environ()))
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		switch name {
+		case "LISTEN_FDS", "LISTEN_PID", "LISTEN_FDNAMES", "WATCHDOG_PID", handoffFDEnv:
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
+
+// 开始服务后调用：通知 systemd 已就绪；如果是交接启动的，通知旧进程退出
+func notifyServing() {
+	val := os.Getenv(handoffFDEnv)
+	if val == "" {
+		sdNotify("READY=1")
+		return
+	}
+	os.Unsetenv(handoffFDEnv)
+
+	// 先在 systemd 中接管主进程，旧进程退出时服务不会被视为停止
+	sdNotify("MAINPID=" + strconv.Itoa(os.Getpid()) + "\nREADY=1")
+
+	fd, err := strconv.Atoi(val)
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "handoff")
+	if _, err := f.Write([]byte{1}); err != nil {
+		slog.Warn("通知旧进程失败", "error", err)
+	}
+	f.Close()
+	slog.Info("已接管旧进程的监听")
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// 交接启动的新进程：通知 systemd 接管主进程，并向旧进程的管道写入一个字节
+func TestNotifyServingHandoff(t *testing.T) {
+	next := listenNotify(t)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	// notifyServing 会关闭这个 fd，交给它一个复制的 fd
+	fd, err := syscall.Dup(int(w.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(handoffFDEnv, strconv.Itoa(fd))
+
+	notifyServing()
+
+	if got, want := next(), "MAINPID="+strconv.Itoa(os.Getpid())+"\nREADY=1"; got != want {
+		t.Errorf("通知 %q，应为 %q", got, want)
+	}
+	r.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatalf("旧进程未收到通知: %v", err)
+	}
+	if _, ok := os.LookupEnv(handoffFDEnv); ok {
+		t.Errorf("%s 应已清除", handoffFDEnv)
+	}
+
+	// 不是交接启动的：只发送 READY=1
+	notifyServing()
+	if got := next(); got != "READY=1" {
+		t.Errorf("通知 %q", got)
+	}
+}
+
+// 新进程的环境变量不带上一轮的 LISTEN_* 和 WATCHDOG_PID
+func TestHandoffEnv(t *testing.T) {
+	t.Setenv("LISTEN_FDS", "2")
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("WATCHDOG_PID", "1")
+	t.Setenv(handoffFDEnv, "5")
+	t.Setenv("WATCHDOG_USEC", "1000000")
+
+	env := handoffEnv()
+	for _, kv := range []string{"LISTEN_FDS=2", "LISTEN_PID=1", "WATCHDOG_PID=1", handoffFDEnv + "=5"} {
+		if slices.Contains(env, kv) {
+			t.Errorf("%s 不应传给新进程", kv)
+		}
+	}
+	if !slices.Contains(env, "WATCHDOG_USEC=1000000") {
+		t.Error("WATCHDOG_USEC 应传给新进程")
+	}
+}
+
+// PM2 下拒绝交接，不启动新进程
+func TestHandoffUnderPM2(t *testing.T) {
+	t.Setenv("PM2_HOME", "")
+	t.Setenv("pm_id", "")
+	if underPM2() {
+		t.Fatal("未设置 PM2 环境变量")
+	}
+
+	t.Setenv("pm_id", "0")
+	if !underPM2() {
+		t.Fatal("设置了 pm_id，应识别为 PM2")
+	}
+	if err := handoff(nil); err == nil {
+		t.Error("PM2 下应拒绝交接")
+	}
+	if handedOff.Load() {
+		t.Error("监听不应被交接")
+	}
+}
+
+// LISTEN_FDS：在子进程中从 fd 3 取得监听，接受一个连接
+func TestInheritedListeners(t *testing.T) {
+	if os.Getenv("UTLS_TEST_INHERITED") == "1" {
+		listeners, err := inheritedListeners()
+		if err != nil || len(listeners) != 1 {
+			t.Fatalf("继承的监听: %v %v", listeners, err)
+		}
+		if os.Getenv("LISTEN_FDS") != "" {
+			t.Fatal("LISTEN_FDS 应已清除")
+		}
+		conn, err := listeners[0].Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(conn, "inherited")
+		conn.Close()
+		return
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// LISTEN_PID 不是本进程时忽略
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	if listeners, err := inheritedListeners(); listeners != nil || err != nil {
+		t.Errorf("LISTEN_PID 不匹配: %v %v", listeners, err)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestInheritedListeners$")
+	cmd.Env = append(handoffEnv(), "UTLS_TEST_INHERITED=1", "LISTEN_FDS=1")
+	cmd.ExtraFiles = []*os.File{f}
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	data, _ := io.ReadAll(conn)
+	if err := cmd.Wait(); err != nil || string(data) != "inherited" {
+		t.Errorf("子进程: %q %v\n%s", data, err, out.String())
+	}
+}
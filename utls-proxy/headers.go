@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// 调用方请求头的受控透传（/proxy 与正向代理相同）：
+//   - UTLS_PASSTHROUGH_HEADERS 中的请求头原样转发（默认条件请求和 Range）
+//   - 带 UTLS_PASSTHROUGH_PREFIX 前缀（默认 X-Forward-）的请求头去掉前缀后转发，用于应用自定义的请求头
+//   - 由浏览器指纹、会话或代理自身决定的请求头（User-Agent、Sec-Ch-Ua、Cookie 等）一律不转发
+//
+// 实际转发的请求头名称通过响应头 X-Applied-Headers 返回
+
+var passthroughHeaders map[string]bool // 原样转发的请求头（canonical 名称）
+
+const defaultPassthroughHeaders = "If-None-Match,If-Modified-Since,If-Match,If-Unmodified-Since,If-Range,Range"
+
+// 不允许调用方覆盖的请求头（浏览器指纹的请求头集合、会话和逐跳头）
+var blockedHeaders = map[string]bool{
+	"User-Agent":        true,
+	"Accept":            true,
+	"Accept-Language":   true,
+	"Accept-Encoding":   true,
+	"Cache-Control":     true,
+	"Pragma":            true,
+	"Dnt":               true,
+	"Cookie":            true,
+	"Origin":            true,
+	"Referer":           true,
+	"Host":              true,
+	"Content-Length":    true,
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Te":                true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+var blockedHeaderPrefixes = []string{"Sec-Ch-", "Sec-Fetch-", "Proxy-", "X-Utls-"}
+
+func initPassthroughHeaders() {
+	passthroughHeaders = make(map[string]bool)
+	for _, name := range strings.Split(config.passthroughHeaders, ",") {
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if isBlockedHeader(name) {
+			slog.Warn("请求头与浏览器指纹或会话冲突，不能透传", "header", name)
+			continue
+		}
+		passthroughHeaders[name] = true
+	}
+
+	names := make([]string, 0, len(passthroughHeaders))
+	for name := range passthroughHeaders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	slog.Info("请求头透传", "headers", names, "prefix", config.passthroughPrefix)
+}
+
+func isBlockedHeader(name string) bool {
+	if blockedHeaders[name] {
+		return true
+	}
+	for _, prefix := range blockedHeaderPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// 调用方请求中可以转发的请求头（按上游名称），以及因冲突被拒绝的请求头
+func callerHeaders(r *http.Request) (applied http.Header, blocked []string) {
+	applied = make(http.Header)
+	prefix := strings.ToLower(config.passthroughPrefix)
+
+	for name, values := range r.Header {
+		target := name
+		if prefix != "" && strings.HasPrefix(strings.ToLower(name), prefix) {
+			target = http.CanonicalHeaderKey(name[len(prefix):])
+		} else if !passthroughHeaders[name] {
+			continue
+		}
+
+		if target == "" || isBlockedHeader(target) {
+			blocked = append(blocked, name)
+			continue
+		}
+		applied[target] = append(applied[target], values...)
+	}
+
+	sort.Strings(blocked)
+	return applied, blocked
+}
+
+// 请求头名称（排序后，用于 X-Applied-Headers）
+func headerNames(h http.Header) []string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"zeromaps-utls-proxy/mockupstream"
+)
+
+// 条件请求命中时上游返回 304（带 gzip 的 Content-Encoding）：原样返回 304 和校验头，不能变成 decode_failed
+func TestConditionalRequestNotModified(t *testing.T) {
+	mock, proxy := startMockProxy(t)
+	saved := mock.Behavior()
+	defer mock.SetBehavior(saved)
+	b := saved
+	b.Encoding = "gzip"
+	mock.SetBehavior(b)
+
+	path := "/rt/earth/NodeData/pb=!1m2!1s0!2u3"
+	etag := mockupstream.PayloadETag(path, b.BodySize)
+	target := url.QueryEscape("https://kh.google.com" + path)
+
+	get := func(mode string, header http.Header) (*http.Response, []byte) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/proxy?response="+mode+"&url="+target, nil)
+		req.Header = header
+		resp, err := rawClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, body
+	}
+
+	resp, _ := get(responseMirror, http.Header{})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") != etag {
+		t.Fatalf("首次请求: 状态码 %d，ETag %q", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+	lastModified := resp.Header.Get("Last-Modified")
+
+	for _, header := range []http.Header{
+		{"If-None-Match": {etag}},
+		{"If-Modified-Since": {lastModified}},
+	} {
+		resp, body := get(responseMirror, header)
+		if resp.StatusCode != http.StatusNotModified || resp.Header.Get("X-Utls-Error") != "" || len(body) != 0 {
+			t.Errorf("%v: 状态码 %d，错误 %q，%d 字节", header, resp.StatusCode, resp.Header.Get("X-Utls-Error"), len(body))
+			continue
+		}
+		if resp.Header.Get("ETag") != etag || resp.Header.Get("Last-Modified") != lastModified {
+			t.Errorf("%v: 304 缺少校验头 ETag %q，Last-Modified %q", header, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"))
+		}
+		for name := range header {
+			if !strings.Contains(resp.Header.Get("X-Applied-Headers"), name) {
+				t.Errorf("X-Applied-Headers %q 应包含 %s", resp.Header.Get("X-Applied-Headers"), name)
+			}
+		}
+	}
+
+	resp, _ = get(responseLegacy, http.Header{"If-None-Match": {etag}})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Status-Code") != "304" || resp.Header.Get("X-Origin-Etag") != etag {
+		t.Errorf("legacy: 状态码 %d，X-Status-Code %q，X-Origin-Etag %q",
+			resp.StatusCode, resp.Header.Get("X-Status-Code"), resp.Header.Get("X-Origin-Etag"))
+	}
+}
+
+// 白名单和 X-Forward- 前缀的请求头转发到上游，与指纹或会话冲突的请求头不转发
+func TestHeaderPassthrough(t *testing.T) {
+	_, proxy := startMockProxy(t)
+
+	req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/proxy?response=mirror&url="+url.QueryEscape("https://kh.google.com/echo"), nil)
+	req.Header.Set("Range", "bytes=0-99")
+	req.Header.Set("X-Forward-X-Client-Data", "abc")
+	req.Header.Set("X-Forward-User-Agent", "curl/8.0")
+	req.Header.Set("X-Forward-Sec-Ch-Ua", `"curl"`)
+	req.Header.Set("X-Custom", "not forwarded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var got mockupstream.Echo
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Header.Get("Range") != "bytes=0-99" || got.Header.Get("X-Client-Data") != "abc" {
+		t.Errorf("白名单请求头未转发: %v", got.Header)
+	}
+	if got.Header.Get("X-Custom") != "" || strings.Contains(got.Header.Get("User-Agent"), "curl") || got.Header.Get("Sec-Ch-Ua") == `"curl"` {
+		t.Errorf("转发了不应转发的请求头: %v", got.Header)
+	}
+	if applied := resp.Header.Get("X-Applied-Headers"); applied != "Range, X-Client-Data" {
+		t.Errorf("X-Applied-Headers: %q", applied)
+	}
+}
+
+// 浏览器指纹的请求头（Accept、Cache-Control、Pragma 等）不能通过白名单或前缀覆盖
+func TestPassthroughBlocksProfileHeaders(t *testing.T) {
+	savedHeaders, savedPrefix, savedConfig := passthroughHeaders, config.passthroughPrefix, config.passthroughHeaders
+	defer func() {
+		passthroughHeaders, config.passthroughPrefix, config.passthroughHeaders = savedHeaders, savedPrefix, savedConfig
+	}()
+	config.passthroughHeaders = "Range,Accept,cache-control,Pragma"
+	config.passthroughPrefix = "X-Forward-"
+	initPassthroughHeaders()
+	if len(passthroughHeaders) != 1 || !passthroughHeaders["Range"] {
+		t.Errorf("白名单: %v", passthroughHeaders)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/proxy", nil)
+	req.Header.Set("Range", "bytes=0-1")
+	req.Header.Set("Accept", "text/plain")
+	req.Header.Set("X-Forward-Cache-Control", "no-cache")
+	req.Header.Set("X-Forward-Pragma", "no-cache")
+	applied, blocked := callerHeaders(req)
+	if names := headerNames(applied); strings.Join(names, ",") != "Range" {
+		t.Errorf("转发: %v", names)
+	}
+	if strings.Join(blocked, ",") != "X-Forward-Cache-Control,X-Forward-Pragma" {
+		t.Errorf("拒绝: %v", blocked)
+	}
+}
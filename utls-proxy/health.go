@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// 健康检查：
+//   - /health  完整统计（始终 200，status 反映就绪状态）
+//   - /livez   存活探针：进程能处理 HTTP 请求即返回 200
+//   - /readyz  就绪探针：不能正常转发时返回 503 并列出原因
+
+// 会话连续刷新失败达到该次数视为“刷新失败中”
+const readyRefreshFailThreshold = 3
+
+type healthResponse struct {
+	Status             string                `json:"status"` // ok / degraded / shutting_down
+	Ready              bool                  `json:"ready"`
+	Reasons            []string              `json:"reasons,omitempty"` // 未就绪的原因
+	Uptime             int64                 `json:"uptime"`
+	TotalRequests      int64                 `json:"totalRequests"`
+	SuccessRequests    int64                 `json:"successRequests"`
+	FailedRequests     int64                 `json:"failedRequests"`
+	SuccessRate        string                `json:"successRate"`
+	Errors             healthErrors          `json:"errors"`
+	Session            healthSession         `json:"session"`
+	Addresses          healthAddresses       `json:"addresses"`
+	ClientPool         healthClientPool      `json:"clientPool"`
+	ConcurrencyControl healthConcurrency     `json:"concurrencyControl"`
+	BrowserProfiles    healthBrowserProfiles `json:"browserProfiles"`
+	LoadShedding       loadShedStats         `json:"loadShedding"`
+	Timing             timingStats           `json:"timing"`
+	Tracing            tracingStats          `json:"tracing"`
+	DNS                dnsStats              `json:"dns"`
+	ForwardProxy       forwardStats          `json:"forwardProxy"`
+	TLSSessions        tlsSessionStats       `json:"tlsSessions"`
+}
+
+type healthErrors struct {
+	Error403 int64 `json:"error403"`
+	Error429 int64 `json:"error429"`
+	Error503 int64 `json:"error503"`
+	Error5xx int64 `json:"error5xx"`
+	Timeout  int64 `json:"timeout"`
+	Network  int64 `json:"network"`
+	DNS      int64 `json:"dns"`
+}
+
+type healthSession struct {
+	TotalSessions       int64  `json:"totalSessions"`
+	FailingSessions     int64  `json:"failingSessions"` // 连续刷新失败的会话数
+	TotalCookies        int64  `json:"totalCookies"`
+	OldestRefresh       string `json:"oldestRefresh"`
+	EarliestExpiry      string `json:"earliestExpiry"`
+	CookieValidSeconds  int64  `json:"cookieValidSeconds"`
+	SessionRefreshCount int64  `json:"sessionRefreshCount"`
+}
+
+type healthAddresses struct {
+	Known       int64 `json:"known"`       // 出现过的 IPv6 地址数
+	CircuitOpen int64 `json:"circuitOpen"` // 熔断中的地址数
+}
+
+type healthClientPool struct {
+	IPv6ClientsCached int64              `json:"ipv6ClientsCached"`
+	Default           defaultClientStats `json:"default"` // 默认出口的客户端
+}
+
+type healthConcurrency struct {
+	CurrentMaxConcurrent int32 `json:"currentMaxConcurrent"`
+	ActiveRefreshCount   int32 `json:"activeRefreshCount"`
+	MinConcurrent        int   `json:"minConcurrent"`
+	MaxConcurrent        int   `json:"maxConcurrent"`
+}
+
+type healthBrowserProfiles struct {
+	Available int              `json:"available"`
+	Usage     map[string]int64 `json:"usage"`
+}
+
+// 就绪检查结果
+type readiness struct {
+	Ready   bool     `json:"ready"`
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// 统计地址熔断状态（default 出口不计入）
+func addressSnapshot() healthAddresses {
+	var s healthAddresses
+	ipv6HealthMap.Range(func(key, value interface{}) bool {
+		if key.(string) == defaultAddressKey {
+			return true
+		}
+		s.Known++
+		health := value.(*IPv6Health)
+		if health.circuitOpen.Load() {
+			health.mu.RLock()
+			openAt := health.circuitOpenAt
+			health.mu.RUnlock()
+			if time.Since(openAt) <= config.circuitRecoveryTime {
+				s.CircuitOpen++
+			}
+		}
+		return true
+	})
+	return s
+}
+
+// 统计会话
+func sessionSnapshot() healthSession {
+	var s healthSession
+	var oldestRefresh, earliestExpiry time.Time
+
+	sessionManager.Range(func(key, value interface{}) bool {
+		session := value.(*CookieSession)
+		session.mu.RLock()
+		s.TotalCookies += int64(len(session.cookies))
+
+		// 记录最旧的刷新时间
+		if oldestRefresh.IsZero() || session.lastUpdate.Before(oldestRefresh) {
+			oldestRefresh = session.lastUpdate
+		}
+
+		// 记录最早的过期时间
+		if !session.earliestExpiry.IsZero() {
+			if earliestExpiry.IsZero() || session.earliestExpiry.Before(earliestExpiry) {
+				earliestExpiry = session.earliestExpiry
+			}
+		}
+		session.mu.RUnlock()
+
+		if session.refreshFails.Load() >= readyRefreshFailThreshold {
+			s.FailingSessions++
+		}
+		s.TotalSessions++
+		return true
+	})
+
+	s.OldestRefresh = oldestRefresh.Format(time.RFC3339)
+	s.EarliestExpiry = earliestExpiry.Format(time.RFC3339)
+
+	// 计算 Cookie 剩余有效时间
+	if !earliestExpiry.IsZero() {
+		if remaining := time.Until(earliestExpiry).Seconds(); remaining > 0 {
+			s.CookieValidSeconds = int64(remaining)
+		}
+	}
+	s.SessionRefreshCount = stats.sessionRefreshCount.Load()
+	return s
+}
+
+// 判断是否可以接收流量
+func checkReadiness(addresses healthAddresses, sessions healthSession) readiness {
+	var reasons []string
+
+	if draining.Load() {
+		reasons = append(reasons, "shutting down")
+	}
+	if addresses.Known > 0 && addresses.CircuitOpen >= addresses.Known {
+		reasons = append(reasons, fmt.Sprintf("no usable addresses: all %d circuit breakers open", addresses.Known))
+	}
+	if sessions.TotalSessions > 0 && sessions.FailingSessions >= sessions.TotalSessions {
+		reasons = append(reasons, fmt.Sprintf("all %d sessions failing to refresh", sessions.TotalSessions))
+	}
+
+	return readiness{Ready: len(reasons) == 0, Reasons: reasons}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(v)
+}
+
+// 健康检查处理器
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, buildHealth())
+}
+
+// 完整统计（/health 与关闭时的状态快照）
+func buildHealth() healthResponse {
+	total := stats.totalRequests.Load()
+	success := stats.successRequests.Load()
+
+	var successRate float64
+	if total > 0 {
+		successRate = float64(success) / float64(total) * 100
+	}
+
+	// 统计浏览器使用情况
+	browserUsage := make(map[string]int64)
+	stats.browserUsage.Range(func(key, value interface{}) bool {
+		browserUsage[key.(string)] = value.(*atomic.Int64).Load()
+		return true
+	})
+
+	// 统计 IPv6 客户端缓存数量
+	var ipv6ClientCount int64
+	ipv6ClientCache.Range(func(key, value interface{}) bool {
+		ipv6ClientCount++
+		return true
+	})
+
+	addresses := addressSnapshot()
+	sessions := sessionSnapshot()
+	ready := checkReadiness(addresses, sessions)
+
+	status := "ok"
+	switch {
+	case draining.Load():
+		status = "shutting_down"
+	case !ready.Ready:
+		status = "degraded"
+	}
+
+	return healthResponse{
+		Status:          status,
+		Ready:           ready.Ready,
+		Reasons:         ready.Reasons,
+		Uptime:          int64(time.Since(stats.startTime).Seconds()),
+		TotalRequests:   total,
+		SuccessRequests: success,
+		FailedRequests:  stats.failedRequests.Load(),
+		SuccessRate:     fmt.Sprintf("%.2f%%", successRate),
+		Errors: healthErrors{
+			Error403: stats.error403Count.Load(),
+			Error429: stats.error429Count.Load(),
+			Error503: stats.error503Count.Load(),
+			Error5xx: stats.error5xxCount.Load(),
+			Timeout:  stats.timeoutCount.Load(),
+			Network:  stats.networkErrorCount.Load(),
+			DNS:      stats.dnsErrorCount.Load(),
+		},
+		Session:    sessions,
+		Addresses:  addresses,
+		ClientPool: healthClientPool{IPv6ClientsCached: ipv6ClientCount, Default: defaultClients.snapshot()},
+		ConcurrencyControl: healthConcurrency{
+			CurrentMaxConcurrent: currentMaxConcurrentRefresh.Load(),
+			ActiveRefreshCount:   int32(len(sessionRefreshSem)),
+			MinConcurrent:        config.minConcurrentRefresh,
+			MaxConcurrent:        config.maxConcurrentRefresh,
+		},
+		BrowserProfiles: healthBrowserProfiles{
+			Available: len(browserProfiles),
+			Usage:     browserUsage,
+		},
+		LoadShedding: admission.snapshot(),
+		Timing:       timingSnapshot(),
+		Tracing:      tracingSnapshot(),
+		DNS:          dnsSnapshot(),
+		ForwardProxy: forwardSnapshot(),
+		TLSSessions:  tlsSessionSnapshot(),
+	}
+}
+
+// 存活探针：能走到这里说明进程和 HTTP 服务正常
+func livezHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// 就绪探针：未就绪时返回 503，负载均衡据此摘除流量
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ready := checkReadiness(addressSnapshot(), sessionSnapshot())
+
+	status := http.StatusOK
+	if !ready.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, ready)
+}
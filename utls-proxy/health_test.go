@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 就绪检查：关闭中、所有地址熔断、所有会话刷新失败时未就绪
+func TestCheckReadiness(t *testing.T) {
+	if r := checkReadiness(healthAddresses{}, healthSession{}); !r.Ready {
+		t.Errorf("没有地址和会话时应就绪: %v", r.Reasons)
+	}
+	if r := checkReadiness(healthAddresses{Known: 3, CircuitOpen: 2}, healthSession{TotalSessions: 2, FailingSessions: 1}); !r.Ready {
+		t.Errorf("部分熔断、部分会话失败时应就绪: %v", r.Reasons)
+	}
+
+	r := checkReadiness(healthAddresses{Known: 2, CircuitOpen: 2}, healthSession{TotalSessions: 1, FailingSessions: 1})
+	if r.Ready || len(r.Reasons) != 2 ||
+		!strings.Contains(r.Reasons[0], "all 2 circuit breakers open") || !strings.Contains(r.Reasons[1], "all 1 sessions failing") {
+		t.Errorf("全部熔断且会话失败: %v", r.Reasons)
+	}
+
+	draining.Store(true)
+	defer draining.Store(false)
+	if r := checkReadiness(healthAddresses{}, healthSession{}); r.Ready || r.Reasons[0] != "shutting down" {
+		t.Errorf("关闭中: %v", r.Reasons)
+	}
+}
+
+// 地址统计不包含默认出口（key 为 default）
+func TestAddressSnapshotSkipsDefault(t *testing.T) {
+	health := getOrCreateIPv6Health("")
+	health.mu.Lock()
+	health.circuitOpenAt = time.Now()
+	health.mu.Unlock()
+	health.circuitOpen.Store(true)
+	defer health.circuitOpen.Store(false)
+
+	var known int64
+	ipv6HealthMap.Range(func(key, value interface{}) bool {
+		if key.(string) != defaultAddressKey {
+			known++
+		}
+		return true
+	})
+	if s := addressSnapshot(); s.Known != known {
+		t.Errorf("Known %d，应为 %d（不含 default）", s.Known, known)
+	}
+}
+
+// /livez 始终 200；/readyz 未就绪时返回 503 和原因
+func TestProbes(t *testing.T) {
+	rec := httptest.NewRecorder()
+	livezHandler(rec, httptest.NewRequest(http.MethodGet, "/livez", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("/livez: %d", rec.Code)
+	}
+
+	draining.Store(true)
+	rec = httptest.NewRecorder()
+	readyzHandler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	draining.Store(false)
+
+	var ready readiness
+	if err := json.Unmarshal(rec.Body.Bytes(), &ready); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusServiceUnavailable || ready.Ready || len(ready.Reasons) == 0 || rec.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("/readyz: %d %+v", rec.Code, ready)
+	}
+}
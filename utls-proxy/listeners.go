@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// 监听：
+//   - TCP（UTLS_PROXY_PORT，off = 不监听 TCP）
+//   - Unix socket（UTLS_UNIX_SOCKET），本机的 Node 服务可以绕过 TCP 回环，也不会占用端口
+//
+// 两种监听都接受 HTTP/1.1 和明文 HTTP/2（h2c，prior knowledge），
+// 调用方可以在一个连接上复用大量并发请求（UTLS_H2C=false 关闭）
+//
+// 从 systemd socket 激活或 SIGUSR2 交接（见 handoff.go）继承了监听时，只使用继承的监听
+
+// LISTEN_FDS 协议中第一个监听的 fd（0-2 为标准输入输出）
+const listenFDsStart = 3
+
+// 创建 TCP 和 Unix socket 监听
+func openListeners(port string) ([]net.Listener, error) {
+	inherited, err := inheritedListeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(inherited) > 0 {
+		addrs := make([]string, 0, len(inherited))
+		for _, ln := range inherited {
+			addrs = append(addrs, ln.Addr().Network()+":"+ln.Addr().String())
+		}
+		slog.Info("使用继承的监听", "listeners", addrs)
+		return inherited, nil
+	}
+
+	var listeners []net.Listener
+
+	if port != "" {
+		ln, err := net.Listen("tcp", ":"+port)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+
+	if config.unixSocket != "" {
+		ln, err := listenUnix(config.unixSocket, config.unixSocketMode)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+
+	if len(listeners) == 0 {
+		return nil, errors.New("未配置任何监听（UTLS_PROXY_PORT=off 且未设置 UTLS_UNIX_SOCKET）")
+	}
+	return listeners, nil
+}
+
+// 监听 Unix socket：删除上次异常退出遗留的 socket 文件，并设置文件权限
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("设置 socket 权限失败: %w", err)
+	}
+	return ln, nil
+}
+
+// 继承的监听（LISTEN_FDS 协议：从 fd 3 开始的 N 个 fd；LISTEN_PID 存在时必须是本进程）
+func inheritedListeners() ([]net.Listener, error) {
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	// 不再传给子进程（交接时重新设置）
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]net.Listener, 0, n)
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		syscall.CloseOnExec(fd)
+		file := os.NewFile(uintptr(fd), "listen-fd-"+strconv.Itoa(fd))
+		ln, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("fd %d 不是可用的监听: %w", fd, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// 路径上已有的 socket 能连上说明另一个进程正在使用，否则视为遗留文件删除；不是 socket 的文件不删除
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s 已存在且不是 socket", path)
+	}
+
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s 正在被其他进程使用", path)
+	}
+
+	slog.Info("删除遗留的 socket 文件", "path", path)
+	return os.Remove(path)
+}
+
+// 服务器接受的协议
+func serverProtocols() *http.Protocols {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(config.h2c)
+	return protocols
+}
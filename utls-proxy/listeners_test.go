@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Unix socket 路径有长度限制，不用 t.TempDir()
+func socketPath(t *testing.T) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "utls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "proxy.sock")
+}
+
+// 遗留的 socket 文件删除后重新监听；正在使用的 socket 和普通文件不删除
+func TestListenUnix(t *testing.T) {
+	path := socketPath(t)
+
+	// 模拟异常退出：关闭监听但保留 socket 文件
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := listenUnix(path, 0660)
+	if err != nil {
+		t.Fatalf("遗留的 socket 文件: %v", err)
+	}
+	defer ln.Close()
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0660 {
+		t.Errorf("socket 权限: %v %v", info.Mode(), err)
+	}
+
+	if _, err := listenUnix(path, 0660); err == nil {
+		t.Error("socket 正在使用，应返回错误")
+	}
+
+	regular := filepath.Join(filepath.Dir(path), "regular")
+	if err := os.WriteFile(regular, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenUnix(regular, 0660); err == nil {
+		t.Error("普通文件，应返回错误")
+	}
+	if _, err := os.Stat(regular); err != nil {
+		t.Errorf("普通文件被删除: %v", err)
+	}
+}
+
+// UTLS_PROXY_PORT=off 时只监听 Unix socket，HTTP/1.1 和 h2c 都可以访问（包括管理接口）；UTLS_H2C=false 时只接受 HTTP/1.1
+func TestUnixSocketH2C(t *testing.T) {
+	savedSocket, savedMode, savedH2C, savedToken := config.unixSocket, config.unixSocketMode, config.h2c, config.adminToken
+	defer func() {
+		config.unixSocket, config.unixSocketMode, config.h2c, config.adminToken = savedSocket, savedMode, savedH2C, savedToken
+	}()
+	config.adminToken = ""
+	config.unixSocket = socketPath(t)
+	config.unixSocketMode = 0660
+
+	listeners, err := openListeners("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 1 || listeners[0].Addr().Network() != "unix" {
+		t.Fatalf("监听: %v", listeners)
+	}
+
+	for _, h2c := range []bool{true, false} {
+		config.h2c = h2c
+		ln := listeners[0]
+		if !h2c {
+			if ln, err = listenUnix(config.unixSocket, config.unixSocketMode); err != nil {
+				t.Fatal(err)
+			}
+		}
+		server := &http.Server{
+			Protocols: serverProtocols(),
+			// Unix socket 上的调用方视为本机，可以访问管理接口
+			Handler: adminOnly(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, r.Proto)
+			}),
+		}
+		go server.Serve(ln)
+
+		for _, http2 := range []bool{false, true} {
+			proto, err := getOverUnix(config.unixSocket, http2)
+			switch {
+			case http2 && !h2c:
+				if err == nil {
+					t.Errorf("UTLS_H2C=false: h2c 请求应失败，实际 %s", proto)
+				}
+			case err != nil:
+				t.Errorf("h2c=%v http2=%v: %v", h2c, http2, err)
+			case http2 && proto != "HTTP/2.0", !http2 && proto != "HTTP/1.1":
+				t.Errorf("h2c=%v http2=%v: %s", h2c, http2, proto)
+			}
+		}
+		server.Close()
+	}
+}
+
+func getOverUnix(path string, http2 bool) (string, error) {
+	protocols := new(http.Protocols)
+	if http2 {
+		protocols.SetUnencryptedHTTP2(true)
+	} else {
+		protocols.SetHTTP1(true)
+	}
+	transport := &http.Transport{
+		Protocols: protocols,
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}
+	defer transport.CloseIdleConnections()
+
+	client := &http.Client{Transport: transport, Timeout: 5 * time.Second}
+	resp, err := client.Get("http://utls-proxy/")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
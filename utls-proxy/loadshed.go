@@ -0,0 +1,265 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 请求优先级（对应 zeromaps-rpc.proto 中的 DataType）
+type priorityClass int
+
+const (
+	priorityHigh   priorityClass = iota // 元数据：PlanetoidMetadata / BulkMetadata（BULK_METADATA）
+	priorityNormal                      // 节点数据：NodeData（NODE_DATA）及未知类型
+	priorityLow                         // 影像数据：ImageryData（IMAGERY_DATA）
+	numPriorityClasses
+)
+
+var priorityNames = [numPriorityClasses]string{"high", "normal", "low"}
+
+func (p priorityClass) String() string {
+	if p < 0 || p >= numPriorityClasses {
+		return "normal"
+	}
+	return priorityNames[p]
+}
+
+// 解析调用方通过 X-Priority 指定的优先级
+// 支持 high/normal/low、DataType 名称（BULK_METADATA 等）以及数值（1/2/3）
+func parsePriority(value string) (priorityClass, bool) {
+	switch strings.ToUpper(strings.TrimSpace(value)) {
+	case "HIGH", "METADATA", "BULK_METADATA", "1":
+		return priorityHigh, true
+	case "NORMAL", "NODE", "NODE_DATA", "UNKNOWN", "0", "2":
+		return priorityNormal, true
+	case "LOW", "IMAGERY", "IMAGERY_DATA", "3":
+		return priorityLow, true
+	}
+	return priorityNormal, false
+}
+
+// 根据 URL 路径推断优先级（kh.google.com/rt/earth/<Type>/...）
+func inferPriority(path string) priorityClass {
+	path = strings.TrimPrefix(path, "/rt/earth/")
+	dataType := path
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		dataType = path[:i]
+	}
+
+	switch dataType {
+	case "PlanetoidMetadata", "BulkMetadata":
+		return priorityHigh
+	case "ImageryData":
+		return priorityLow
+	}
+	return priorityNormal
+}
+
+// 获取请求优先级：Header 优先，否则按 URL 推断
+func requestPriority(r *http.Request, targetPath string) priorityClass {
+	if value := r.Header.Get("X-Priority"); value != "" {
+		if p, ok := parsePriority(value); ok {
+			return p
+		}
+	}
+	return inferPriority(targetPath)
+}
+
+// 全局并发控制器
+var admission = newLoadShedder()
+
+var (
+	errQueueFull    = errors.New("等待队列已满")
+	errQueueTimeout = errors.New("排队超时")
+)
+
+// 排队中的请求
+type admissionWaiter struct {
+	ready   chan struct{} // 获得执行槽位时关闭
+	granted bool          // 是否已获得槽位（受 loadShedder.mu 保护）
+}
+
+// 负载控制器：限制最大并发（in-flight）数，超出部分按优先级排队，队列满时直接拒绝
+type loadShedder struct {
+	mu       sync.Mutex
+	inFlight int
+	queued   int
+	queues   [numPriorityClasses]*list.List
+
+	admitted     atomic.Int64
+	shed         atomic.Int64
+	queueTimeout atomic.Int64
+	waitCount    [numPriorityClasses]atomic.Int64
+	waitTotalNs  [numPriorityClasses]atomic.Int64
+	waitMaxNs    [numPriorityClasses]atomic.Int64
+}
+
+func newLoadShedder() *loadShedder {
+	ls := &loadShedder{}
+	for i := range ls.queues {
+		ls.queues[i] = list.New()
+	}
+	return ls
+}
+
+// 申请执行槽位；成功后必须调用 release
+func (ls *loadShedder) acquire(ctx context.Context, priority priorityClass) (time.Duration, error) {
+	// 未配置上限：只计数，不限制
+	if config.maxInFlight <= 0 {
+		ls.mu.Lock()
+		ls.inFlight++
+		ls.mu.Unlock()
+		ls.admitted.Add(1)
+		return 0, nil
+	}
+
+	ls.mu.Lock()
+	if ls.inFlight < config.maxInFlight && ls.queued == 0 {
+		ls.inFlight++
+		ls.mu.Unlock()
+		ls.admitted.Add(1)
+		return 0, nil
+	}
+
+	if ls.queued >= config.maxQueueSize {
+		ls.mu.Unlock()
+		ls.shed.Add(1)
+		return 0, errQueueFull
+	}
+
+	waiter := &admissionWaiter{ready: make(chan struct{})}
+	elem := ls.queues[priority].PushBack(waiter)
+	ls.queued++
+	ls.mu.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(config.maxQueueWait)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-waiter.ready:
+	case <-timer.C:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		ls.mu.Lock()
+		if waiter.granted {
+			// 超时与分配同时发生：槽位已转交给我们，直接使用
+			err = nil
+		} else {
+			ls.queues[priority].Remove(elem)
+			ls.queued--
+		}
+		ls.mu.Unlock()
+	}
+
+	wait := time.Since(start)
+	ls.recordWait(priority, wait)
+
+	if err != nil {
+		if errors.Is(err, errQueueTimeout) {
+			ls.queueTimeout.Add(1)
+		}
+		ls.shed.Add(1)
+		return wait, err
+	}
+
+	ls.admitted.Add(1)
+	return wait, nil
+}
+
+// 释放执行槽位：优先转交给最高优先级的排队请求
+func (ls *loadShedder) release() {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if config.maxInFlight > 0 {
+		for _, queue := range ls.queues {
+			if front := queue.Front(); front != nil {
+				waiter := queue.Remove(front).(*admissionWaiter)
+				ls.queued--
+				waiter.granted = true
+				close(waiter.ready)
+				return // 槽位直接转交，inFlight 不变
+			}
+		}
+	}
+
+	ls.inFlight--
+}
+
+func (ls *loadShedder) recordWait(priority priorityClass, wait time.Duration) {
+	ns := int64(wait)
+	ls.waitCount[priority].Add(1)
+	ls.waitTotalNs[priority].Add(ns)
+	for {
+		old := ls.waitMaxNs[priority].Load()
+		if ns <= old || ls.waitMaxNs[priority].CompareAndSwap(old, ns) {
+			return
+		}
+	}
+}
+
+// 负载控制统计
+type loadShedStats struct {
+	InFlight     int                         `json:"inFlight"`
+	MaxInFlight  int                         `json:"maxInFlight"`
+	QueueDepth   int                         `json:"queueDepth"`
+	MaxQueueSize int                         `json:"maxQueueSize"`
+	Admitted     int64                       `json:"admitted"`
+	Shed         int64                       `json:"shed"`
+	QueueTimeout int64                       `json:"queueTimeout"`
+	Priorities   map[string]priorityWaitStat `json:"priorities"`
+}
+
+type priorityWaitStat struct {
+	QueueDepth int     `json:"queueDepth"`
+	Waited     int64   `json:"waited"`
+	AvgWaitMs  float64 `json:"avgWaitMs"`
+	MaxWaitMs  float64 `json:"maxWaitMs"`
+}
+
+func (ls *loadShedder) snapshot() loadShedStats {
+	s := loadShedStats{
+		MaxInFlight:  config.maxInFlight,
+		MaxQueueSize: config.maxQueueSize,
+		Admitted:     ls.admitted.Load(),
+		Shed:         ls.shed.Load(),
+		QueueTimeout: ls.queueTimeout.Load(),
+		Priorities:   make(map[string]priorityWaitStat, numPriorityClasses),
+	}
+
+	ls.mu.Lock()
+	s.InFlight = ls.inFlight
+	s.QueueDepth = ls.queued
+	var depths [numPriorityClasses]int
+	for i, queue := range ls.queues {
+		depths[i] = queue.Len()
+	}
+	ls.mu.Unlock()
+
+	for i := priorityClass(0); i < numPriorityClasses; i++ {
+		count := ls.waitCount[i].Load()
+		stat := priorityWaitStat{
+			QueueDepth: depths[i],
+			Waited:     count,
+			MaxWaitMs:  float64(ls.waitMaxNs[i].Load()) / float64(time.Millisecond),
+		}
+		if count > 0 {
+			stat.AvgWaitMs = float64(ls.waitTotalNs[i].Load()) / float64(count) / float64(time.Millisecond)
+		}
+		s.Priorities[i.String()] = stat
+	}
+
+	return s
+}
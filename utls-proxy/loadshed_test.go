@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// 临时修改并发上限、队列长度和排队时间
+func setAdmissionLimits(t *testing.T, maxInFlight, maxQueueSize int, maxQueueWait time.Duration) {
+	t.Helper()
+	savedInFlight, savedQueueSize, savedQueueWait := config.maxInFlight, config.maxQueueSize, config.maxQueueWait
+	config.maxInFlight, config.maxQueueSize, config.maxQueueWait = maxInFlight, maxQueueSize, maxQueueWait
+	t.Cleanup(func() {
+		config.maxInFlight, config.maxQueueSize, config.maxQueueWait = savedInFlight, savedQueueSize, savedQueueWait
+	})
+}
+
+// 释放的槽位按优先级转交给排队的请求，队列满时立即拒绝
+func TestLoadShedderPriorityOrder(t *testing.T) {
+	setAdmissionLimits(t, 1, 3, 5*time.Second)
+	ls := newLoadShedder()
+	ctx := context.Background()
+
+	if _, err := ls.acquire(ctx, priorityNormal); err != nil {
+		t.Fatal(err)
+	}
+
+	order := make(chan priorityClass, 3)
+	for i, p := range []priorityClass{priorityLow, priorityNormal, priorityHigh} {
+		go func() {
+			if _, err := ls.acquire(ctx, p); err != nil {
+				t.Errorf("%s: %v", p, err)
+				return
+			}
+			order <- p
+		}()
+		waitFor(t, "请求未进入队列", func() bool { return ls.snapshot().QueueDepth == i+1 })
+	}
+
+	if _, err := ls.acquire(ctx, priorityHigh); !errors.Is(err, errQueueFull) {
+		t.Errorf("队列已满: %v", err)
+	}
+
+	for _, want := range []priorityClass{priorityHigh, priorityNormal, priorityLow} {
+		ls.release()
+		if got := <-order; got != want {
+			t.Errorf("获得槽位的顺序: %s，应为 %s", got, want)
+		}
+	}
+	ls.release()
+
+	s := ls.snapshot()
+	if s.InFlight != 0 || s.QueueDepth != 0 || s.Admitted != 4 || s.Shed != 1 {
+		t.Errorf("统计: %+v", s)
+	}
+	if s.Priorities["low"].Waited != 1 || s.Priorities["low"].MaxWaitMs <= 0 {
+		t.Errorf("low 的排队统计: %+v", s.Priorities["low"])
+	}
+}
+
+// 排队超时和调用方取消都会移出队列，不占用槽位
+func TestLoadShedderQueueTimeout(t *testing.T) {
+	setAdmissionLimits(t, 1, 4, 20*time.Millisecond)
+	ls := newLoadShedder()
+
+	if _, err := ls.acquire(context.Background(), priorityNormal); err != nil {
+		t.Fatal(err)
+	}
+	wait, err := ls.acquire(context.Background(), priorityLow)
+	if !errors.Is(err, errQueueTimeout) || wait < 20*time.Millisecond {
+		t.Errorf("排队超时: %v，等待 %v", err, wait)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ls.acquire(ctx, priorityHigh); !errors.Is(err, context.Canceled) {
+		t.Errorf("取消: %v", err)
+	}
+
+	ls.release()
+	s := ls.snapshot()
+	if s.InFlight != 0 || s.QueueDepth != 0 || s.QueueTimeout != 1 || s.Shed != 2 {
+		t.Errorf("统计: %+v", s)
+	}
+}
+
+// 过载时 /proxy 返回 503 overloaded 和 Retry-After
+func TestProxyOverloaded(t *testing.T) {
+	_, proxy := startMockProxy(t)
+	setAdmissionLimits(t, 1, 0, time.Second)
+
+	if _, err := admission.acquire(context.Background(), priorityHigh); err != nil {
+		t.Fatal(err)
+	}
+	defer admission.release()
+
+	resp, err := http.Get(proxy.URL + "/proxy?url=" + url.QueryEscape("https://kh.google.com/rt/earth/PlanetoidMetadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("X-Utls-Error") != codeOverloaded || resp.Header.Get("Retry-After") != "1" {
+		t.Errorf("状态码 %d，X-Utls-Error %q，Retry-After %q", resp.StatusCode, resp.Header.Get("X-Utls-Error"), resp.Header.Get("Retry-After"))
+	}
+}
+
+// X-Priority 支持的写法，以及按 Earth 数据类型推断的优先级
+func TestRequestPriority(t *testing.T) {
+	for value, want := range map[string]priorityClass{
+		"high":           priorityHigh,
+		" BULK_METADATA": priorityHigh,
+		"1":              priorityHigh,
+		"node_data":      priorityNormal,
+		"0":              priorityNormal,
+		"Imagery":        priorityLow,
+		"3":              priorityLow,
+	} {
+		if got, ok := parsePriority(value); !ok || got != want {
+			t.Errorf("parsePriority(%q) = %s, %v", value, got, ok)
+		}
+	}
+	if _, ok := parsePriority("urgent"); ok {
+		t.Error("未知的优先级应返回 false")
+	}
+
+	for path, want := range map[string]priorityClass{
+		"/rt/earth/PlanetoidMetadata":            priorityHigh,
+		"/rt/earth/BulkMetadata/pb=!1m2!1s0!2u1": priorityHigh,
+		"/rt/earth/NodeData/pb=!1m2!1s0!2u1":     priorityNormal,
+		"/rt/earth/ImageryData/pb=!1m2!1s0!2u1":  priorityLow,
+		"/web/":                                  priorityNormal,
+	} {
+		if got := inferPriority(path); got != want {
+			t.Errorf("inferPriority(%q) = %s，应为 %s", path, got, want)
+		}
+	}
+
+	// X-Priority 优先于路径，无法解析时按路径推断
+	r, _ := http.NewRequest(http.MethodGet, "/proxy", nil)
+	r.Header.Set("X-Priority", "IMAGERY_DATA")
+	if got := requestPriority(r, "/rt/earth/BulkMetadata/x"); got != priorityLow {
+		t.Errorf("X-Priority: %s", got)
+	}
+	r.Header.Set("X-Priority", "urgent")
+	if got := requestPriority(r, "/rt/earth/BulkMetadata/x"); got != priorityHigh {
+		t.Errorf("无效的 X-Priority: %s", got)
+	}
+}
+
+// 等待条件成立（最多 5 秒）
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// 结构化日志：基于 log/slog，支持级别、text/json 输出、成功日志采样以及运行时调整级别
+//
+// 统一字段名：
+//   - request_id  请求 ID（调用方的 X-Request-Id 或自动生成）
+//   - addr        出口 IPv6 地址（无绑定时为 default）
+//   - profile     浏览器指纹
+//   - host        目标域名
+//   - status      HTTP 状态码
+//   - duration_ms 耗时（毫秒）
+//   - attempt     第几次尝试（从 1 开始）
+
+var (
+	logLevel          = new(slog.LevelVar)              // 当前日志级别（可运行时修改）
+	logOutput         = &swappableWriter{w: os.Stdout}  // 日志输出（轮转时切换文件）
+	successLogCounter atomic.Uint64                     // 成功日志采样计数
+	requestIDCounter  atomic.Uint64                     // 请求 ID 序号
+	requestIDPrefix   = hex.EncodeToString(randomID(4)) // 进程级前缀，避免重启后 ID 重复
+)
+
+// 可切换目标的 Writer（所有写入串行化，切换时不会丢失或交错日志行）
+type swappableWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *swappableWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+// 切换输出目标，返回旧的目标
+func (s *swappableWriter) swap(w io.Writer) io.Writer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.w
+	s.w = w
+	return old
+}
+
+// 解析日志级别：debug / info / warn / error
+func parseLogLevel(value string) (slog.Level, bool) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(value))); err != nil {
+		return slog.LevelInfo, false
+	}
+	return level, true
+}
+
+// 按配置安装全局 slog Logger（标准库 log 的输出也会转到这里）
+func setupLogger() {
+	logLevel.Set(config.logLevel)
+
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	if config.logFormat == "json" {
+		handler = slog.NewJSONHandler(logOutput, opts)
+	} else {
+		handler = slog.NewTextHandler(logOutput, opts)
+	}
+
+	slog.SetDefault(slog.New(handler))
+}
+
+// 成功日志采样：按配置比例输出（1 = 全部，0 = 不输出）
+func shouldLogSuccess() bool {
+	rate := config.logSuccessSampleRate
+	if rate >= 1 {
+		return true
+	}
+	if rate <= 0 {
+		return false
+	}
+	every := uint64(math.Round(1 / rate))
+	return (successLogCounter.Add(1)-1)%every == 0
+}
+
+// 获取请求 ID：优先使用调用方传入的 X-Request-Id
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); id != "" && len(id) <= 128 {
+		return id
+	}
+	return requestIDPrefix + "-" + strconv.FormatUint(requestIDCounter.Add(1), 16)
+}
+
+func randomID(n int) []byte {
+	b := make([]byte, n)
+	randomBytes(b)
+	return b
+}
+
+// 日志中使用的地址（无 IPv6 时为 default）
+func logAddr(ipv6 string) string {
+	if ipv6 == "" {
+		return defaultAddressKey
+	}
+	return ipv6
+}
+
+// 运行时查看/修改日志级别
+// GET /loglevel
+// PUT /loglevel?level=debug（或请求体 {"level":"debug"}）
+func logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		value := r.URL.Query().Get("level")
+		if value == "" {
+			var body struct {
+				Level string `json:"level"`
+			}
+			if err := json.NewDecoder(io.LimitReader(r.Body, 1024)).Decode(&body); err == nil {
+				value = body.Level
+			}
+		}
+
+		level, ok := parseLogLevel(value)
+		if !ok {
+			http.Error(w, "Invalid level (debug/info/warn/error)", http.StatusBadRequest)
+			return
+		}
+
+		old := logLevel.Level()
+		logLevel.Set(level)
+		slog.Warn("日志级别已修改", "from", old.String(), "to", level.String())
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"level": logLevel.Level().String()})
+}
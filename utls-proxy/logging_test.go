@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// 成功日志按比例采样：0.25 表示每 4 个成功请求输出 1 条
+func TestShouldLogSuccess(t *testing.T) {
+	saved := config.logSuccessSampleRate
+	defer func() { config.logSuccessSampleRate = saved }()
+
+	for _, tc := range []struct {
+		rate float64
+		want int
+	}{
+		{1, 8},
+		{0.25, 2},
+		{0.5, 4},
+		{0, 0},
+	} {
+		config.logSuccessSampleRate = tc.rate
+		successLogCounter.Store(0)
+		logged := 0
+		for range 8 {
+			if shouldLogSuccess() {
+				logged++
+			}
+		}
+		if logged != tc.want {
+			t.Errorf("采样率 %v: 8 个请求输出 %d 条，应为 %d", tc.rate, logged, tc.want)
+		}
+	}
+}
+
+// 调用方的 X-Request-Id 原样沿用（过长时忽略），否则生成带进程前缀的 ID
+func TestRequestID(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/proxy", nil)
+	r.Header.Set("X-Request-Id", "caller-1")
+	if id := requestID(r); id != "caller-1" {
+		t.Errorf("沿用调用方的 ID: %q", id)
+	}
+
+	r.Header.Set("X-Request-Id", strings.Repeat("x", 129))
+	first := requestID(r)
+	second := requestID(r)
+	if !strings.HasPrefix(first, requestIDPrefix+"-") || first == second {
+		t.Errorf("生成的 ID: %q, %q", first, second)
+	}
+}
+
+// /loglevel：GET 查看，PUT 查询参数或 POST 请求体修改，无效级别返回 400
+func TestLogLevelHandler(t *testing.T) {
+	saved := logLevel.Level()
+	defer logLevel.Set(saved)
+	logLevel.Set(slog.LevelWarn)
+
+	call := func(method, target, body string) (int, string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		logLevelHandler(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		var got struct {
+			Level string `json:"level"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &got)
+		return rec.Code, got.Level
+	}
+
+	if code, level := call(http.MethodGet, "/loglevel", ""); code != http.StatusOK || level != "WARN" {
+		t.Errorf("GET: %d %q", code, level)
+	}
+	if code, level := call(http.MethodPut, "/loglevel?level=debug", ""); code != http.StatusOK || level != "DEBUG" || logLevel.Level() != slog.LevelDebug {
+		t.Errorf("PUT: %d %q", code, level)
+	}
+	if code, level := call(http.MethodPost, "/loglevel", `{"level":"error"}`); code != http.StatusOK || level != "ERROR" || logLevel.Level() != slog.LevelError {
+		t.Errorf("POST: %d %q", code, level)
+	}
+	if code, _ := call(http.MethodPut, "/loglevel?level=verbose", ""); code != http.StatusBadRequest || logLevel.Level() != slog.LevelError {
+		t.Errorf("无效级别: %d，当前级别 %s", code, logLevel.Level())
+	}
+
+	rec := httptest.NewRecorder()
+	logLevelHandler(rec, httptest.NewRequest(http.MethodDelete, "/loglevel", nil))
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "GET, PUT, POST" {
+		t.Errorf("DELETE: %d，Allow %q", rec.Code, rec.Header().Get("Allow"))
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// 日志文件轮转（运行日志和访问日志共用）：
+//   - 写入时检查大小，超过上限立即轮转；可选每天零点轮转
+//   - 旧文件重命名为 <file>.<时间戳>，后台压缩为 .gz
+//   - 按 maxBackups 和 maxAge 清理轮转产生的旧文件（文件名带轮转时间戳或旧版本的序号，同目录的其他文件不受影响）
+//   - 收到 SIGUSR1 时重新打开文件（配合外部 logrotate / copytruncate）
+//
+// 轮转在持有写锁时完成，每次 Write 都是完整的一行，切换期间不会丢失或交错日志。
+// 注意：Write 内不能调用 slog（运行日志本身就写到这里），轮转结果由后台任务记录。
+
+const rotatedTimeFormat = "20060102-150405.000"
+
+type rotatingLog struct {
+	path       string
+	maxSizeMB  int  // 单个文件最大大小（MB）
+	maxBackups int  // 保留的旧文件数（0 = 不限制）
+	maxAgeDays int  // 旧文件保留天数（0 = 不限制）
+	daily      bool // 是否每天轮转
+	compress   bool // 是否压缩旧文件
+
+	mu       sync.Mutex
+	file     *os.File
+	out      io.Writer // 当前输出（文件打开失败时回退到 stdout）
+	size     int64     // 当前文件大小
+	openDay  int       // 当前文件对应的日期（yyyymmdd，用于每天轮转）
+	closed   bool
+	rotated  chan string // 待压缩/清理的旧文件
+	workDone chan struct{}
+}
+
+// 创建目录并以追加模式打开日志文件
+func openRotatingLog(path string, maxSizeMB, maxBackups, maxAgeDays int) (*rotatingLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("创建日志目录失败: %w", err)
+	}
+
+	l := &rotatingLog{
+		path:       path,
+		maxSizeMB:  maxSizeMB,
+		maxBackups: maxBackups,
+		maxAgeDays: maxAgeDays,
+		daily:      config.logRotateDaily,
+		compress:   config.logCompress,
+		rotated:    make(chan string, 16),
+		workDone:   make(chan struct{}),
+	}
+	if err := l.openFile(); err != nil {
+		return nil, err
+	}
+
+	go l.worker()
+	l.rotated <- "" // 启动时清理一次历史文件
+
+	return l, nil
+}
+
+// 打开（或重新打开）日志文件，调用方需持有锁或处于初始化阶段
+func (l *rotatingLog) openFile() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("打开日志文件失败: %w", err)
+	}
+
+	var size int64
+	if info, err := file.Stat(); err == nil {
+		size = info.Size()
+	}
+
+	l.file = file
+	l.out = file
+	l.size = size
+	l.openDay = dayNumber(time.Now())
+	return nil
+}
+
+func dayNumber(t time.Time) int {
+	y, m, d := t.Date()
+	return y*10000 + int(m)*100 + d
+}
+
+func (l *rotatingLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return len(p), nil
+	}
+
+	if l.file != nil && l.shouldRotate(len(p)) {
+		l.rotate()
+	}
+
+	n, err := l.out.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+func (l *rotatingLog) shouldRotate(next int) bool {
+	if l.size == 0 {
+		return false
+	}
+	if l.daily && dayNumber(time.Now()) != l.openDay {
+		return true
+	}
+	if l.size+int64(next) <= int64(l.maxSizeMB)*1024*1024 {
+		return false
+	}
+
+	// 外部 copytruncate 截断后计数会偏大，以实际大小为准
+	if info, err := l.file.Stat(); err == nil && info.Size() < l.size {
+		l.size = info.Size()
+		return l.size > 0 && l.size+int64(next) > int64(l.maxSizeMB)*1024*1024
+	}
+	return true
+}
+
+// 轮转：关闭当前文件 → 重命名为带时间戳的旧文件 → 打开新文件（持有锁）
+func (l *rotatingLog) rotate() {
+	l.file.Close()
+	l.file = nil
+
+	backup := l.path + "." + time.Now().Format(rotatedTimeFormat)
+	if err := os.Rename(l.path, backup); err != nil {
+		backup = ""
+	}
+
+	if err := l.openFile(); err != nil {
+		// 回退到 stdout，下次 SIGUSR1 时重试
+		l.out = os.Stdout
+		l.size = 0
+		fmt.Fprintf(os.Stderr, "日志轮转失败，输出到 stdout: %v\n", err)
+	}
+
+	select {
+	case l.rotated <- backup:
+	default:
+		// 后台任务积压，下次轮转时统一清理
+	}
+}
+
+// 重新打开日志文件（外部工具已移动或截断文件）
+func (l *rotatingLog) reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return nil
+	}
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+	if err := l.openFile(); err != nil {
+		l.out = os.Stdout
+		l.size = 0
+		return err
+	}
+	return nil
+}
+
+func (l *rotatingLog) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.rotated)
+
+	var err error
+	if l.file != nil {
+		err = l.file.Close()
+		l.file = nil
+	}
+	l.out = io.Discard
+	l.mu.Unlock()
+
+	// 等待正在进行的压缩完成
+	<-l.workDone
+	return err
+}
+
+// 后台任务：压缩旧文件并清理
+func (l *rotatingLog) worker() {
+	defer close(l.workDone)
+
+	for backup := range l.rotated {
+		if backup != "" {
+			slog.Info("日志轮转完成", "file", l.path, "backup", filepath.Base(backup))
+
+			if l.compress {
+				if err := compressFile(backup); err != nil {
+					slog.Warn("压缩旧日志失败", "file", filepath.Base(backup), "error", err)
+				}
+			}
+		}
+
+		l.cleanOld()
+	}
+}
+
+// gzip 压缩文件，成功后删除原文件
+func compressFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := name + ".gz.tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(dst)
+	_, err = io.Copy(gz, src)
+	if closeErr := gz.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name+".gz")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// 保留原文件的修改时间，按时间清理时才准确
+	if info, statErr := src.Stat(); statErr == nil {
+		os.Chtimes(name+".gz", info.ModTime(), info.ModTime())
+	}
+	return os.Remove(name)
+}
+
+// 清理旧日志：超过保留数量或保留天数的文件都删除（只处理轮转产生的文件）
+func (l *rotatingLog) cleanOld() {
+	dir := filepath.Dir(l.path)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	type backupFile struct {
+		name    string
+		modTime time.Time
+	}
+	var backups []backupFile
+	for _, entry := range entries {
+		if !isRotatedBackup(filepath.Base(l.path), entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		backups = append(backups, backupFile{name: filepath.Join(dir, entry.Name()), modTime: info.ModTime()})
+	}
+
+	// 新的在前
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].modTime.After(backups[j].modTime)
+	})
+
+	var cutoffTime time.Time
+	if l.maxAgeDays > 0 {
+		cutoffTime = time.Now().AddDate(0, 0, -l.maxAgeDays)
+	}
+
+	for i, b := range backups {
+		tooMany := l.maxBackups > 0 && i >= l.maxBackups
+		tooOld := !cutoffTime.IsZero() && b.modTime.Before(cutoffTime)
+		if !tooMany && !tooOld {
+			continue
+		}
+		if err := os.Remove(b.name); err == nil {
+			slog.Info("清理旧日志", "file", filepath.Base(b.name),
+				"max_backups", l.maxBackups, "max_age_days", l.maxAgeDays)
+		}
+	}
+}
+
+// <base>.<时间戳> 或压缩后的 <base>.<时间戳>.gz；同目录下的其他文件（.bak、.lock、正在压缩的 .tmp 等）不是旧日志
+func isRotatedBackup(base, name string) bool {
+	stamp, ok := strings.CutPrefix(name, base+".")
+	if !ok {
+		return false
+	}
+	stamp = strings.TrimSuffix(stamp, ".gz")
+	if _, err := time.Parse(rotatedTimeFormat, stamp); err == nil {
+		return true
+	}
+	// 旧版本按序号轮转留下的 <文件>.1 … <文件>.N，升级后按同样的规则清理
+	return stamp != "" && strings.Trim(stamp, "0123456789") == ""
+}
+
+// 收到 SIGUSR1 时重新打开日志文件
+func startLogReopenHandler(ctx context.Context) {
+	if mainLog == nil && accessLog == nil {
+		return
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGUSR1)
+	defer signal.Stop(sigChan)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigChan:
+		}
+
+		for _, l := range []*rotatingLog{mainLog, accessLog} {
+			if l == nil {
+				continue
+			}
+			if err := l.reopen(); err != nil {
+				slog.Error("重新打开日志文件失败，日志将输出到 stdout", "file", l.path, "error", err)
+				continue
+			}
+			slog.Info("日志文件已重新打开", "file", l.path)
+		}
+	}
+}
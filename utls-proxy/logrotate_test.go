@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 只清理文件名带轮转时间戳的旧日志，超过保留数量的按修改时间从旧到新删除
+func TestRotatingLogCleanOld(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "utls-proxy.log")
+	l := &rotatingLog{path: path, maxBackups: 2}
+
+	now := time.Now()
+	backups := make([]string, 4)
+	for i := range backups {
+		stamp := now.Add(time.Duration(i-4) * time.Hour)
+		backups[i] = path + "." + stamp.Format(rotatedTimeFormat)
+		if i%2 == 0 {
+			backups[i] += ".gz"
+		}
+		if err := os.WriteFile(backups[i], []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(backups[i], stamp, stamp)
+	}
+	// 旧版本按序号轮转留下的文件，比带时间戳的文件更早，应先被清理
+	legacy := []string{path + ".1", path + ".2.gz"}
+	for _, name := range legacy {
+		if err := os.WriteFile(name, []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		old := now.Add(-24 * time.Hour)
+		os.Chtimes(name, old, old)
+	}
+	others := []string{
+		path,
+		path + ".",
+		path + ".1x",
+		path + ".bak",
+		path + ".lock",
+		path + "." + now.Format(rotatedTimeFormat) + ".gz.tmp",
+		filepath.Join(dir, "access.log."+now.Format(rotatedTimeFormat)),
+	}
+	for _, name := range others {
+		if err := os.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		old := now.Add(-48 * time.Hour)
+		os.Chtimes(name, old, old)
+	}
+
+	l.cleanOld()
+
+	for i, name := range backups {
+		_, err := os.Stat(name)
+		if kept := err == nil; kept != (i >= 2) {
+			t.Errorf("%s: 保留 %v", filepath.Base(name), kept)
+		}
+	}
+	for _, name := range legacy {
+		if _, err := os.Stat(name); err == nil {
+			t.Errorf("旧版本的轮转文件未被清理: %s", filepath.Base(name))
+		}
+	}
+	for _, name := range others {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("不是轮转产生的文件也被删除: %s", filepath.Base(name))
+		}
+	}
+}
+
+// 超过大小上限时轮转，旧文件压缩为 .gz，新文件从下一行开始
+func TestRotatingLogRotateOnSize(t *testing.T) {
+	saved := config.logCompress
+	config.logCompress = true
+	defer func() { config.logCompress = saved }()
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, err := openRotatingLog(path, 1, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := strings.Repeat("x", 1023) + "\n"
+	for range 1024 {
+		l.Write([]byte(line))
+	}
+	l.Write([]byte("last\n"))
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	current, _ := os.ReadFile(path)
+	if string(current) != "last\n" {
+		t.Errorf("轮转后的新文件: %q", current)
+	}
+	matches, _ := filepath.Glob(path + ".*")
+	if len(matches) != 1 || !isRotatedBackup(filepath.Base(path), filepath.Base(matches[0])) || !strings.HasSuffix(matches[0], ".gz") {
+		t.Fatalf("旧文件: %v", matches)
+	}
+
+	f, err := os.Open(matches[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil || !bytes.Equal(data, bytes.Repeat([]byte(line), 1024)) {
+		t.Errorf("旧文件内容 %d 字节: %v", len(data), err)
+	}
+}
@@ -5,16 +5,16 @@ import (
 	"compress/gzip"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
-	"log"
-	"math/rand"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"os"
 	"os/signal"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -24,9 +24,11 @@ import (
 
 	utls "github.com/refraction-networking/utls"
 	"golang.org/x/net/http2"
+
+	"zeromaps-utls-proxy/mockupstream"
 )
 
-// 浏览器指纹配置（严格基于 uTLS v1.6.0 支持的 ClientHelloID）
+// 浏览器指纹配置（由指纹库加载，ClientHello 在链接的 uTLS 版本中解析，见 profiles.go）
 type BrowserProfile struct {
 	Name            string
 	UserAgent       string
@@ -35,15 +37,17 @@ type BrowserProfile struct {
 	AcceptLanguage  string
 	Accept          string
 	ClientHello     utls.ClientHelloID
+	Weight          float64 // 分配权重
 }
 
 // Cookie 会话管理
 type CookieSession struct {
 	cookies        []*http.Cookie
 	lastUpdate     time.Time
-	earliestExpiry time.Time   // 最早过期的 Cookie 的过期时间
-	lastAccess     time.Time   // 最后访问时间（用于清理）
-	refreshing     atomic.Bool // 是否正在刷新（防止并发刷新）
+	earliestExpiry time.Time    // 最早过期的 Cookie 的过期时间
+	lastAccess     time.Time    // 最后访问时间（用于清理）
+	refreshing     atomic.Bool  // 是否正在刷新（防止并发刷新）
+	refreshFails   atomic.Int32 // 连续刷新失败次数（用于就绪检查）
 	mu             sync.RWMutex
 }
 
@@ -52,7 +56,7 @@ type IPv6Health struct {
 	totalRequests  atomic.Int64
 	failedRequests atomic.Int64
 	circuitOpen    atomic.Bool // 熔断器是否打开（true = 熔断中）
-	circuitOpenAt  time.Time   // 熔断器打开时间
+	circuitOpenAt  time.Time   // 熔断器打开时间（打开和恢复都在 mu 下进行）
 	mu             sync.RWMutex
 }
 
@@ -67,6 +71,7 @@ type Stats struct {
 	error5xxCount       atomic.Int64 // 其他 5xx 错误
 	timeoutCount        atomic.Int64 // 超时错误
 	networkErrorCount   atomic.Int64 // 网络错误
+	dnsErrorCount       atomic.Int64 // DNS 解析错误
 	sessionRefreshCount atomic.Int64
 	startTime           time.Time
 	browserUsage        sync.Map // 记录每个浏览器的使用次数
@@ -74,7 +79,6 @@ type Stats struct {
 
 var (
 	stats                       = &Stats{startTime: time.Now()}
-	clientPool                  sync.Pool     // 无 IPv6 绑定的客户端池
 	ipv6ClientCache             sync.Map      // IPv6 地址 -> *http.Client 的缓存
 	sessionManager              sync.Map      // IPv6 地址 -> *CookieSession 的缓存（每个 IPv6 独立 Session）
 	browserProfileMap           sync.Map      // IPv6 地址 -> BrowserProfile 的缓存（每个 IPv6 固定浏览器指纹）
@@ -83,153 +87,18 @@ var (
 	currentMaxConcurrentRefresh atomic.Int32  // 当前最大并发刷新数（智能调整）
 	activeRequests              atomic.Int64  // 当前正在处理的请求数
 	shutdownFlag                atomic.Bool   // 关闭标志
-	logFileHandle               *os.File      // 日志文件句柄（用于日志轮转）
-	allowedDomains              = map[string]bool{
-		"kh.google.com":    true,
-		"earth.google.com": true,
-		"www.google.com":   true,
-	}
-
-	// 浏览器指纹库（基于 uTLS v1.8.1 官方支持）
-	browserProfiles = []BrowserProfile{
-		// ========== Chrome 系列（Chromium 内核）==========
-		{
-			Name:            "Chrome 133 (Windows 11)",
-			UserAgent:       "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/133.0.0.0 Safari/537.36",
-			SecChUa:         `"Chromium";v="133", "Not(A:Brand";v="24", "Google Chrome";v="133"`,
-			SecChUaPlatform: `"Windows"`,
-			AcceptLanguage:  "zh-CN,zh;q=0.9,en;q=0.8",
-			Accept:          "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7",
-			ClientHello:     utls.HelloChrome_133,
-		},
-		{
-			Name:            "Chrome 131 (Windows 10)",
-			UserAgent:       "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/131.0.0.0 Safari/537.36",
-			SecChUa:         `"Google Chrome";v="131", "Chromium";v="131", "Not_A Brand";v="24"`,
-			SecChUaPlatform: `"Windows"`,
-			AcceptLanguage:  "zh-CN,zh;q=0.9,en;q=0.8",
-			Accept:          "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7",
-			ClientHello:     utls.HelloChrome_131,
-		},
-		{
-			Name:            "Chrome 120 (Windows 10)",
-			UserAgent:       "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
-			SecChUa:         `"Not_A Brand";v="8", "Chromium";v="120", "Google Chrome";v="120"`,
-			SecChUaPlatform: `"Windows"`,
-			AcceptLanguage:  "zh-CN,zh;q=0.9,en;q=0.8",
-			Accept:          "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7",
-			ClientHello:     utls.HelloChrome_120,
-		},
-		{
-			Name:            "Chrome 102 (Windows 10)",
-			UserAgent:       "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/102.0.0.0 Safari/537.36",
-			SecChUa:         `" Not A;Brand";v="99", "Chromium";v="102", "Google Chrome";v="102"`,
-			SecChUaPlatform: `"Windows"`,
-			AcceptLanguage:  "en-US,en;q=0.9",
-			Accept:          "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8",
-			ClientHello:     utls.HelloChrome_102,
-		},
-		{
-			Name:            "Chrome 106 (macOS)",
-			UserAgent:       "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/106.0.0.0 Safari/537.36",
-			SecChUa:         `"Chromium";v="106", "Google Chrome";v="106", "Not;A=Brand";v="99"`,
-			SecChUaPlatform: `"macOS"`,
-			AcceptLanguage:  "en-US,en;q=0.9",
-			Accept:          "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8",
-			ClientHello:     utls.HelloChrome_106_Shuffle,
-		},
-		{
-			Name:            "Chrome 100 (Linux)",
-			UserAgent:       "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/100.0.4896.127 Safari/537.36",
-			SecChUa:         `" Not A;Brand";v="99", "Chromium";v="100", "Google Chrome";v="100"`,
-			SecChUaPlatform: `"Linux"`,
-			AcceptLanguage:  "en-US,en;q=0.9",
-			Accept:          "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8",
-			ClientHello:     utls.HelloChrome_100,
-		},
-
-		// ========== Firefox 系列 ==========
-		{
-			Name:            "Firefox 120 (Windows 10)",
-			UserAgent:       "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:120.0) Gecko/20100101 Firefox/120.0",
-			SecChUa:         "", // Firefox 不使用 Sec-Ch-Ua
-			SecChUaPlatform: "",
-			AcceptLanguage:  "en-US,en;q=0.5",
-			Accept:          "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8",
-			ClientHello:     utls.HelloFirefox_120,
-		},
-		{
-			Name:            "Firefox 105 (macOS)",
-			UserAgent:       "Mozilla/5.0 (Macintosh; Intel Mac OS X 10.15; rv:105.0) Gecko/20100101 Firefox/105.0",
-			SecChUa:         "",
-			SecChUaPlatform: "",
-			AcceptLanguage:  "en-US,en;q=0.5",
-			Accept:          "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8",
-			ClientHello:     utls.HelloFirefox_105,
-		},
-		{
-			Name:            "Firefox 102 (Linux)",
-			UserAgent:       "Mozilla/5.0 (X11; Linux x86_64; rv:102.0) Gecko/20100101 Firefox/102.0",
-			SecChUa:         "",
-			SecChUaPlatform: "",
-			AcceptLanguage:  "en-US,en;q=0.5",
-			Accept:          "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8",
-			ClientHello:     utls.HelloFirefox_102,
-		},
-
-		// ========== Edge 系列 ==========
-		{
-			Name:            "Edge 106 (Windows 11)",
-			UserAgent:       "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/106.0.0.0 Safari/537.36 Edg/106.0.1370.52",
-			SecChUa:         `"Chromium";v="106", "Microsoft Edge";v="106", "Not;A=Brand";v="99"`,
-			SecChUaPlatform: `"Windows"`,
-			AcceptLanguage:  "en-US,en;q=0.9",
-			Accept:          "text/html,application/xhtml+xml,application/xml;q=0.9,image/webp,image/apng,*/*;q=0.8",
-			ClientHello:     utls.HelloEdge_106,
-		},
-		{
-			Name:            "Edge 85 (Windows 10)",
-			UserAgent:       "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/85.0.4183.102 Safari/537.36 Edg/85.0.564.51",
-			SecChUa:         `"Chromium";v="85", "Microsoft Edge";v="85", ";Not A Brand";v="99"`,
-			SecChUaPlatform: `"Windows"`,
-			AcceptLanguage:  "en-US,en;q=0.9",
-			Accept:          "text/html,application/xhtml+xml,application/xml;q=0.9,image/webp,image/apng,*/*;q=0.8",
-			ClientHello:     utls.HelloEdge_85,
-		},
-
-		// ========== Safari 系列 ==========
-		{
-			Name:            "Safari 16.0 (macOS)",
-			UserAgent:       "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.0 Safari/605.1.15",
-			SecChUa:         "", // Safari 不使用 Sec-Ch-Ua
-			SecChUaPlatform: "",
-			AcceptLanguage:  "en-US,en;q=0.9",
-			Accept:          "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
-			ClientHello:     utls.HelloSafari_16_0,
-		},
-
-		// ========== iOS Safari 系列 ==========
-		{
-			Name:            "iOS 14 Safari (iPhone)",
-			UserAgent:       "Mozilla/5.0 (iPhone; CPU iPhone OS 14_7_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/14.1.2 Mobile/15E148 Safari/604.1",
-			SecChUa:         "",
-			SecChUaPlatform: "",
-			AcceptLanguage:  "en-US,en;q=0.9",
-			Accept:          "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
-			ClientHello:     utls.HelloIOS_14,
-		},
-		{
-			Name:            "iOS 13 Safari (iPad)",
-			UserAgent:       "Mozilla/5.0 (iPad; CPU OS 13_7 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/13.1.2 Mobile/15E148 Safari/604.1",
-			SecChUa:         "",
-			SecChUaPlatform: "",
-			AcceptLanguage:  "en-US,en;q=0.9",
-			Accept:          "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
-			ClientHello:     utls.HelloIOS_13,
-		},
+	mainLog                     *rotatingLog  // 运行日志文件（用于日志轮转）
+	// 上游域名白名单（每个域名允许的方法见 methods.go）
+	allowedDomains = map[string]*hostPolicy{
+		"kh.google.com":    {},
+		"earth.google.com": {},
+		"www.google.com":   {},
 	}
 
-	rng *rand.Rand // 全局随机数生成器
+	// 启用的浏览器指纹（来自指纹库，见 profiles.go）
+	browserProfiles = catalog.profiles
+
+	rng *lockedRand // 全局随机数生成器（并发安全）
 
 	// 可配置参数（从环境变量读取，带默认值）
 	config struct {
@@ -248,6 +117,57 @@ var (
 		logMaxSize              int           // 日志文件最大大小（MB）
 		logMaxBackups           int           // 保留的旧日志文件数
 		logMaxAge               int           // 日志文件保留天数
+		logRotateDaily          bool          // 是否每天轮转日志
+		logCompress             bool          // 是否 gzip 压缩旧日志
+		accessLogFile           string        // 访问日志文件路径（空 = 不记录）
+		accessLogFormat         string        // 访问日志格式（combined / json）
+		accessLogMaxSize        int           // 访问日志文件最大大小（MB）
+		accessLogMaxBackups     int           // 保留的旧访问日志文件数
+		accessLogMaxAge         int           // 访问日志文件保留天数
+		logLevel                slog.Level    // 日志级别
+		logFormat               string        // 日志格式（text / json）
+		logSuccessSampleRate    float64       // 成功请求日志的采样率
+		adminToken              string        // 管理接口的令牌（空 = 只允许本机访问）
+		maxInFlight             int           // 最大并发处理请求数（0 = 不限制）
+		maxQueueSize            int           // 最大排队请求数
+		maxQueueWait            time.Duration // 最长排队时间
+		shedRetryAfter          int           // 过载拒绝时的 Retry-After（秒）
+		tracingEnabled          bool          // 是否启用链路追踪
+		otlpEndpoint            string        // OTLP/HTTP Traces 接收地址
+		traceSampleRatio        float64       // 无上游 traceparent 时的采样率
+		traceServiceName        string        // service.name
+		resolveOverrides        string        // 上游解析覆盖（host:port:address，逗号分隔）
+		dnsServers              string        // DNS 服务器（逗号分隔，空 = 系统解析）
+		dnsMinTTL               time.Duration // DNS 缓存最短时间
+		dnsMaxTTL               time.Duration // DNS 缓存最长时间
+		dnsNegativeTTL          time.Duration // DNS 解析失败的缓存时间
+		dnsPinEdge              bool          // 每个会话固定首次连接的边缘 IP
+		caFile                  string        // 额外信任的根证书文件
+		mockUpstream            string        // 模拟上游地址（测试用，空 = 连接真实上游）
+		mockCAFile              string        // 模拟上游的 CA 证书
+		forwardProxy            bool          // 是否启用标准正向代理（绝对 URI 请求与 CONNECT）
+		forwardCADir            string        // CONNECT 模式签发证书的 CA 目录（空 = 不支持 CONNECT）
+		allowedMethods          string        // 每个域名允许的请求方法（host=METHOD,METHOD，分号分隔）
+		retryBodyBuffer         int64         // 为重试缓存的请求体上限（字节）
+		passthroughHeaders      string        // 原样转发的调用方请求头（逗号分隔）
+		passthroughPrefix       string        // 去掉前缀后转发的调用方请求头前缀（空 = 不启用）
+		responseMode            string        // 默认响应格式：legacy / mirror
+		batchConcurrency        int           // 每个批量请求的最大并发
+		batchMaxItems           int           // 每个批量请求的最大项数
+		unixSocket              string        // Unix socket 路径（空 = 不监听）
+		unixSocketMode          os.FileMode   // Unix socket 文件权限
+		h2c                     bool          // 是否接受明文 HTTP/2
+		defaultClients          int           // 默认出口（无 IPv6）的客户端数
+		randomSeed              int64         // 随机数种子（0 = 按时间）
+		profileAssignment       string        // 指纹分配策略：hash / random
+		profileSalt             string        // hash 策略的盐
+		profileOverrides        string        // 按地址覆盖指纹（address=profile，分号分隔）
+		profilesFile            string        // 指纹库文件（空 = 内置）
+		profilesGolden          string        // 指纹自检的 golden 文件（空 = 内置）
+		tlsSessionCache         int           // 每个客户端的 TLS 会话缓存大小（0 = 不复用会话）
+		shutdownTimeout         time.Duration // 关闭时等待活跃请求完成的最长时间
+		shutdownReadyDelay      time.Duration // 关闭时标记未就绪后、停止监听前的等待时间
+		stateFile               string        // 关闭时写入状态快照的文件（空 = 不写）
 	}
 )
 
@@ -357,207 +277,442 @@ func loadConfig() {
 		}
 	}
 
-	log.Printf("📝 配置已加载:")
-	log.Printf("  - 最大重试次数: %d", config.maxRetries)
-	log.Printf("  - 基础重试延迟: %v", config.baseRetryDelay)
-	log.Printf("  - 请求超时: %v", config.requestTimeout)
-	log.Printf("  - Session 刷新超时: %v", config.sessionRefreshTimeout)
-	log.Printf("  - 并发刷新范围: %d ~ %d（智能调整）", config.minConcurrentRefresh, config.maxConcurrentRefresh)
-	log.Printf("  - 资源清理间隔: %v", config.resourceCleanInterval)
-	log.Printf("  - Session 不活跃时间: %v", config.sessionInactiveTime)
-	log.Printf("  - 熔断器失败率阈值: %.0f%%", config.circuitBreakerThreshold*100)
-	log.Printf("  - 熔断器最小请求数: %d", config.circuitBreakerWindow)
-	log.Printf("  - 熔断恢复时间: %v", config.circuitRecoveryTime)
-	log.Printf("  - 日志文件: %s", config.logFile)
-	log.Printf("  - 日志最大大小: %d MB", config.logMaxSize)
-	log.Printf("  - 日志保留文件数: %d", config.logMaxBackups)
-	log.Printf("  - 日志保留天数: %d", config.logMaxAge)
-}
+	config.logRotateDaily = false
+	if val := os.Getenv("UTLS_LOG_ROTATE_DAILY"); val != "" {
+		if v, err := strconv.ParseBool(val); err == nil {
+			config.logRotateDaily = v
+		}
+	}
 
-// 初始化日志
-func initLogger() {
-	// 如果配置了日志文件，输出到文件；否则输出到 stdout
-	if config.logFile != "" {
-		// 创建日志目录
-		logDir := filepath.Dir(config.logFile)
-		if err := os.MkdirAll(logDir, 0755); err != nil {
-			// ⚠️  日志目录创建失败，降级到 stdout，但不阻止程序启动
-			log.Printf("⚠️  创建日志目录失败: %v，日志将输出到 stdout", err)
-			log.Printf("⚠️  请手动创建目录: sudo mkdir -p %s", logDir)
-			config.logFile = "" // 标记为 stdout 模式
-			return
+	config.logCompress = true
+	if val := os.Getenv("UTLS_LOG_COMPRESS"); val != "" {
+		if v, err := strconv.ParseBool(val); err == nil {
+			config.logCompress = v
 		}
+	}
 
-		// 打开日志文件（追加模式）
-		logFile, err := os.OpenFile(config.logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-		if err != nil {
-			// ⚠️  日志文件打开失败，降级到 stdout，但不阻止程序启动
-			log.Printf("⚠️  打开日志文件失败: %v，日志将输出到 stdout", err)
-			log.Printf("⚠️  请检查文件权限: sudo chmod 644 %s", config.logFile)
-			config.logFile = "" // 标记为 stdout 模式
-			return
+	config.accessLogFile = "/opt/zeromaps-rpc/logs/utls-access.log"
+	if val := os.Getenv("UTLS_ACCESS_LOG_FILE"); val != "" {
+		config.accessLogFile = val
+		if val == "off" || val == "none" {
+			config.accessLogFile = ""
 		}
+	}
 
-		logFileHandle = logFile // 保存句柄供后续轮转使用
+	config.accessLogFormat = "combined"
+	if val := os.Getenv("UTLS_ACCESS_LOG_FORMAT"); val == "json" || val == "combined" {
+		config.accessLogFormat = val
+	}
 
-		// 设置日志输出到文件
-		log.SetOutput(logFile)
-		log.Printf("📝 日志已配置: %s (最大 %d MB, 保留 %d 个文件, %d 天)",
-			config.logFile, config.logMaxSize, config.logMaxBackups, config.logMaxAge)
-	} else {
-		log.Printf("📝 日志输出到 stdout（建议在生产环境配置 UTLS_LOG_FILE）")
+	config.accessLogMaxSize = 100 // MB
+	if val := os.Getenv("UTLS_ACCESS_LOG_MAX_SIZE_MB"); val != "" {
+		if v, err := strconv.Atoi(val); err == nil && v > 0 {
+			config.accessLogMaxSize = v
+		}
 	}
-}
 
-// 定期检查并轮转日志
-func startLogRotation() {
-	if config.logFile == "" {
-		return // 未配置日志文件，不需要轮转
+	config.accessLogMaxBackups = 5
+	if val := os.Getenv("UTLS_ACCESS_LOG_MAX_BACKUPS"); val != "" {
+		if v, err := strconv.Atoi(val); err == nil && v > 0 {
+			config.accessLogMaxBackups = v
+		}
 	}
 
-	ticker := time.NewTicker(1 * time.Hour) // 每小时检查一次
-	defer ticker.Stop()
+	config.accessLogMaxAge = 7 // 天
+	if val := os.Getenv("UTLS_ACCESS_LOG_MAX_AGE_DAYS"); val != "" {
+		if v, err := strconv.Atoi(val); err == nil && v > 0 {
+			config.accessLogMaxAge = v
+		}
+	}
 
-	log.Printf("📝 日志轮转任务已启动（每 1 小时检查）")
+	config.resolveOverrides = os.Getenv("UTLS_RESOLVE")
+	config.dnsServers = os.Getenv("UTLS_DNS_SERVERS")
+	if config.dnsServers == "" {
+		config.dnsServers = os.Getenv("UTLS_DNS_SERVER") // 兼容单个服务器的写法
+	}
 
-	for range ticker.C {
-		if shutdownFlag.Load() {
-			break
+	config.dnsMinTTL = 5 * time.Second
+	if val := os.Getenv("UTLS_DNS_MIN_TTL"); val != "" {
+		if v, err := strconv.Atoi(val); err == nil && v >= 0 {
+			config.dnsMinTTL = time.Duration(v) * time.Second
 		}
+	}
 
-		rotateLogIfNeeded()
+	config.dnsMaxTTL = time.Hour
+	if val := os.Getenv("UTLS_DNS_MAX_TTL"); val != "" {
+		if v, err := strconv.Atoi(val); err == nil && v > 0 {
+			config.dnsMaxTTL = time.Duration(v) * time.Second
+		}
 	}
-}
 
-// 检查并轮转日志文件
-func rotateLogIfNeeded() {
-	if config.logFile == "" || logFileHandle == nil {
-		return
+	config.dnsNegativeTTL = 5 * time.Second
+	if val := os.Getenv("UTLS_DNS_NEGATIVE_TTL"); val != "" {
+		if v, err := strconv.Atoi(val); err == nil && v >= 0 {
+			config.dnsNegativeTTL = time.Duration(v) * time.Second
+		}
 	}
 
-	// 检查文件大小
-	fileInfo, err := os.Stat(config.logFile)
-	if err != nil {
-		log.Printf("⚠️  无法获取日志文件信息: %v", err)
-		return
+	config.dnsPinEdge = false
+	if val := os.Getenv("UTLS_DNS_PIN_EDGE"); val != "" {
+		if v, err := strconv.ParseBool(val); err == nil {
+			config.dnsPinEdge = v
+		}
 	}
+	config.caFile = os.Getenv("UTLS_CA_FILE")
+	config.mockUpstream = os.Getenv("UTLS_MOCK_UPSTREAM")
+	config.mockCAFile = os.Getenv("UTLS_MOCK_CA_FILE")
 
-	maxBytes := int64(config.logMaxSize) * 1024 * 1024 // MB 转 字节
+	config.allowedMethods = os.Getenv("UTLS_ALLOWED_METHODS")
 
-	if fileInfo.Size() >= maxBytes {
-		log.Printf("📝 日志文件达到 %d MB，开始轮转...", config.logMaxSize)
+	config.retryBodyBuffer = 1024 * 1024 // 1MB
+	if val := os.Getenv("UTLS_RETRY_BODY_BUFFER_KB"); val != "" {
+		if v, err := strconv.Atoi(val); err == nil && v >= 0 {
+			config.retryBodyBuffer = int64(v) * 1024
+		}
+	}
 
-		// 关闭当前文件
-		if logFileHandle != nil {
-			logFileHandle.Close()
+	config.passthroughHeaders = defaultPassthroughHeaders
+	if val := os.Getenv("UTLS_PASSTHROUGH_HEADERS"); val != "" {
+		config.passthroughHeaders = val
+		if val == "none" {
+			config.passthroughHeaders = ""
 		}
+	}
 
-		// 轮转日志文件（重命名为 .1, .2, .3...）
-		for i := config.logMaxBackups - 1; i >= 1; i-- {
-			oldName := fmt.Sprintf("%s.%d", config.logFile, i)
-			newName := fmt.Sprintf("%s.%d", config.logFile, i+1)
+	config.passthroughPrefix = "X-Forward-"
+	if val := os.Getenv("UTLS_PASSTHROUGH_PREFIX"); val != "" {
+		config.passthroughPrefix = val
+		if val == "off" || val == "none" {
+			config.passthroughPrefix = ""
+		}
+	}
 
-			if _, err := os.Stat(oldName); err == nil {
-				os.Rename(oldName, newName)
-			}
+	config.responseMode = responseLegacy
+	if val := os.Getenv("UTLS_RESPONSE_MODE"); validResponseMode(val) {
+		config.responseMode = val
+	}
+
+	config.batchConcurrency = 8
+	if val := os.Getenv("UTLS_BATCH_CONCURRENCY"); val != "" {
+		if v, err := strconv.Atoi(val); err == nil && v > 0 {
+			config.batchConcurrency = v
+		}
+	}
+
+	config.batchMaxItems = 256
+	if val := os.Getenv("UTLS_BATCH_MAX_ITEMS"); val != "" {
+		if v, err := strconv.Atoi(val); err == nil && v > 0 {
+			config.batchMaxItems = v
 		}
+	}
 
-		// 当前日志文件重命名为 .1
-		os.Rename(config.logFile, config.logFile+".1")
+	config.unixSocket = os.Getenv("UTLS_UNIX_SOCKET")
 
-		// 创建新的日志文件
-		newLogFile, err := os.OpenFile(config.logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-		if err != nil {
-			log.Printf("❌ 创建新日志文件失败: %v", err)
-			// 回退到 stdout
-			log.SetOutput(os.Stdout)
-			logFileHandle = nil
-			return
+	config.unixSocketMode = 0660
+	if val := os.Getenv("UTLS_UNIX_SOCKET_MODE"); val != "" {
+		if v, err := strconv.ParseUint(val, 8, 32); err == nil && v <= 0777 {
+			config.unixSocketMode = os.FileMode(v)
+		}
+	}
+
+	config.h2c = true
+	if val := os.Getenv("UTLS_H2C"); val != "" {
+		if v, err := strconv.ParseBool(val); err == nil {
+			config.h2c = v
 		}
+	}
 
-		logFileHandle = newLogFile
-		log.SetOutput(newLogFile)
-		log.Printf("✓ 日志轮转完成")
+	config.defaultClients = 4
+	if val := os.Getenv("UTLS_DEFAULT_CLIENTS"); val != "" {
+		if v, err := strconv.Atoi(val); err == nil && v > 0 {
+			config.defaultClients = v
+		}
+	}
 
-		// 清理超过保留天数的旧日志
-		cleanOldLogs()
+	config.randomSeed = 0
+	if val := os.Getenv("UTLS_RANDOM_SEED"); val != "" {
+		if v, err := strconv.ParseInt(val, 10, 64); err == nil {
+			config.randomSeed = v
+		}
 	}
-}
 
-// 清理超过保留天数的旧日志
-func cleanOldLogs() {
-	if config.logMaxAge <= 0 {
-		return
+	config.profileAssignment = assignHash
+	if val := strings.ToLower(os.Getenv("UTLS_PROFILE_ASSIGNMENT")); val == assignHash || val == assignRandom {
+		config.profileAssignment = val
 	}
 
-	cutoffTime := time.Now().AddDate(0, 0, -config.logMaxAge)
+	config.profileSalt = os.Getenv("UTLS_PROFILE_SALT")
+	config.profileOverrides = os.Getenv("UTLS_PROFILE_OVERRIDES")
+	config.profilesFile = os.Getenv("UTLS_PROFILES_FILE")
+	config.profilesGolden = os.Getenv("UTLS_PROFILES_GOLDEN")
 
-	// 检查所有 .1, .2, .3... 文件
-	for i := 1; i <= config.logMaxBackups+10; i++ {
-		logPath := fmt.Sprintf("%s.%d", config.logFile, i)
+	config.tlsSessionCache = 0
+	if val := os.Getenv("UTLS_TLS_SESSION_CACHE"); val != "" {
+		if v, err := strconv.Atoi(val); err == nil && v >= 0 {
+			config.tlsSessionCache = v
+		}
+	}
 
-		fileInfo, err := os.Stat(logPath)
-		if err != nil {
-			continue // 文件不存在
+	config.shutdownTimeout = 30 * time.Second
+	if val := os.Getenv("UTLS_SHUTDOWN_TIMEOUT"); val != "" {
+		if v, err := strconv.Atoi(val); err == nil && v > 0 {
+			config.shutdownTimeout = time.Duration(v) * time.Second
 		}
+	}
 
-		// 检查文件修改时间
-		if fileInfo.ModTime().Before(cutoffTime) {
-			if err := os.Remove(logPath); err == nil {
-				log.Printf("🗑️  清理过期日志: %s (超过 %d 天)", filepath.Base(logPath), config.logMaxAge)
-			}
+	config.shutdownReadyDelay = 0
+	if val := os.Getenv("UTLS_SHUTDOWN_READY_DELAY_MS"); val != "" {
+		if v, err := strconv.Atoi(val); err == nil && v >= 0 {
+			config.shutdownReadyDelay = time.Duration(v) * time.Millisecond
+		}
+	}
+
+	config.stateFile = "/opt/zeromaps-rpc/logs/utls-proxy-state.json"
+	if val := os.Getenv("UTLS_STATE_FILE"); val != "" {
+		config.stateFile = val
+		if val == "off" || val == "none" {
+			config.stateFile = ""
+		}
+	}
+
+	// 正向代理与监听共用端口且不做认证，需要显式开启
+	config.forwardProxy = false
+	if val := os.Getenv("UTLS_FORWARD_PROXY"); val != "" {
+		if v, err := strconv.ParseBool(val); err == nil {
+			config.forwardProxy = v
+		}
+	}
+
+	// CONNECT 需要显式指定 CA 目录（会在其中生成 CA 私钥）
+	config.forwardCADir = ""
+	if val := os.Getenv("UTLS_FORWARD_CA_DIR"); val != "" && val != "off" && val != "none" {
+		config.forwardCADir = val
+	}
+
+	config.maxInFlight = 512
+	if val := os.Getenv("UTLS_MAX_INFLIGHT"); val != "" {
+		if v, err := strconv.Atoi(val); err == nil && v >= 0 {
+			config.maxInFlight = v
+		}
+	}
+
+	config.maxQueueSize = 1024
+	if val := os.Getenv("UTLS_MAX_QUEUE"); val != "" {
+		if v, err := strconv.Atoi(val); err == nil && v >= 0 {
+			config.maxQueueSize = v
+		}
+	}
+
+	config.maxQueueWait = 10 * time.Second
+	if val := os.Getenv("UTLS_MAX_QUEUE_WAIT_MS"); val != "" {
+		if v, err := strconv.Atoi(val); err == nil && v > 0 {
+			config.maxQueueWait = time.Duration(v) * time.Millisecond
+		}
+	}
+
+	config.shedRetryAfter = 1
+	if val := os.Getenv("UTLS_SHED_RETRY_AFTER"); val != "" {
+		if v, err := strconv.Atoi(val); err == nil && v > 0 {
+			config.shedRetryAfter = v
+		}
+	}
+
+	config.logLevel = slog.LevelInfo
+	if val := os.Getenv("UTLS_LOG_LEVEL"); val != "" {
+		if v, ok := parseLogLevel(val); ok {
+			config.logLevel = v
 		}
 	}
+
+	config.logFormat = "text"
+	if val := os.Getenv("UTLS_LOG_FORMAT"); val == "json" || val == "text" {
+		config.logFormat = val
+	}
+
+	config.logSuccessSampleRate = 1.0
+	if val := os.Getenv("UTLS_LOG_SUCCESS_SAMPLE"); val != "" {
+		if v, err := strconv.ParseFloat(val, 64); err == nil && v >= 0 && v <= 1 {
+			config.logSuccessSampleRate = v
+		}
+	}
+
+	config.adminToken = os.Getenv("UTLS_ADMIN_TOKEN")
+
+	config.tracingEnabled = false
+	if val := os.Getenv("UTLS_TRACING_ENABLED"); val != "" {
+		if v, err := strconv.ParseBool(val); err == nil {
+			config.tracingEnabled = v
+		}
+	}
+
+	config.otlpEndpoint = "http://localhost:4318/v1/traces"
+	if val := os.Getenv("UTLS_OTLP_ENDPOINT"); val != "" {
+		config.otlpEndpoint = val
+	}
+
+	config.traceSampleRatio = 1.0
+	if val := os.Getenv("UTLS_TRACE_SAMPLE_RATIO"); val != "" {
+		if v, err := strconv.ParseFloat(val, 64); err == nil && v >= 0 && v <= 1 {
+			config.traceSampleRatio = v
+		}
+	}
+
+	config.traceServiceName = "utls-proxy"
+	if val := os.Getenv("UTLS_TRACE_SERVICE_NAME"); val != "" {
+		config.traceServiceName = val
+	}
+
 }
 
-// 初始化
-func init() {
-	rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+// 输出已加载的配置
+func logConfig() {
+	slog.Info("配置已加载",
+		"max_retries", config.maxRetries,
+		"base_retry_delay", config.baseRetryDelay.String(),
+		"request_timeout", config.requestTimeout.String(),
+		"session_refresh_timeout", config.sessionRefreshTimeout.String(),
+		"concurrent_refresh_min", config.minConcurrentRefresh,
+		"concurrent_refresh_max", config.maxConcurrentRefresh,
+		"resource_clean_interval", config.resourceCleanInterval.String(),
+		"session_inactive_time", config.sessionInactiveTime.String(),
+		"circuit_threshold", config.circuitBreakerThreshold,
+		"circuit_min_requests", config.circuitBreakerWindow,
+		"circuit_recovery_time", config.circuitRecoveryTime.String(),
+		"log_file", config.logFile,
+		"log_max_size_mb", config.logMaxSize,
+		"log_max_backups", config.logMaxBackups,
+		"log_max_age_days", config.logMaxAge,
+		"log_rotate_daily", config.logRotateDaily,
+		"log_compress", config.logCompress,
+		"access_log_file", config.accessLogFile,
+		"access_log_format", config.accessLogFormat,
+		"log_level", config.logLevel.String(),
+		"log_format", config.logFormat,
+		"log_success_sample_rate", config.logSuccessSampleRate,
+		"admin_token", config.adminToken != "",
+		"max_inflight", config.maxInFlight,
+		"max_queue", config.maxQueueSize,
+		"max_queue_wait", config.maxQueueWait.String(),
+		"tracing_enabled", config.tracingEnabled,
+		"forward_proxy", config.forwardProxy,
+		"forward_ca_dir", config.forwardCADir,
+		"retry_body_buffer_kb", config.retryBodyBuffer/1024,
+		"response_mode", config.responseMode,
+		"batch_concurrency", config.batchConcurrency,
+		"batch_max_items", config.batchMaxItems,
+		"unix_socket", config.unixSocket,
+		"unix_socket_mode", fmt.Sprintf("%#o", config.unixSocketMode),
+		"h2c", config.h2c,
+		"default_clients", config.defaultClients,
+		"random_seed", config.randomSeed,
+		"profile_assignment", config.profileAssignment,
+		"profile_salt_set", config.profileSalt != "",
+		"profiles_file", config.profilesFile,
+		"profiles_golden", config.profilesGolden,
+		"tls_session_cache", config.tlsSessionCache,
+		"shutdown_timeout", config.shutdownTimeout.String(),
+		"shutdown_ready_delay", config.shutdownReadyDelay.String(),
+		"state_file", config.stateFile,
+	)
+}
 
+// 初始化日志
+func initLogger() {
+	setupLogger()
+
+	// 如果配置了日志文件，输出到文件；否则输出到 stdout
+	if config.logFile != "" {
+		logFile, err := openRotatingLog(config.logFile, config.logMaxSize, config.logMaxBackups, config.logMaxAge)
+		if err != nil {
+			// ⚠️  日志文件打开失败，降级到 stdout，但不阻止程序启动
+			slog.Warn("日志文件不可用，日志将输出到 stdout", "file", config.logFile, "error", err)
+			config.logFile = "" // 标记为 stdout 模式
+			return
+		}
+
+		mainLog = logFile // 保存句柄供后续轮转使用
+
+		// 设置日志输出到文件
+		logOutput.swap(logFile)
+		slog.Info("日志已配置", "file", config.logFile, "max_size_mb", config.logMaxSize,
+			"max_backups", config.logMaxBackups, "max_age_days", config.logMaxAge)
+	} else {
+		slog.Info("日志输出到 stdout（建议在生产环境配置 UTLS_LOG_FILE）")
+	}
+}
+
+// 初始化（子命令不需要代理的全局状态，因此不放在 init 中）
+func initProxy() {
 	// 加载配置
 	loadConfig()
 
+	rng = newLockedRand(config.randomSeed)
+
 	// 初始化日志
 	initLogger()
+	logConfig()
+	initAccessLog()
 
-	clientPool = sync.Pool{
-		New: func() interface{} {
-			return createUTLSClient()
-		},
+	if err := initUpstream(); err != nil {
+		slog.Error("上游配置无效", "error", err)
+		os.Exit(1)
+	}
+	if err := initHostPolicies(config.allowedMethods); err != nil {
+		slog.Error("请求方法配置无效", "error", err)
+		os.Exit(1)
+	}
+	initPassthroughHeaders()
+	initForwardProxy()
+	if err := initProfileCatalog(config.profilesFile); err != nil {
+		slog.Error("指纹库无效", "error", err)
+		os.Exit(1)
+	}
+	if err := initProfileGolden(config.profilesGolden); err != nil {
+		slog.Error("指纹 golden 文件无效", "error", err)
+		os.Exit(1)
+	}
+	if err := initProfileOverrides(config.profileOverrides); err != nil {
+		slog.Error("指纹覆盖配置无效", "error", err)
+		os.Exit(1)
 	}
 
 	// 初始化并发刷新控制信号量（初始值为最小值）
 	sessionRefreshSem = make(chan struct{}, config.maxConcurrentRefresh)
 	currentMaxConcurrentRefresh.Store(int32(config.minConcurrentRefresh))
 
-	log.Printf("🎭 uTLS 浏览器指纹库已加载: %d 种配置（基于 uTLS v1.8.1）", len(browserProfiles))
-	for i, profile := range browserProfiles {
-		log.Printf("  [%d] %s", i+1, profile.Name)
+	profileNames := make([]string, 0, len(browserProfiles))
+	for _, profile := range browserProfiles {
+		profileNames = append(profileNames, profile.Name)
 	}
-	log.Printf("🔒 并发刷新控制: 智能调整（%d ~ %d）", config.minConcurrentRefresh, config.maxConcurrentRefresh)
+	slog.Info("uTLS 浏览器指纹库已加载", "source", catalog.source, "count", len(browserProfiles),
+		"disabled", len(catalog.entries)-len(browserProfiles), "utls_version", utlsVersion(), "profiles", profileNames)
+	slog.Info("并发刷新控制: 智能调整", "min", config.minConcurrentRefresh, "max", config.maxConcurrentRefresh)
 }
 
 // 获取或分配 IPv6 的固定浏览器指纹
 func getBrowserProfileForIPv6(ipv6 string) BrowserProfile {
-	// 无 IPv6 时使用默认 key
-	if ipv6 == "" {
-		ipv6 = "default"
-	}
+	// 规范形式的 key（无 IPv6 时为 default），与覆盖和 /profiles/assignments 一致
+	key := addressKey(ipv6)
 
 	// 先查缓存：如果已经分配过，返回固定的指纹
-	if cached, ok := browserProfileMap.Load(ipv6); ok {
+	if cached, ok := browserProfileMap.Load(key); ok {
 		return cached.(BrowserProfile)
 	}
 
-	// 首次使用：随机选择一个浏览器指纹
-	index := rng.Intn(len(browserProfiles))
-	profile := browserProfiles[index]
+	// 首次使用：按覆盖和分配策略选择（见 assignment.go）
+	profile, _ := assignBrowserProfile(key)
+	return pinBrowserProfile(key, profile)
+}
 
-	// 存入缓存，后续该 IPv6 一直使用这个指纹
-	browserProfileMap.Store(ipv6, profile)
+// 为地址固定浏览器指纹，后续该地址一直使用这个指纹；已固定过时返回原有的指纹
+func pinBrowserProfile(ipv6 string, profile BrowserProfile) BrowserProfile {
+	ipv6 = addressKey(ipv6)
 
-	log.Printf("✓ 为 IPv6 %s 分配浏览器指纹: %s",
-		ipv6[:min(20, len(ipv6))], profile.Name)
+	if actual, loaded := browserProfileMap.LoadOrStore(ipv6, profile); loaded {
+		return actual.(BrowserProfile)
+	}
+
+	slog.Debug("分配浏览器指纹", "addr", ipv6, "profile", profile.Name)
 
 	// 统计使用情况
 	count, _ := stats.browserUsage.LoadOrStore(profile.Name, new(atomic.Int64))
@@ -566,55 +721,38 @@ func getBrowserProfileForIPv6(ipv6 string) BrowserProfile {
 	return profile
 }
 
-// 随机选择浏览器指纹（仅用于无 IPv6 的场景）
-func getRandomBrowserProfile() BrowserProfile {
-	index := rng.Intn(len(browserProfiles))
-	profile := browserProfiles[index]
-
-	// 统计使用情况
-	count, _ := stats.browserUsage.LoadOrStore(profile.Name, new(atomic.Int64))
-	count.(*atomic.Int64).Add(1)
-
-	return profile
+// 按名称查找浏览器指纹：忽略大小写、空格和标点（"chrome-133-windows-11" 匹配 "Chrome 133 (Windows 11)"）
+func findBrowserProfile(name string) (BrowserProfile, bool) {
+	key := profileKey(name)
+	for _, profile := range browserProfiles {
+		if profileKey(profile.Name) == key {
+			return profile, true
+		}
+	}
+	return BrowserProfile{}, false
 }
 
-// 创建可复用的 uTLS 客户端（使用随机浏览器指纹）
-func createUTLSClient() *http.Client {
-	profile := getRandomBrowserProfile()
+func profileKey(name string) string {
+	var b strings.Builder
+	for _, c := range strings.ToLower(name) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
 
+// 创建 uTLS 客户端：每个客户端有独立的 HTTP/2 连接池和 TLS 会话缓存，握手使用给定的浏览器指纹
+func newUTLSClient(dialer *upstreamDialer, profile BrowserProfile) *http.Client {
+	sessions := newTLSSessionCache()
 	transport := &http2.Transport{
 		AllowHTTP:         false,
 		MaxHeaderListSize: 262144,
 		ReadIdleTimeout:   60 * time.Second,
 		PingTimeout:       15 * time.Second,
 
-		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
-			dialer := &net.Dialer{
-				Timeout:   10 * time.Second,
-				KeepAlive: 30 * time.Second,
-			}
-
-			rawConn, err := dialer.Dial("tcp", addr)
-			if err != nil {
-				return nil, fmt.Errorf("TCP 连接失败: %w", err)
-			}
-
-			tlsConfig := &utls.Config{
-				ServerName:         getHostFromAddr(addr),
-				InsecureSkipVerify: false,
-				MinVersion:         tls.VersionTLS12,
-				NextProtos:         []string{"h2", "http/1.1"},
-			}
-
-			tlsConn := utls.UClient(rawConn, tlsConfig, profile.ClientHello)
-
-			err = tlsConn.Handshake()
-			if err != nil {
-				rawConn.Close()
-				return nil, fmt.Errorf("TLS 握手失败: %w", err)
-			}
-
-			return tlsConn, nil
+		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return dialUTLS(ctx, dialer, addr, profile.ClientHello, sessions)
 		},
 	}
 
@@ -626,6 +764,8 @@ func createUTLSClient() *http.Client {
 
 // 获取或创建 IPv6 绑定的客户端（带缓存）
 func getOrCreateIPv6Client(ipv6 string) (*http.Client, error) {
+	ipv6 = addressKey(ipv6)
+
 	// 先查缓存
 	if cached, ok := ipv6ClientCache.Load(ipv6); ok {
 		return cached.(*http.Client), nil
@@ -639,7 +779,7 @@ func getOrCreateIPv6Client(ipv6 string) (*http.Client, error) {
 
 	// 存入缓存
 	ipv6ClientCache.Store(ipv6, client)
-	log.Printf("✓ 为 IPv6 %s 创建并缓存新客户端", ipv6[:min(20, len(ipv6))])
+	slog.Debug("创建并缓存新客户端", "addr", ipv6)
 
 	return client, nil
 }
@@ -653,48 +793,86 @@ func createUTLSClientWithIPv6(ipv6 string) (*http.Client, error) {
 
 	// 获取该 IPv6 固定的浏览器指纹
 	profile := getBrowserProfileForIPv6(ipv6)
+	dialer := newUpstreamDialer(&net.TCPAddr{IP: localAddr.IP})
 
-	transport := &http2.Transport{
-		AllowHTTP:         false,
-		MaxHeaderListSize: 262144,
-		ReadIdleTimeout:   60 * time.Second,
-		PingTimeout:       15 * time.Second,
+	return newUTLSClient(dialer, profile), nil
+}
 
-		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
-			dialer := &net.Dialer{
-				Timeout:   10 * time.Second,
-				KeepAlive: 30 * time.Second,
-				LocalAddr: &net.TCPAddr{IP: localAddr.IP},
-			}
+// 上游 uTLS 握手的配置（指纹自检使用同样的配置，见 verify.go）
+func upstreamTLSConfig(serverName string) *utls.Config {
+	return &utls.Config{
+		ServerName:         serverName,
+		RootCAs:            upstreamRootCAs,
+		InsecureSkipVerify: false,
+		MinVersion:         tls.VersionTLS12,
+		NextProtos:         []string{"h2", "http/1.1"},
+	}
+}
 
-			rawConn, err := dialer.Dial("tcp6", addr)
-			if err != nil {
-				return nil, fmt.Errorf("TCP6 连接失败: %w", err)
-			}
+// 建立 TCP 连接并完成 uTLS 握手
+// ctx 携带请求的 httptrace：DNS 阶段由 net 包或内置解析器上报，TCP 阶段由 net 包上报，握手阶段在这里上报
+func dialUTLS(ctx context.Context, dialer *upstreamDialer, addr string, hello utls.ClientHelloID, sessions utls.ClientSessionCache) (net.Conn, error) {
+	_, dialSpan := startSpan(ctx, "tcp.dial", spanKindClient)
+	dialSpan.setAttr("network.transport", dialer.network)
+	dialSpan.setAttr("server.address", addr)
+	if dialer.dialer.LocalAddr != nil {
+		dialSpan.setAttr("utls.ipv6", dialer.dialer.LocalAddr.String())
+	}
 
-			tlsConfig := &utls.Config{
-				ServerName:         getHostFromAddr(addr),
-				InsecureSkipVerify: false,
-				MinVersion:         tls.VersionTLS12,
-				NextProtos:         []string{"h2", "http/1.1"},
-			}
+	rawConn, err := dialer.dial(ctx, addr)
+	if err != nil {
+		dialSpan.setError(errorClass(err), err)
+		dialSpan.End()
+		return nil, fmt.Errorf("%s 连接失败: %w", strings.ToUpper(dialer.network), err)
+	}
+	dialSpan.End()
 
-			tlsConn := utls.UClient(rawConn, tlsConfig, profile.ClientHello)
+	tlsConfig := upstreamTLSConfig(getHostFromAddr(addr))
+	tlsConn, err := newUConn(rawConn, tlsConfig, hello, sessions)
+	if err != nil {
+		rawConn.Close()
+		return nil, &tlsHandshakeError{err: err}
+	}
 
-			err = tlsConn.Handshake()
-			if err != nil {
-				rawConn.Close()
-				return nil, fmt.Errorf("TLS 握手失败: %w", err)
-			}
+	_, handshakeSpan := startSpan(ctx, "tls.handshake", spanKindClient)
+	handshakeSpan.setAttr("server.address", tlsConfig.ServerName)
+	handshakeSpan.setAttr("tls.client_hello", hello.Str())
 
-			return tlsConn, nil
-		},
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.TLSHandshakeStart != nil {
+		trace.TLSHandshakeStart()
 	}
 
-	return &http.Client{
-		Timeout:   config.requestTimeout,
-		Transport: transport,
-	}, nil
+	err = tlsConn.HandshakeContext(ctx)
+
+	if err != nil {
+		handshakeSpan.setError(codeTLSHandshake, err)
+	} else {
+		state := tlsConn.ConnectionState()
+		handshakeSpan.setAttr("tls.protocol.negotiated", state.NegotiatedProtocol)
+		handshakeSpan.setAttr("tls.resumed", state.DidResume)
+		recordHandshake(state.DidResume)
+	}
+	handshakeSpan.End()
+
+	if trace != nil && trace.TLSHandshakeDone != nil {
+		state := tlsConn.ConnectionState()
+		trace.TLSHandshakeDone(tls.ConnectionState{
+			Version:            state.Version,
+			HandshakeComplete:  state.HandshakeComplete,
+			DidResume:          state.DidResume,
+			CipherSuite:        state.CipherSuite,
+			NegotiatedProtocol: state.NegotiatedProtocol,
+			ServerName:         state.ServerName,
+		}, err)
+	}
+
+	if err != nil {
+		rawConn.Close()
+		return nil, &tlsHandshakeError{err: err}
+	}
+
+	return tlsConn, nil
 }
 
 // min 辅助函数
@@ -752,10 +930,8 @@ func calculateOptimalConcurrency() int32 {
 
 // 获取或创建指定 IPv6 的 Session
 func getOrCreateSession(ipv6 string) *CookieSession {
-	// 无 IPv6 时使用默认 Session（key = ""）
-	if ipv6 == "" {
-		ipv6 = "default"
-	}
+	// 无 IPv6 时使用默认 Session（key = defaultAddressKey）
+	ipv6 = addressKey(ipv6)
 
 	// 先查缓存
 	if cached, ok := sessionManager.Load(ipv6); ok {
@@ -767,16 +943,14 @@ func getOrCreateSession(ipv6 string) *CookieSession {
 		lastAccess: time.Now(),
 	}
 	sessionManager.Store(ipv6, session)
-	log.Printf("✓ 为 IPv6 %s 创建新 Session", ipv6[:min(20, len(ipv6))])
+	slog.Debug("创建新 Session", "addr", ipv6)
 
 	return session
 }
 
 // 获取或创建 IPv6 的健康状态
 func getOrCreateIPv6Health(ipv6 string) *IPv6Health {
-	if ipv6 == "" {
-		ipv6 = "default"
-	}
+	ipv6 = addressKey(ipv6)
 
 	if cached, ok := ipv6HealthMap.Load(ipv6); ok {
 		return cached.(*IPv6Health)
@@ -801,19 +975,22 @@ func isCircuitOpen(ipv6 string) bool {
 	openAt := health.circuitOpenAt
 	health.mu.RUnlock()
 
-	if time.Since(openAt) > config.circuitRecoveryTime {
-		log.Printf("🔄 [%s] 熔断器尝试恢复（已熔断 %v）", ipv6[:min(20, len(ipv6))], config.circuitRecoveryTime)
+	if time.Since(openAt) <= config.circuitRecoveryTime {
+		return true
+	}
+
+	// 并发请求中只有一个负责恢复
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	if health.circuitOpen.Load() && time.Since(health.circuitOpenAt) > config.circuitRecoveryTime {
+		slog.Info("熔断器尝试恢复", "addr", logAddr(ipv6), "open_for", config.circuitRecoveryTime.String())
 
 		// 重置计数器，给 IPv6 一个全新的机会
 		health.totalRequests.Store(0)
 		health.failedRequests.Store(0)
 		health.circuitOpen.Store(false)
-
-		log.Printf("✓ [%s] 熔断器已重置计数器，开始重新评估", ipv6[:min(20, len(ipv6))])
-		return false
 	}
-
-	return true
+	return false
 }
 
 // 记录请求结果并检查是否需要熔断
@@ -838,13 +1015,20 @@ func recordRequestResult(ipv6 string, success bool) {
 
 	// 使用配置的失败率阈值
 	if failureRate > config.circuitBreakerThreshold && !health.circuitOpen.Load() {
-		health.circuitOpen.Store(true)
+		// 先写打开时间再打开熔断器，读到打开状态时打开时间一定有效；并发请求中只有一个负责打开
 		health.mu.Lock()
-		health.circuitOpenAt = time.Now()
+		opened := !health.circuitOpen.Load()
+		if opened {
+			health.circuitOpenAt = time.Now()
+			health.circuitOpen.Store(true)
+		}
 		health.mu.Unlock()
+		if !opened {
+			return
+		}
 
-		log.Printf("⚠️  [%s] 触发熔断！失败率: %.2f%% (%d/%d)，暂停使用 %v",
-			ipv6[:min(20, len(ipv6))], failureRate*100, failed, total, config.circuitRecoveryTime)
+		slog.Warn("触发熔断", "addr", logAddr(ipv6), "failure_rate", failureRate,
+			"failed", failed, "total", total, "pause", config.circuitRecoveryTime.String())
 	}
 }
 
@@ -885,22 +1069,37 @@ func cleanExpiredCookies(session *CookieSession) {
 		if cookie.Expires.IsZero() || cookie.Expires.After(now) {
 			validCookies = append(validCookies, cookie)
 		} else {
-			log.Printf("🗑️  清理过期 Cookie: %s (过期时间: %s)",
-				cookie.Name, cookie.Expires.Format(time.RFC3339))
+			slog.Debug("清理过期 Cookie", "cookie", cookie.Name, "expires", cookie.Expires.Format(time.RFC3339))
 		}
 	}
 
 	if len(validCookies) < len(session.cookies) {
-		log.Printf("✓ Cookie 清理完成：%d 个有效，%d 个已过期",
-			len(validCookies), len(session.cookies)-len(validCookies))
+		slog.Debug("Cookie 清理完成", "valid", len(validCookies), "expired", len(session.cookies)-len(validCookies))
 		session.cookies = validCookies
 	}
 }
 
 // 初始化或刷新指定 IPv6 的会话（访问 earth.google.com 获取 Cookie）
-func refreshSession(ipv6 string, force bool) error {
+func refreshSession(ctx context.Context, ipv6 string, force bool) (err error) {
+	ctx, span := startSpan(ctx, "session.refresh", spanKindInternal)
+	span.setAttr("utls.ipv6", ipv6)
+	span.setAttr("utls.force", force)
+	defer func() {
+		if err != nil {
+			span.setError("session_refresh", err)
+		}
+		span.End()
+	}()
+
 	// 获取或创建该 IPv6 的 Session
 	session := getOrCreateSession(ipv6)
+	defer func() {
+		if err != nil {
+			session.refreshFails.Add(1)
+		} else {
+			session.refreshFails.Store(0)
+		}
+	}()
 
 	// 先清理过期的 Cookie
 	cleanExpiredCookies(session)
@@ -912,20 +1111,19 @@ func refreshSession(ipv6 string, force bool) error {
 		session.mu.RUnlock()
 
 		if remaining > 0 {
-			log.Printf("✓ [%s] Cookie 仍然有效（剩余 %.0f 秒）",
-				ipv6[:min(20, len(ipv6))], remaining)
+			slog.Debug("Cookie 仍然有效", "addr", logAddr(ipv6), "remaining_s", int(remaining))
 			return nil
 		}
 	}
 
 	// 使用 CAS 操作防止同一 Session 并发刷新
 	if !session.refreshing.CompareAndSwap(false, true) {
-		log.Printf("⏳ [%s] 其他 goroutine 正在刷新会话，等待...", ipv6[:min(20, len(ipv6))])
+		slog.Debug("其他 goroutine 正在刷新会话，等待", "addr", logAddr(ipv6))
 		// 等待其他 goroutine 完成刷新
 		for session.refreshing.Load() {
 			time.Sleep(100 * time.Millisecond)
 		}
-		log.Printf("✓ [%s] 会话刷新完成，使用新 Cookie", ipv6[:min(20, len(ipv6))])
+		slog.Debug("会话刷新完成，使用新 Cookie", "addr", logAddr(ipv6))
 		return nil
 	}
 	defer session.refreshing.Store(false)
@@ -946,37 +1144,29 @@ func refreshSession(ipv6 string, force bool) error {
 	sessionRefreshSem <- struct{}{}
 	defer func() { <-sessionRefreshSem }()
 
-	log.Printf("🔄 [%s] 刷新会话：访问 earth.google.com... (槽位: %d/%d)",
-		ipv6[:min(20, len(ipv6))], len(sessionRefreshSem), currentConcurrency)
+	slog.Debug("刷新会话：访问 earth.google.com", "addr", logAddr(ipv6),
+		"slots_used", len(sessionRefreshSem), "slots_max", currentConcurrency)
 
 	// 使用该 IPv6 固定的浏览器指纹
 	profile := getBrowserProfileForIPv6(ipv6)
-	log.Printf("🎭 使用浏览器指纹: %s", profile.Name)
+	span.setAttr("utls.profile", profile.Name)
 
 	var client *http.Client
-	var err error
-	var shouldReturn bool
 
 	if ipv6 != "" {
 		// 使用缓存获取 IPv6 客户端
 		client, err = getOrCreateIPv6Client(ipv6)
 		if err != nil {
-			log.Printf("⚠️  获取 IPv6 客户端失败，使用默认客户端: %v", err)
-			client = clientPool.Get().(*http.Client)
-			shouldReturn = true
-		} else {
-			shouldReturn = false
+			slog.Warn("获取 IPv6 客户端失败，使用默认客户端", "addr", ipv6, "error", err)
 		}
-	} else {
-		client = clientPool.Get().(*http.Client)
-		shouldReturn = true
 	}
-
-	if shouldReturn {
-		defer clientPool.Put(client)
+	if client == nil {
+		var release func()
+		client, _, release = defaultClients.acquire()
+		defer release()
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), config.sessionRefreshTimeout)
+	ctx, cancel := context.WithTimeout(ctx, config.sessionRefreshTimeout)
 	defer cancel()
 
 	req, err := http.NewRequestWithContext(ctx, "GET", "https://earth.google.com/web/", nil)
@@ -1017,7 +1207,7 @@ func refreshSession(ipv6 string, force bool) error {
 	}
 
 	if !hasNID && !has1PJAR {
-		log.Printf("⚠️  警告：未获取到关键 Cookie (NID 或 1P_JAR)，但有 %d 个其他 Cookie", len(cookies))
+		slog.Warn("未获取到关键 Cookie (NID 或 1P_JAR)", "addr", logAddr(ipv6), "cookies", len(cookies))
 		// 不返回错误，只记录警告（因为可能有其他有效的 Cookie）
 	}
 
@@ -1052,24 +1242,27 @@ func refreshSession(ipv6 string, force bool) error {
 
 	stats.sessionRefreshCount.Add(1)
 
-	log.Printf("✓ [%s] 会话已刷新，获得 %d 个 Cookie", ipv6[:min(20, len(ipv6))], len(cookies))
-	for _, cookie := range cookies {
-		expiryInfo := "Session"
-		if !cookie.Expires.IsZero() {
-			expiryInfo = fmt.Sprintf("过期: %s", cookie.Expires.Format("15:04:05"))
-		}
+	slog.Info("会话已刷新", "addr", logAddr(ipv6), "profile", profile.Name, "cookies", len(cookies),
+		"earliest_expiry", earliestExpiry.Format(time.RFC3339))
 
-		// 显示 Cookie 的 Domain，确认可以跨域使用
-		domainInfo := cookie.Domain
-		if domainInfo == "" {
-			domainInfo = "earth.google.com" // 默认域
-		}
+	// Cookie 明细只在 debug 级别输出，且只记录名称，不记录值
+	if slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		for _, cookie := range cookies {
+			expiryInfo := "session"
+			if !cookie.Expires.IsZero() {
+				expiryInfo = cookie.Expires.Format(time.RFC3339)
+			}
 
-		log.Printf("  - %s=%s... (Domain: %s, %s)",
-			cookie.Name, safeSubstring(cookie.Value, 20), domainInfo, expiryInfo)
+			// 显示 Cookie 的 Domain，确认可以跨域使用
+			domainInfo := cookie.Domain
+			if domainInfo == "" {
+				domainInfo = "earth.google.com" // 默认域
+			}
+
+			slog.Debug("会话 Cookie", "addr", logAddr(ipv6), "cookie", cookie.Name,
+				"domain", domainInfo, "expires", expiryInfo)
+		}
 	}
-	log.Printf("  ⏰ 最早过期时间: %s（%d 秒后）",
-		earliestExpiry.Format("15:04:05"), int(time.Until(earliestExpiry).Seconds()))
 
 	return nil
 }
@@ -1132,18 +1325,35 @@ func isAllowedURL(targetURL string) error {
 		return fmt.Errorf("只允许 HTTPS 协议")
 	}
 
-	if !allowedDomains[parsedURL.Host] {
+	if allowedDomains[parsedURL.Host] == nil {
 		return fmt.Errorf("域名不在白名单中: %s", parsedURL.Host)
 	}
 
 	return nil
 }
 
-// HTTP 代理处理器
+// HTTP 代理处理器（GET /proxy?url=<URL>&ipv6=<IPv6>）
 func proxyHandler(w http.ResponseWriter, r *http.Request) {
-	// 检查是否正在关闭
-	if shutdownFlag.Load() {
-		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+	serveProxy(w, r, proxyTarget{
+		url:  r.URL.Query().Get("url"),
+		ipv6: r.URL.Query().Get("ipv6"),
+	})
+}
+
+// 一次代理请求的目标与提示：来自 /proxy 的查询参数，或正向代理的请求行和请求头
+type proxyTarget struct {
+	url     string // 上游 URL
+	ipv6    string // 出口 IPv6（空 = 默认出口）
+	profile string // 浏览器指纹提示（只在该地址首次分配指纹时生效）
+	forward bool   // 正向代理模式（响应固定为 mirror 格式）
+	batch   bool   // 批量请求中的一项
+}
+
+// 代理请求的处理流程（白名单、熔断器、并发控制、会话、重试），/proxy 与正向代理共用
+func serveProxy(w http.ResponseWriter, r *http.Request, target proxyTarget) {
+	// 检查是否正在关闭（已接受的批量请求照常处理）
+	if shutdownFlag.Load() && !target.batch {
+		writeError(w, errorResponse{Code: codeShuttingDown, Message: "Server is shutting down", Status: http.StatusServiceUnavailable})
 		return
 	}
 
@@ -1153,18 +1363,49 @@ func proxyHandler(w http.ResponseWriter, r *http.Request) {
 	startTime := time.Now()
 	stats.totalRequests.Add(1)
 
-	targetURL := r.URL.Query().Get("url")
-	ipv6 := r.URL.Query().Get("ipv6")
+	// 记录各阶段耗时，写响应头时附加 Server-Timing
+	timing := newRequestTiming()
+	defer timing.observe()
+	tw := &timingResponseWriter{ResponseWriter: w, timing: timing}
+	w = tw
+
+	// 链路追踪：沿用调用方的 traceparent，请求结束时记录返回给调用方的状态码
+	_, rootSpan := startServerSpan(r, "proxy")
+	defer func() {
+		rootSpan.setAttr("http.response.status_code", tw.status)
+		if tw.status >= 400 {
+			rootSpan.setError(strconv.Itoa(tw.status), nil)
+		}
+		rootSpan.End()
+	}()
+
+	targetURL := target.url
+	ipv6 := target.ipv6
+
+	// 请求 ID：贯穿日志与响应头
+	reqID := requestID(r)
+	w.Header().Set("X-Request-Id", reqID)
+	rootSpan.setAttr("utls.request_id", reqID)
+	reqLog := slog.With("request_id", reqID, "addr", logAddr(ipv6))
+
+	// 访问日志：请求结束时写一行
+	access := newAccessRecord(r, reqID)
+	access.Addr = logAddr(ipv6)
+	if target.batch {
+		// 批量请求的各项记录目标 URL（内部请求的 URI 都是 /batch）
+		access.URI = targetURL
+	}
+	defer func() { access.finish(tw) }()
 
 	if targetURL == "" {
-		http.Error(w, "Missing 'url' parameter", http.StatusBadRequest)
+		writeProxyError(w, access, codeInvalidRequest, "Missing 'url' parameter", http.StatusBadRequest)
 		return
 	}
 
 	// 验证 URL
 	if err := isAllowedURL(targetURL); err != nil {
-		log.Printf("❌ URL 验证失败: %v", err)
-		http.Error(w, "Invalid URL", http.StatusBadRequest)
+		reqLog.Warn("URL 验证失败", "error", err)
+		writeProxyError(w, access, codeNotAllowed, "Invalid URL", http.StatusBadRequest)
 		stats.failedRequests.Add(1)
 		return
 	}
@@ -1172,135 +1413,293 @@ func proxyHandler(w http.ResponseWriter, r *http.Request) {
 	// 验证 IPv6 地址
 	if ipv6 != "" {
 		if _, err := net.ResolveIPAddr("ip6", ipv6); err != nil {
-			log.Printf("❌ 无效的 IPv6 地址: %s", ipv6)
-			http.Error(w, "Invalid IPv6 address", http.StatusBadRequest)
+			reqLog.Warn("无效的 IPv6 地址")
+			writeProxyError(w, access, codeInvalidRequest, "Invalid IPv6 address", http.StatusBadRequest)
 			stats.failedRequests.Add(1)
 			return
 		}
+		// 同一地址的不同写法（2001:DB8::0001 / 2001:db8::1）共用指纹、客户端、会话和熔断状态
+		ipv6 = addressKey(ipv6)
 
 		// 检查熔断器状态
 		if isCircuitOpen(ipv6) {
-			log.Printf("⛔ [%s] 熔断器已打开，拒绝请求", ipv6[:min(20, len(ipv6))])
-			http.Error(w, "IPv6 circuit breaker open", http.StatusServiceUnavailable)
+			reqLog.Warn("熔断器已打开，拒绝请求")
+			writeProxyError(w, access, codeBreakerOpen, "IPv6 circuit breaker open", http.StatusServiceUnavailable)
 			stats.failedRequests.Add(1)
 			return
 		}
 	}
 
-	// 使用该 IPv6 固定的浏览器指纹
-	profile := getBrowserProfileForIPv6(ipv6)
+	// 指纹提示：只影响该地址首次分配的指纹，已固定的指纹保持不变
+	if target.profile != "" {
+		hinted, ok := findBrowserProfile(target.profile)
+		if !ok {
+			reqLog.Warn("未知的浏览器指纹", "profile", target.profile)
+			writeProxyError(w, access, codeInvalidRequest, "Unknown browser profile", http.StatusBadRequest)
+			stats.failedRequests.Add(1)
+			return
+		}
+		if ipv6 != "" {
+			if pinned := pinBrowserProfile(ipv6, hinted); pinned.Name != hinted.Name {
+				reqLog.Debug("该地址已固定其他指纹，忽略提示", "hint", hinted.Name, "profile", pinned.Name)
+			}
+		}
+	}
 
-	// 获取客户端（优先从缓存获取）
+	// 并发控制：超过上限时按优先级排队，队列满或排队超时则快速拒绝
+	parsedURL, _ := url.Parse(targetURL)
+	reqLog = reqLog.With("host", parsedURL.Host)
+	access.TargetHost = parsedURL.Host
+	access.TargetPath = parsedURL.Path
+	// 请求方法按域名限制
+	if !methodAllowed(parsedURL.Host, r.Method) {
+		reqLog.Warn("请求方法不允许", "method", r.Method)
+		w.Header().Set("Allow", allowedMethodList(parsedURL.Host))
+		writeProxyError(w, access, codeNotAllowed, "Method not allowed", http.StatusMethodNotAllowed)
+		stats.failedRequests.Add(1)
+		return
+	}
+
+	priority := requestPriority(r, parsedURL.Path)
+	wait, err := admission.acquire(r.Context(), priority)
+	timing.add(phaseQueue, wait)
+	if err != nil {
+		reqLog.Warn("过载拒绝", "priority", priority.String(), "queue_ms", wait.Milliseconds(), "error", err)
+		if errors.Is(err, context.Canceled) {
+			writeProxyError(w, access, codeClientCancelled, "Client cancelled", statusClientClosedRequest)
+			return
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(config.shedRetryAfter))
+		writeProxyError(w, access, codeOverloaded, "Server overloaded: "+err.Error(), http.StatusServiceUnavailable)
+		stats.failedRequests.Add(1)
+		return
+	}
+	defer admission.release()
+
+	// 获取客户端（优先从缓存获取）和它使用的浏览器指纹
 	var client *http.Client
+	var profile BrowserProfile
 
 	if ipv6 != "" {
-		// 有 IPv6：从缓存获取或创建（会自动缓存）
+		// 有 IPv6：使用该 IPv6 固定的浏览器指纹，从缓存获取或创建客户端（会自动缓存）
+		profile = getBrowserProfileForIPv6(ipv6)
+		access.Profile = profile.Name
 		var err error
 		client, err = getOrCreateIPv6Client(ipv6)
 		if err != nil {
-			log.Printf("❌ 获取 IPv6 客户端失败: %v", err)
-			http.Error(w, "IPv6 client creation failed", http.StatusInternalServerError)
+			reqLog.Error("获取 IPv6 客户端失败", "error", err)
+			writeProxyError(w, access, codeAddressUnavailable, "IPv6 client creation failed", http.StatusInternalServerError)
 			stats.failedRequests.Add(1)
 			return
 		}
 	} else {
-		// 无 IPv6：使用通用连接池
-		client = clientPool.Get().(*http.Client)
-		defer clientPool.Put(client)
+		// 无 IPv6：使用默认客户端，指纹以取到的客户端为准（默认会话的指纹可能同时被重置）
+		var release func()
+		client, profile, release = defaultClients.acquire()
+		defer release()
 	}
 
+	reqLog = reqLog.With("profile", profile.Name)
+	access.Profile = profile.Name
+
+	rootSpan.setAttr("http.request.method", r.Method)
+	rootSpan.setAttr("server.address", parsedURL.Host)
+	rootSpan.setAttr("url.path", parsedURL.Path)
+	rootSpan.setAttr("utls.ipv6", ipv6)
+	rootSpan.setAttr("utls.profile", profile.Name)
+	rootSpan.setAttr("utls.priority", priority.String())
+	rootSpan.setAttr("utls.forward", target.forward)
+
+	// 请求根 Span 挂到独立的 context 上（上游请求不随调用方断开而取消）
+	spanCtx := contextWithSpan(context.Background(), rootSpan)
+
 	// 刷新会话（针对 kh.google.com）
-	parsedURL, _ := url.Parse(targetURL)
 	needsSession := parsedURL.Host == "kh.google.com"
 
 	if needsSession {
 		// 尝试刷新会话（内部会检查是否真的需要刷新）
 		// 如果失败，使用旧 Cookie 继续（不重试，避免延迟）
-		if err := refreshSession(ipv6, false); err != nil {
+		var err error
+		timing.measure(phaseSession, func() { err = refreshSession(spanCtx, ipv6, false) })
+		if err != nil {
 			// 只记录一次，不重试，使用旧 Cookie
-			log.Printf("⚠️  会话刷新失败，使用旧 Cookie: %v", err)
+			reqLog.Warn("会话刷新失败，使用旧 Cookie", "error", err)
 		}
 	}
 
 	// 创建请求（使用配置的超时，并留出重试时间）
 	requestContextTimeout := config.requestTimeout + time.Duration(config.maxRetries)*config.baseRetryDelay*8
-	ctx, cancel := context.WithTimeout(context.Background(), requestContextTimeout)
+	ctx, cancel := context.WithTimeout(spanCtx, requestContextTimeout)
 	defer cancel()
 
-	req, err := http.NewRequestWithContext(ctx, "GET", targetURL, nil)
+	// 重试次数：非幂等方法只在调用方明确允许时重试，请求体无法重放时不重试
+	maxRetries := config.maxRetries
+	retryable := isIdempotent(r.Method) || retryOptIn(r)
+	if !retryable {
+		maxRetries = 0
+	}
+
+	callerBody, err := readRequestBody(r, maxRetries > 0)
 	if err != nil {
-		log.Printf("❌ 创建请求失败: %v", err)
-		http.Error(w, "Request creation failed", http.StatusInternalServerError)
+		reqLog.Warn("读取请求体失败", "error", err)
+		if r.Context().Err() != nil {
+			writeProxyError(w, access, codeClientCancelled, "Client cancelled", statusClientClosedRequest)
+			return
+		}
+		writeProxyError(w, access, codeInvalidRequest, "Failed to read request body", http.StatusBadRequest)
 		stats.failedRequests.Add(1)
 		return
 	}
+	if !callerBody.replayable() && maxRetries > 0 {
+		reqLog.Debug("请求体超过缓存上限，不重试", "limit_bytes", config.retryBodyBuffer)
+		maxRetries = 0
+	}
+	if callerBody != nil {
+		rootSpan.setAttr("http.request.body.size", callerBody.size)
+	}
 
-	// 使用随机浏览器指纹设置 Headers
-	setHeaders(req, profile, false)
-
-	// 关键：必须有 Referer 和 Origin
-	if !strings.Contains(targetURL, "www.google.com") {
-		req.Header.Set("Referer", "https://earth.google.com/")
-		req.Header.Set("Origin", "https://earth.google.com")
+	// 调用方请求头透传（白名单），实际转发的请求头通过 X-Applied-Headers 返回
+	passthrough, blocked := callerHeaders(r)
+	if len(passthrough) > 0 {
+		w.Header().Set("X-Applied-Headers", strings.Join(headerNames(passthrough), ", "))
+	}
+	if len(blocked) > 0 {
+		reqLog.Debug("请求头与浏览器指纹或会话冲突，未转发", "headers", blocked)
 	}
 
-	// 获取该 IPv6 的 Session 并添加 Cookie
+	// 获取该 IPv6 的 Session
 	session := getOrCreateSession(ipv6)
 
 	// 更新最后访问时间
 	session.mu.Lock()
 	session.lastAccess = time.Now()
-	cookies := session.cookies
 	session.mu.Unlock()
 
-	for _, cookie := range cookies {
-		req.AddCookie(cookie)
+	// 每次尝试都重新创建请求（带上最新的 Cookie）
+	newUpstreamRequest := func(ctx context.Context) (*http.Request, error) {
+		var reqBody io.Reader
+		if callerBody != nil {
+			reqBody = callerBody.reader()
+		}
+		req, err := http.NewRequestWithContext(ctx, r.Method, targetURL, reqBody)
+		if err != nil {
+			return nil, err
+		}
+
+		// 使用该 IPv6 固定的浏览器指纹设置 Headers
+		setHeaders(req, profile, false)
+
+		if callerBody != nil {
+			req.ContentLength = callerBody.size
+			if callerBody.contentType != "" {
+				req.Header.Set("Content-Type", callerBody.contentType)
+			}
+		}
+
+		// 关键：必须有 Referer 和 Origin
+		if !strings.Contains(targetURL, "www.google.com") {
+			req.Header.Set("Referer", "https://earth.google.com/")
+			req.Header.Set("Origin", "https://earth.google.com")
+		}
+
+		session.mu.RLock()
+		for _, cookie := range session.cookies {
+			req.AddCookie(cookie)
+		}
+		session.mu.RUnlock()
+
+		for name, values := range passthrough {
+			req.Header[name] = append([]string(nil), values...)
+		}
+
+		return req, nil
 	}
 
 	// 发送请求（支持多种错误的自动重试和指数退避）
 	var resp *http.Response
-	maxRetries := config.maxRetries
 	baseDelay := config.baseRetryDelay
 	hasRefreshedCookie := false // 标记是否已经刷新过 Cookie（403 时）
+	attempts := 0
+
+	// 重试用尽后仍是错误状态码：mirror 模式原样返回上游最后一次的响应（返回 true，跳出循环照常读取响应体），
+	// legacy 模式返回 JSON 错误。传输层失败（无上游响应）两种模式都返回 JSON 错误
+	mode := responseMode(r, target)
+	upstreamFailed := false
+	failUpstream := func(message string, status int) bool {
+		if mode == responseMirror {
+			upstreamFailed = true
+			access.Error = statusErrorCode(resp.StatusCode)
+			return true
+		}
+		resp.Body.Close()
+		writeProxyError(w, access, statusErrorCode(resp.StatusCode), message, status)
+		stats.failedRequests.Add(1)
+		recordRequestResult(ipv6, false) // 记录失败到熔断器
+		return false
+	}
 
 	for attempt := 0; attempt <= maxRetries; attempt++ {
+		// 调用方已断开时不再重试
+		if attempt > 0 && r.Context().Err() != nil {
+			reqLog.Debug("调用方已断开，停止重试", "attempt", attempt+1)
+			writeProxyError(w, access, codeClientCancelled, "Client cancelled", statusClientClosedRequest)
+			return
+		}
+
+		attempts = attempt + 1
+		access.Attempts = attempts
+		attemptCtx, attemptSpan := startSpan(ctx, "upstream.attempt", spanKindClient)
+		attemptSpan.setAttr("utls.attempt", attempt+1)
+		attemptSpan.setAttr("server.address", parsedURL.Host)
+		attemptSpan.setAttr("utls.ipv6", ipv6)
+		attemptSpan.setAttr("utls.profile", profile.Name)
+
+		req, err := newUpstreamRequest(timing.withTrace(attemptCtx))
+		if err != nil {
+			attemptSpan.setError(codeInvalidRequest, err)
+			attemptSpan.End()
+			reqLog.Error("创建请求失败", "error", err)
+			writeProxyError(w, access, codeInvalidRequest, "Request creation failed", http.StatusInternalServerError)
+			stats.failedRequests.Add(1)
+			return
+		}
+
 		resp, err = client.Do(req)
+		if err != nil {
+			attemptSpan.setError(errorClass(err), err)
+		} else {
+			attemptSpan.setAttr("http.response.status_code", resp.StatusCode)
+			if resp.StatusCode >= 400 {
+				attemptSpan.setError(strconv.Itoa(resp.StatusCode), nil)
+			}
+		}
+		attemptSpan.End()
 
 		// 网络错误处理
 		if err != nil {
-			// 检查是否超时
-			if strings.Contains(err.Error(), "timeout") ||
-				strings.Contains(err.Error(), "deadline exceeded") {
+			class := errorClass(err)
+			switch class {
+			case codeDNS:
+				stats.dnsErrorCount.Add(1)
+				reqLog.Warn("DNS 解析失败", "attempt", attempt+1, "max_attempts", maxRetries+1, "error", err)
+			case codeUpstreamTimeout:
 				stats.timeoutCount.Add(1)
-				log.Printf("⏱️  请求超时 (尝试 %d/%d): %v", attempt+1, maxRetries+1, err)
-			} else {
+				reqLog.Warn("请求超时", "attempt", attempt+1, "max_attempts", maxRetries+1, "error", err)
+			default:
 				stats.networkErrorCount.Add(1)
-				log.Printf("❌ 网络错误 (尝试 %d/%d): %v", attempt+1, maxRetries+1, err)
+				reqLog.Warn("网络错误", "class", class, "attempt", attempt+1, "max_attempts", maxRetries+1, "error", err)
 			}
 
 			// 如果还有重试机会，等待后重试
 			if attempt < maxRetries {
 				delay := baseDelay * time.Duration(1<<uint(attempt)) // 指数退避: 100ms, 200ms, 400ms
-				log.Printf("⏳ 等待 %v 后重试...", delay)
-				time.Sleep(delay)
-
-				// 重新创建请求
-				req, _ = http.NewRequestWithContext(ctx, "GET", targetURL, nil)
-				setHeaders(req, profile, false)
-				if !strings.Contains(targetURL, "www.google.com") {
-					req.Header.Set("Referer", "https://earth.google.com/")
-					req.Header.Set("Origin", "https://earth.google.com")
-				}
-				session.mu.RLock()
-				for _, cookie := range session.cookies {
-					req.AddCookie(cookie)
-				}
-				session.mu.RUnlock()
+				reqLog.Debug("等待后重试", "attempt", attempt+1, "delay_ms", delay.Milliseconds())
+				timing.sleep(delay)
 				continue
 			}
 
 			// 重试次数用尽
-			http.Error(w, "Request failed after retries", http.StatusBadGateway)
+			writeProxyError(w, access, errorClass(err), "Request failed after retries", http.StatusBadGateway)
 			stats.failedRequests.Add(1)
 			recordRequestResult(ipv6, false) // 记录失败到熔断器
 			return
@@ -1308,19 +1707,22 @@ func proxyHandler(w http.ResponseWriter, r *http.Request) {
 
 		// HTTP 错误码处理
 		statusCode := resp.StatusCode
+		access.UpstreamStatus = statusCode
 
 		// 403 Forbidden - 刷新 Cookie 重试（只刷新一次，避免死循环）
 		if statusCode == 403 && needsSession {
 			stats.error403Count.Add(1)
-			resp.Body.Close()
 
 			// 如果还没刷新过 Cookie，尝试刷新
 			if !hasRefreshedCookie && attempt < maxRetries {
-				log.Printf("⚠️  收到 403 (尝试 %d/%d)，Cookie 可能失效，立即刷新并重试...", attempt+1, maxRetries+1)
-
-				if err := refreshSession(ipv6, true); err != nil {
-					log.Printf("❌ 强制刷新会话失败: %v", err)
-					http.Error(w, "Session refresh failed", http.StatusServiceUnavailable)
+				resp.Body.Close()
+				reqLog.Warn("收到 403，Cookie 可能失效，立即刷新并重试", "status", 403, "attempt", attempt+1, "max_attempts", maxRetries+1)
+
+				var err error
+				timing.measure(phaseSession, func() { err = refreshSession(spanCtx, ipv6, true) })
+				if err != nil {
+					reqLog.Error("强制刷新会话失败", "attempt", attempt+1, "error", err)
+					writeProxyError(w, access, codeSessionRefresh, "Session refresh failed", http.StatusServiceUnavailable)
 					stats.failedRequests.Add(1)
 					recordRequestResult(ipv6, false) // 记录失败到熔断器
 					return
@@ -1328,37 +1730,24 @@ func proxyHandler(w http.ResponseWriter, r *http.Request) {
 
 				hasRefreshedCookie = true // 标记已刷新
 
-				// 重新创建请求
-				req, _ = http.NewRequestWithContext(ctx, "GET", targetURL, nil)
-				setHeaders(req, profile, false)
-				if !strings.Contains(targetURL, "www.google.com") {
-					req.Header.Set("Referer", "https://earth.google.com/")
-					req.Header.Set("Origin", "https://earth.google.com")
-				}
-				session.mu.RLock()
-				for _, cookie := range session.cookies {
-					req.AddCookie(cookie)
-				}
-				session.mu.RUnlock()
-
-				log.Printf("🔄 使用新 Cookie 重试请求...")
+				reqLog.Debug("使用新 Cookie 重试请求", "attempt", attempt+1)
 				continue
 			}
 
 			// 已刷新过或无重试机会
-			log.Printf("❌ 403 错误，Cookie 刷新后仍然失败")
-			http.Error(w, "Forbidden after refresh", http.StatusForbidden)
-			stats.failedRequests.Add(1)
-			recordRequestResult(ipv6, false)
+			reqLog.Error("403 错误，Cookie 刷新后仍然失败", "status", 403, "attempt", attempt+1)
+			if failUpstream("Forbidden after refresh", http.StatusForbidden) {
+				break
+			}
 			return
 		}
 
 		// 429 Too Many Requests - 指数退避重试
 		if statusCode == 429 {
 			stats.error429Count.Add(1)
-			resp.Body.Close()
 
 			if attempt < maxRetries {
+				resp.Body.Close()
 				// 检查 Retry-After 头
 				retryAfter := resp.Header.Get("Retry-After")
 				var delay time.Duration
@@ -1373,92 +1762,53 @@ func proxyHandler(w http.ResponseWriter, r *http.Request) {
 					delay = baseDelay * time.Duration(1<<uint(attempt+2)) // 429 使用更长的退避: 400ms, 800ms, 1600ms
 				}
 
-				log.Printf("⚠️  收到 429 (Too Many Requests)，等待 %v 后重试 (尝试 %d/%d)...", delay, attempt+1, maxRetries+1)
-				time.Sleep(delay)
-
-				// 重新创建请求
-				req, _ = http.NewRequestWithContext(ctx, "GET", targetURL, nil)
-				setHeaders(req, profile, false)
-				if !strings.Contains(targetURL, "www.google.com") {
-					req.Header.Set("Referer", "https://earth.google.com/")
-					req.Header.Set("Origin", "https://earth.google.com")
-				}
-				session.mu.RLock()
-				for _, cookie := range session.cookies {
-					req.AddCookie(cookie)
-				}
-				session.mu.RUnlock()
+				reqLog.Warn("收到 429，等待后重试", "status", 429, "attempt", attempt+1, "max_attempts", maxRetries+1, "delay_ms", delay.Milliseconds())
+				timing.sleep(delay)
 				continue
 			}
 
-			log.Printf("❌ 429 错误，重试次数用尽")
-			http.Error(w, "Too many requests", http.StatusTooManyRequests)
-			stats.failedRequests.Add(1)
-			recordRequestResult(ipv6, false) // 记录失败到熔断器
+			reqLog.Error("429 错误，重试次数用尽", "status", 429, "attempt", attempt+1)
+			if failUpstream("Too many requests", http.StatusTooManyRequests) {
+				break
+			}
 			return
 		}
 
 		// 503 Service Unavailable - 短暂等待重试
 		if statusCode == 503 {
 			stats.error503Count.Add(1)
-			resp.Body.Close()
 
 			if attempt < maxRetries {
+				resp.Body.Close()
 				delay := baseDelay * time.Duration(1<<uint(attempt+1)) // 200ms, 400ms, 800ms
-				log.Printf("⚠️  收到 503 (Service Unavailable)，等待 %v 后重试 (尝试 %d/%d)...", delay, attempt+1, maxRetries+1)
-				time.Sleep(delay)
-
-				// 重新创建请求
-				req, _ = http.NewRequestWithContext(ctx, "GET", targetURL, nil)
-				setHeaders(req, profile, false)
-				if !strings.Contains(targetURL, "www.google.com") {
-					req.Header.Set("Referer", "https://earth.google.com/")
-					req.Header.Set("Origin", "https://earth.google.com")
-				}
-				session.mu.RLock()
-				for _, cookie := range session.cookies {
-					req.AddCookie(cookie)
-				}
-				session.mu.RUnlock()
+				reqLog.Warn("收到 503，等待后重试", "status", 503, "attempt", attempt+1, "max_attempts", maxRetries+1, "delay_ms", delay.Milliseconds())
+				timing.sleep(delay)
 				continue
 			}
 
-			log.Printf("❌ 503 错误，重试次数用尽")
-			http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
-			stats.failedRequests.Add(1)
-			recordRequestResult(ipv6, false) // 记录失败到熔断器
+			reqLog.Error("503 错误，重试次数用尽", "status", 503, "attempt", attempt+1)
+			if failUpstream("Service unavailable", http.StatusServiceUnavailable) {
+				break
+			}
 			return
 		}
 
 		// 其他 5xx 错误 - 短暂等待重试
 		if statusCode >= 500 && statusCode < 600 {
 			stats.error5xxCount.Add(1)
-			resp.Body.Close()
 
 			if attempt < maxRetries {
+				resp.Body.Close()
 				delay := baseDelay * time.Duration(1<<uint(attempt)) // 100ms, 200ms, 400ms
-				log.Printf("⚠️  收到 %d 错误，等待 %v 后重试 (尝试 %d/%d)...", statusCode, delay, attempt+1, maxRetries+1)
-				time.Sleep(delay)
-
-				// 重新创建请求
-				req, _ = http.NewRequestWithContext(ctx, "GET", targetURL, nil)
-				setHeaders(req, profile, false)
-				if !strings.Contains(targetURL, "www.google.com") {
-					req.Header.Set("Referer", "https://earth.google.com/")
-					req.Header.Set("Origin", "https://earth.google.com")
-				}
-				session.mu.RLock()
-				for _, cookie := range session.cookies {
-					req.AddCookie(cookie)
-				}
-				session.mu.RUnlock()
+				reqLog.Warn("收到 5xx，等待后重试", "status", statusCode, "attempt", attempt+1, "max_attempts", maxRetries+1, "delay_ms", delay.Milliseconds())
+				timing.sleep(delay)
 				continue
 			}
 
-			log.Printf("❌ %d 错误，重试次数用尽", statusCode)
-			http.Error(w, fmt.Sprintf("Server error: %d", statusCode), statusCode)
-			stats.failedRequests.Add(1)
-			recordRequestResult(ipv6, false) // 记录失败到熔断器
+			reqLog.Error("5xx 错误，重试次数用尽", "status", statusCode, "attempt", attempt+1)
+			if failUpstream(fmt.Sprintf("Server error: %d", statusCode), statusCode) {
+				break
+			}
 			return
 		}
 
@@ -1468,223 +1818,107 @@ func proxyHandler(w http.ResponseWriter, r *http.Request) {
 	defer resp.Body.Close()
 
 	// 读取响应体
+	bodyStart := time.Now()
+	_, decodeSpan := startSpan(ctx, "body.decode", spanKindInternal)
+	decodeSpan.setAttr("http.response.header.content-encoding", resp.Header.Get("Content-Encoding"))
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Printf("❌ 读取响应失败: %v", err)
-		http.Error(w, "Failed to read response", http.StatusInternalServerError)
+		decodeSpan.setError(errorClass(err), err)
+		decodeSpan.End()
+		reqLog.Error("读取响应失败", "status", resp.StatusCode, "error", err)
+		writeProxyError(w, access, errorClass(err), "Failed to read response", http.StatusBadGateway)
 		stats.failedRequests.Add(1)
 		recordRequestResult(ipv6, false) // 记录失败到熔断器
 		return
 	}
 
-	// 解压 gzip
-	if resp.Header.Get("Content-Encoding") == "gzip" {
-		body, err = decompressGzip(body)
+	// 解压：gzip 始终解压；mirror 模式下 br / deflate 也解压，调用方收到的都是未压缩的内容
+	// HEAD、204 / 304 和空响应体没有可解压的内容，连同 Content-Encoding 原样返回
+	encoding := strings.ToLower(resp.Header.Get("Content-Encoding"))
+	decoded := false
+	if len(body) > 0 && !bodylessResponse(resp) &&
+		(encoding == "gzip" || (mode == responseMirror && (encoding == "br" || encoding == "deflate"))) {
+		decoded = true
+		body, err = decodeBody(body, encoding)
 		if err != nil {
-			log.Printf("❌ 解压失败: %v", err)
-			http.Error(w, "Failed to decompress response", http.StatusInternalServerError)
+			decodeSpan.setError(codeDecode, err)
+			decodeSpan.End()
+			reqLog.Error("解压失败", "status", resp.StatusCode, "error", err)
+			writeProxyError(w, access, codeDecode, "Failed to decompress response", http.StatusInternalServerError)
 			stats.failedRequests.Add(1)
 			recordRequestResult(ipv6, false) // 记录失败到熔断器
 			return
 		}
 	}
 
-	duration := time.Since(startTime)
-	stats.successRequests.Add(1)
+	decodeSpan.setAttr("utls.body_bytes", len(body))
+	decodeSpan.End()
+	timing.add(phaseBody, time.Since(bodyStart))
 
-	// 记录成功结果到熔断器
-	recordRequestResult(ipv6, true)
+	duration := time.Since(startTime)
+	if upstreamFailed {
+		stats.failedRequests.Add(1)
+		recordRequestResult(ipv6, false) // 记录失败到熔断器
+	} else {
+		stats.successRequests.Add(1)
+		recordRequestResult(ipv6, true) // 记录成功结果到熔断器
+	}
 
-	ipv6Display := safeSubstring(ipv6, 20)
-	if ipv6Display == "" {
-		ipv6Display = "default"
+	if r.Context().Err() != nil {
+		reqLog.Debug("调用方已断开，响应无法送达", "status", resp.StatusCode)
+		access.Error = codeClientCancelled
 	}
-	urlDisplay := safeSubstring(targetURL, 60)
 
-	log.Printf("✅ [%s] [%s] %d - %s (%dms, %d bytes)",
-		ipv6Display, profile.Name, resp.StatusCode, urlDisplay,
-		duration.Milliseconds(), len(body))
+	if !upstreamFailed && shouldLogSuccess() {
+		reqLog.Info("请求成功", "status", resp.StatusCode, "duration_ms", duration.Milliseconds(),
+			"bytes", len(body), "attempt", attempts, "path", safeSubstring(parsedURL.Path, 60))
+	}
 
 	// 返回响应
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("X-Status-Code", strconv.Itoa(resp.StatusCode))
 	w.Header().Set("X-Duration-Ms", strconv.FormatInt(duration.Milliseconds(), 10))
 	w.Header().Set("X-Browser-Profile", profile.Name)
 
-	for key, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add("X-Origin-"+key, value)
-		}
+	if mode == responseMirror {
+		writeMirrorResponse(w, resp, body, decoded)
+	} else {
+		writeLegacyResponse(w, resp, body)
 	}
-
-	w.WriteHeader(http.StatusOK)
-	w.Write(body)
 }
 
-// 健康检查处理器
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-	uptime := time.Since(stats.startTime)
-	total := stats.totalRequests.Load()
-	success := stats.successRequests.Load()
-	failed := stats.failedRequests.Load()
-	error403 := stats.error403Count.Load()
-	error429 := stats.error429Count.Load()
-	error503 := stats.error503Count.Load()
-	error5xx := stats.error5xxCount.Load()
-	timeoutErr := stats.timeoutCount.Load()
-	networkErr := stats.networkErrorCount.Load()
-	sessionRefresh := stats.sessionRefreshCount.Load()
-
-	var successRate float64
-	if total > 0 {
-		successRate = float64(success) / float64(total) * 100
-	}
-
-	// 统计所有 Session 的信息
-	var totalCookies int64
-	var totalSessions int64
-	var oldestRefresh time.Time
-	var earliestExpiry time.Time
-
-	sessionManager.Range(func(key, value interface{}) bool {
-		session := value.(*CookieSession)
-		session.mu.RLock()
-		totalCookies += int64(len(session.cookies))
-
-		// 记录最旧的刷新时间
-		if oldestRefresh.IsZero() || session.lastUpdate.Before(oldestRefresh) {
-			oldestRefresh = session.lastUpdate
-		}
-
-		// 记录最早的过期时间
-		if !session.earliestExpiry.IsZero() {
-			if earliestExpiry.IsZero() || session.earliestExpiry.Before(earliestExpiry) {
-				earliestExpiry = session.earliestExpiry
-			}
-		}
-		session.mu.RUnlock()
-
-		totalSessions++
-		return true
-	})
-
-	// 计算 Cookie 剩余有效时间
-	var cookieValidSeconds int64
-	if !earliestExpiry.IsZero() {
-		remaining := time.Until(earliestExpiry).Seconds()
-		if remaining > 0 {
-			cookieValidSeconds = int64(remaining)
+func main() {
+	// 子命令
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "mockupstream":
+			os.Exit(mockupstream.Main(os.Args[2:]))
+		case "profiles":
+			os.Exit(profilesCommand(os.Args[2:]))
 		}
 	}
 
-	// 统计浏览器使用情况
-	browserUsage := make(map[string]int64)
-	stats.browserUsage.Range(func(key, value interface{}) bool {
-		browserUsage[key.(string)] = value.(*atomic.Int64).Load()
-		return true
-	})
-
-	// 统计 IPv6 客户端缓存数量
-	var ipv6ClientCount int64
-	ipv6ClientCache.Range(func(key, value interface{}) bool {
-		ipv6ClientCount++
-		return true
-	})
-
-	// 当前并发刷新数（智能调整的值）
-	currentConcurrency := currentMaxConcurrentRefresh.Load()
-	activeRefreshCount := int32(len(sessionRefreshSem))
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-
-	// 构建浏览器使用统计
-	browserStats := "{"
-	first := true
-	for name, count := range browserUsage {
-		if !first {
-			browserStats += ", "
-		}
-		browserStats += fmt.Sprintf(`"%s": %d`, name, count)
-		first = false
-	}
-	browserStats += "}"
-
-	fmt.Fprintf(w, `{
-	"status": "ok",
-	"uptime": %.0f,
-	"totalRequests": %d,
-	"successRequests": %d,
-	"failedRequests": %d,
-	"successRate": "%.2f%%",
-	"errors": {
-		"error403": %d,
-		"error429": %d,
-		"error503": %d,
-		"error5xx": %d,
-		"timeout": %d,
-		"network": %d
-	},
-	"session": {
-		"totalSessions": %d,
-		"totalCookies": %d,
-		"oldestRefresh": "%s",
-		"earliestExpiry": "%s",
-		"cookieValidSeconds": %d,
-		"sessionRefreshCount": %d
-	},
-	"clientPool": {
-		"ipv6ClientsCached": %d
-	},
-	"concurrencyControl": {
-		"currentMaxConcurrent": %d,
-		"activeRefreshCount": %d,
-		"minConcurrent": %d,
-		"maxConcurrent": %d
-	},
-	"browserProfiles": {
-		"available": %d,
-		"usage": %s
-	}
-}`,
-		uptime.Seconds(),
-		total,
-		success,
-		failed,
-		successRate,
-		error403,
-		error429,
-		error503,
-		error5xx,
-		timeoutErr,
-		networkErr,
-		totalSessions,
-		totalCookies,
-		oldestRefresh.Format(time.RFC3339),
-		earliestExpiry.Format(time.RFC3339),
-		cookieValidSeconds,
-		sessionRefresh,
-		ipv6ClientCount,
-		currentConcurrency,
-		activeRefreshCount,
-		config.minConcurrentRefresh,
-		config.maxConcurrentRefresh,
-		len(browserProfiles),
-		browserStats,
-	)
-}
+	initProxy()
 
-func main() {
 	port := os.Getenv("UTLS_PROXY_PORT")
 	if port == "" {
 		port = "8765"
 	}
+	if port == "off" || port == "none" {
+		port = ""
+	}
 
 	http.HandleFunc("/proxy", proxyHandler)
+	http.HandleFunc("/batch", batchHandler)
 	http.HandleFunc("/health", healthHandler)
+	http.HandleFunc("/livez", livezHandler)
+	http.HandleFunc("/readyz", readyzHandler)
+	http.HandleFunc("/loglevel", adminOnly(logLevelHandler))
+	http.HandleFunc("/profiles", profilesHandler)
+	http.HandleFunc("/profiles/assignments", adminOnly(profileAssignmentsHandler))
+	http.HandleFunc("/profiles/verify", adminOnly(profilesVerifyHandler))
 
 	server := &http.Server{
-		Addr:         ":" + port,
+		Handler:      withForwardProxy(http.DefaultServeMux),
+		Protocols:    serverProtocols(),
 		ReadTimeout:  60 * time.Second,
 		WriteTimeout: 60 * time.Second,
 		IdleTimeout:  120 * time.Second,
@@ -1694,84 +1928,79 @@ func main() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
+	// 后台任务在关闭时通过 ctx 停止
+	ctx, stopBackground := context.WithCancel(context.Background())
+
 	// 启动定期资源清理任务
-	go startResourceCleanup()
+	runBackground(ctx, startResourceCleanup)
 
 	// 启动并发数动态调整任务
-	go startConcurrencyAdjustment()
-
-	// 启动日志轮转任务
-	go startLogRotation()
+	runBackground(ctx, startConcurrencyAdjustment)
 
-	// 在 goroutine 中启动服务器
-	go func() {
-		log.Printf("🚀 uTLS Proxy Server starting on :%s", port)
-		log.Printf("📦 uTLS 版本: v1.8.1 (github.com/refraction-networking/utls)")
-		log.Printf("🎭 浏览器指纹库: %d 种官方支持的配置", len(browserProfiles))
-		log.Printf("🌐 代理端点: http://localhost:%s/proxy?url=<URL>&ipv6=<IPv6>", port)
-		log.Printf("💚 健康检查: http://localhost:%s/health", port)
-
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("❌ Server failed: %v", err)
-		}
-	}()
+	// 启动日志重新打开（SIGUSR1）监听
+	runBackground(ctx, startLogReopenHandler)
 
-	// 等待关闭信号
-	sig := <-sigChan
-	log.Printf("🛑 收到信号: %v，开始优雅关闭...", sig)
+	// 启动 systemd 看门狗
+	runBackground(ctx, startWatchdog)
 
-	// 设置关闭标志，拒绝新请求
-	shutdownFlag.Store(true)
-	log.Printf("✓ 已停止接受新请求")
+	// 启动链路追踪导出
+	startTracing()
 
-	// 等待现有请求完成（最多等待 30 秒）
-	log.Printf("⏳ 等待 %d 个活跃请求完成...", activeRequests.Load())
-	shutdownTimeout := 30 * time.Second
-	deadline := time.Now().Add(shutdownTimeout)
-
-	for activeRequests.Load() > 0 && time.Now().Before(deadline) {
-		remaining := activeRequests.Load()
-		log.Printf("⏳ 还有 %d 个请求正在处理...", remaining)
-		time.Sleep(500 * time.Millisecond)
+	listeners, err := openListeners(port)
+	if err != nil {
+		slog.Error("监听失败", "error", err)
+		os.Exit(1)
 	}
 
-	if activeRequests.Load() > 0 {
-		log.Printf("⚠️  超时，仍有 %d 个请求未完成，强制关闭", activeRequests.Load())
-	} else {
-		log.Printf("✓ 所有请求已完成")
+	slog.Info("uTLS Proxy Server starting", "port", port, "unix_socket", config.unixSocket,
+		"h2c", config.h2c, "utls_version", utlsVersion(), "profiles", len(browserProfiles),
+		"proxy_endpoint", "/proxy?url=<URL>&ipv6=<IPv6>", "health_endpoint", "/health")
+
+	// 在 goroutine 中启动服务器（每个监听一个）
+	for _, ln := range listeners {
+		go func(ln net.Listener) {
+			if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+				slog.Error("Server failed", "listener", ln.Addr().String(), "error", err)
+				os.Exit(1)
+			}
+		}(ln)
 	}
+	notifyServing()
 
-	// 关闭 HTTP 服务器
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	// 启动监听交接（SIGUSR2）
+	runBackground(ctx, func(ctx context.Context) {
+		startHandoffHandler(ctx, listeners)
+	})
 
-	if err := server.Shutdown(ctx); err != nil {
-		log.Printf("❌ 服务器关闭失败: %v", err)
+	// 等待关闭信号，或新进程接管监听
+	select {
+	case sig := <-sigChan:
+		slog.Info("收到信号，开始优雅关闭", "signal", sig.String())
+	case <-handoffDone:
+		slog.Info("监听已交给新进程，开始优雅关闭")
 	}
 
-	log.Printf("✓ 服务器已优雅关闭")
-	log.Printf("📊 最终统计:")
-	log.Printf("  - 总请求数: %d", stats.totalRequests.Load())
-	log.Printf("  - 成功: %d", stats.successRequests.Load())
-	log.Printf("  - 失败: %d", stats.failedRequests.Load())
-	log.Printf("  - Session 刷新次数: %d", stats.sessionRefreshCount.Load())
+	shutdown(server, stopBackground)
 
 	// 关闭日志文件
-	if logFileHandle != nil {
-		logFileHandle.Close()
+	closeAccessLog()
+	if mainLog != nil {
+		mainLog.Close()
 	}
 }
 
 // 定期调整并发刷新数
-func startConcurrencyAdjustment() {
+func startConcurrencyAdjustment(ctx context.Context) {
 	ticker := time.NewTicker(1 * time.Minute) // 每分钟调整一次
 	defer ticker.Stop()
 
-	log.Printf("🎚️  并发数自动调整任务已启动（每 1 分钟）")
+	slog.Info("并发数自动调整任务已启动", "interval", time.Minute.String())
 
-	for range ticker.C {
-		if shutdownFlag.Load() {
-			break
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 		}
 
 		oldConcurrency := currentMaxConcurrentRefresh.Load()
@@ -1779,21 +2008,23 @@ func startConcurrencyAdjustment() {
 
 		if oldConcurrency != newConcurrency {
 			currentMaxConcurrentRefresh.Store(newConcurrency)
-			log.Printf("🎚️  并发数已调整: %d → %d", oldConcurrency, newConcurrency)
+			slog.Info("并发数已调整", "from", oldConcurrency, "to", newConcurrency)
 		}
 	}
 }
 
 // 定期资源清理任务
-func startResourceCleanup() {
+func startResourceCleanup(ctx context.Context) {
 	ticker := time.NewTicker(config.resourceCleanInterval)
 	defer ticker.Stop()
 
-	log.Printf("🗑️  资源清理任务已启动（每 %v）", config.resourceCleanInterval)
+	slog.Info("资源清理任务已启动", "interval", config.resourceCleanInterval.String())
 
-	for range ticker.C {
-		if shutdownFlag.Load() {
-			break
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 		}
 
 		cleanupExpiredResources()
@@ -1828,9 +2059,12 @@ func cleanupExpiredResources() {
 
 	// 执行删除
 	for _, ipv6 := range toDelete {
+		if ipv6 == defaultAddressKey {
+			defaultClients.retire()
+		}
 		sessionManager.Delete(ipv6)
 		cleanedSessions++
-		log.Printf("🗑️  清理过期 Session: %s (%v 未使用)", ipv6[:min(20, len(ipv6))], config.sessionInactiveTime)
+		slog.Debug("清理过期 Session", "addr", ipv6, "inactive", config.sessionInactiveTime.String())
 	}
 
 	// 2. 清理对应的 Client（Session 已删除的）
@@ -1848,12 +2082,14 @@ func cleanupExpiredResources() {
 	})
 
 	for _, ipv6 := range toDelete {
-		ipv6ClientCache.Delete(ipv6)
+		if client, ok := ipv6ClientCache.LoadAndDelete(ipv6); ok {
+			client.(*http.Client).CloseIdleConnections()
+		}
 		cleanedClients++
-		log.Printf("🗑️  清理过期 Client: %s", ipv6[:min(20, len(ipv6))])
+		slog.Debug("清理过期 Client", "addr", ipv6)
 	}
 
-	// 3. 清理浏览器指纹映射（Session 已删除的）
+	// 3. 清理浏览器指纹映射（Session 已删除的；hash 策略下再次使用时分配到相同的指纹）
 	toDelete = toDelete[:0]
 
 	browserProfileMap.Range(func(key, value interface{}) bool {
@@ -1870,7 +2106,10 @@ func cleanupExpiredResources() {
 		browserProfileMap.Delete(ipv6)
 	}
 
+	// 4. 清理过期的 DNS 缓存
+	cleanedDNS := resolver.cleanExpired()
+
 	if cleanedSessions > 0 || cleanedClients > 0 {
-		log.Printf("✓ 资源清理完成：%d 个 Session，%d 个 Client", cleanedSessions, cleanedClients)
+		slog.Info("资源清理完成", "sessions", cleanedSessions, "clients", cleanedClients, "dns_entries", cleanedDNS)
 	}
 }
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 上游请求方法与请求体：
+//   - 调用方的请求方法即上游请求方法，允许的方法按白名单中的域名配置（UTLS_ALLOWED_METHODS，默认 GET / HEAD）
+//   - 请求体直接流式转发；需要重试时先缓存（不超过 UTLS_RETRY_BODY_BUFFER_KB）以便重放，超出时退化为流式且不重试
+//   - 只有幂等方法会重试，非幂等方法需要调用方用 X-Utls-Retry: true 明确允许
+
+// 白名单中每个域名的策略
+type hostPolicy struct {
+	methods map[string]bool // 允许的请求方法
+}
+
+var defaultAllowedMethods = []string{http.MethodGet, http.MethodHead}
+
+// 可以转发的请求方法（CONNECT / TRACE 不转发）
+var supportedMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+}
+
+// 解析 UTLS_ALLOWED_METHODS：分号分隔的 host=METHOD,METHOD，host 为 * 时作用于所有域名（具体域名优先）
+//
+//	*=GET,HEAD;earth.google.com=GET,HEAD,POST
+func initHostPolicies(spec string) error {
+	for _, policy := range allowedDomains {
+		policy.methods = methodSet(defaultAllowedMethods)
+	}
+
+	overrides := make(map[string][]string)
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		host, list, ok := strings.Cut(entry, "=")
+		host = strings.ToLower(strings.TrimSpace(host))
+		if !ok || host == "" {
+			return fmt.Errorf("无效的方法配置 %q（格式 host=METHOD,METHOD）", entry)
+		}
+		if host != "*" && allowedDomains[host] == nil {
+			return fmt.Errorf("方法配置中的域名不在白名单中: %s", host)
+		}
+
+		var methods []string
+		for _, method := range strings.Split(list, ",") {
+			method = strings.ToUpper(strings.TrimSpace(method))
+			if method == "" {
+				continue
+			}
+			if !supportedMethods[method] {
+				return fmt.Errorf("不支持的请求方法: %s", method)
+			}
+			methods = append(methods, method)
+		}
+		if len(methods) == 0 {
+			return fmt.Errorf("无效的方法配置 %q：至少需要一个方法", entry)
+		}
+		overrides[host] = methods
+	}
+
+	if methods, ok := overrides["*"]; ok {
+		for _, policy := range allowedDomains {
+			policy.methods = methodSet(methods)
+		}
+	}
+	for host, methods := range overrides {
+		if host != "*" {
+			allowedDomains[host].methods = methodSet(methods)
+		}
+	}
+
+	for host := range allowedDomains {
+		slog.Info("允许的请求方法", "host", host, "methods", allowedMethodList(host))
+	}
+	return nil
+}
+
+func methodSet(methods []string) map[string]bool {
+	set := make(map[string]bool, len(methods))
+	for _, method := range methods {
+		set[method] = true
+	}
+	return set
+}
+
+func methodAllowed(host, method string) bool {
+	policy := allowedDomains[host]
+	return policy != nil && policy.methods[method]
+}
+
+// 该域名允许的方法（用于 405 响应的 Allow 头）
+func allowedMethodList(host string) string {
+	policy := allowedDomains[host]
+	if policy == nil {
+		return ""
+	}
+	methods := make([]string, 0, len(policy.methods))
+	for method := range policy.methods {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
+
+// 幂等方法（RFC 9110 9.2.2）可以安全重试
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// 调用方是否允许重试非幂等请求
+func retryOptIn(r *http.Request) bool {
+	v, err := strconv.ParseBool(r.Header.Get("X-Utls-Retry"))
+	return err == nil && v
+}
+
+// 上游请求体：已缓存的可以在重试时重放，流式的只能发送一次
+type requestBody struct {
+	data        []byte    // 已缓存的请求体
+	stream      io.Reader // 未缓存时直接转发的调用方请求体
+	size        int64     // 长度（-1 = 未知）
+	contentType string
+}
+
+// 读取调用方的请求体；buffer 为 true 时缓存以便重试，超出缓存上限时已读部分和剩余部分一起流式转发
+func readRequestBody(r *http.Request, buffer bool) (*requestBody, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+
+	body := &requestBody{size: r.ContentLength, contentType: r.Header.Get("Content-Type")}
+	if !buffer {
+		body.stream = r.Body
+		return body, nil
+	}
+
+	limit := config.retryBodyBuffer
+	data, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		body.stream = io.MultiReader(bytes.NewReader(data), r.Body)
+		return body, nil
+	}
+
+	body.data = data
+	body.size = int64(len(data))
+	return body, nil
+}
+
+// 是否可以在重试时重放
+func (b *requestBody) replayable() bool {
+	return b == nil || b.stream == nil
+}
+
+// 本次尝试使用的请求体
+func (b *requestBody) reader() io.Reader {
+	if b.stream != nil {
+		return b.stream
+	}
+	return bytes.NewReader(b.data)
+}
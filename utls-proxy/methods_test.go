@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"zeromaps-utls-proxy/mockupstream"
+)
+
+// 不自动解压的客户端：检查代理返回的原始 Content-Encoding
+var rawClient = &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+// HEAD 请求经 gzip 上游：没有响应体可解压，返回上游的状态码和 Content-Encoding，而不是 decode_failed
+func TestHeadThroughGzipUpstream(t *testing.T) {
+	mock, proxy := startMockProxy(t)
+	saved := mock.Behavior()
+	defer mock.SetBehavior(saved)
+	b := saved
+	b.Encoding = "gzip"
+	mock.SetBehavior(b)
+
+	tile := url.QueryEscape("https://kh.google.com/rt/earth/NodeData/pb=!1m2!1s0!2u2")
+	for _, mode := range []string{responseMirror, responseLegacy} {
+		req, _ := http.NewRequest(http.MethodHead, proxy.URL+"/proxy?response="+mode+"&url="+tile, nil)
+		resp, err := rawClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Utls-Error") != "" {
+			t.Errorf("%s: 状态码 %d，错误 %q", mode, resp.StatusCode, resp.Header.Get("X-Utls-Error"))
+			continue
+		}
+		encoding := resp.Header.Get("Content-Encoding")
+		if mode == responseLegacy {
+			encoding = resp.Header.Get("X-Origin-Content-Encoding")
+		}
+		if encoding != "gzip" {
+			t.Errorf("%s: Content-Encoding 为 %q，应保留上游的 gzip", mode, encoding)
+		}
+	}
+}
+
+// 调用方的方法和请求体原样转发；不允许的方法返回 405 和 Allow；非幂等请求默认不重试
+func TestForwardMethodAndBody(t *testing.T) {
+	mock, proxy := startMockProxy(t)
+	if err := initHostPolicies("kh.google.com=GET,HEAD,POST"); err != nil {
+		t.Fatal(err)
+	}
+	defer initHostPolicies(config.allowedMethods)
+	saved := mock.Behavior()
+	defer mock.SetBehavior(saved)
+
+	echo := proxy.URL + "/proxy?response=mirror&url=" + url.QueryEscape("https://kh.google.com/echo")
+	post := func(target string, header http.Header) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, target, strings.NewReader("payload"))
+		req.Header = header
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := post(echo, http.Header{})
+	var got mockupstream.Echo
+	err := json.NewDecoder(resp.Body).Decode(&got)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST: 状态码 %d，%v", resp.StatusCode, err)
+	}
+	if got.Method != http.MethodPost || got.BodyBytes != len("payload") || got.Header.Get("Content-Type") != "application/x-protobuf" {
+		t.Errorf("上游收到 %s，%d 字节，Content-Type %q", got.Method, got.BodyBytes, got.Header.Get("Content-Type"))
+	}
+
+	resp = post(proxy.URL+"/proxy?url="+url.QueryEscape("https://earth.google.com/echo"), http.Header{})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "GET, HEAD" {
+		t.Errorf("earth.google.com POST: 状态码 %d，Allow %q", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+
+	// 上游 503：POST 只发送一次，X-Utls-Retry: true 时重试
+	for _, tc := range []struct {
+		header   http.Header
+		requests int64
+		status   int
+	}{
+		{http.Header{}, 1, http.StatusServiceUnavailable},
+		{http.Header{"X-Utls-Retry": {"true"}}, 2, http.StatusOK},
+	} {
+		b := saved
+		b.UnavailableNext = 1
+		b.FaultHosts = []string{"kh.google.com"}
+		mock.SetBehavior(b)
+		before := mock.Stats().ByHost["kh.google.com"]
+
+		resp := post(echo, tc.header)
+		resp.Body.Close()
+		if sent := mock.Stats().ByHost["kh.google.com"] - before; sent != tc.requests || resp.StatusCode != tc.status {
+			t.Errorf("X-Utls-Retry=%q: 上游收到 %d 次，状态码 %d", tc.header.Get("X-Utls-Retry"), sent, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"zeromaps-utls-proxy/mockupstream"
+)
+
+// 端到端测试：代理经 ::1 连接进程内的模拟上游（UTLS_MOCK_UPSTREAM），不访问真实的 Google 服务器
+
+var (
+	mockOnce   sync.Once
+	mockProxy  *httptest.Server
+	mockServer *mockupstream.Server
+	mockDir    string // 模拟上游 CA 和日志文件所在的临时目录
+)
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	stopMockProxy()
+	os.Exit(code)
+}
+
+// 启动共享的模拟上游和代理（全局状态只能初始化一次，所有测试共用），由 TestMain 统一清理
+func startMockProxy(t *testing.T) (*mockupstream.Server, *httptest.Server) {
+	t.Helper()
+
+	mockOnce.Do(func() {
+		mock, err := mockupstream.New(mockupstream.Options{Addr: "[::1]:0", Behavior: mockupstream.DefaultBehavior()})
+		if err != nil {
+			t.Fatalf("启动模拟上游失败: %v", err)
+		}
+		mock.Start()
+
+		dir, err := os.MkdirTemp("", "utls-proxy-mock")
+		if err != nil {
+			t.Fatal(err)
+		}
+		mockDir = dir
+		caFile := filepath.Join(dir, "mock-ca.pem")
+		if err := os.WriteFile(caFile, mock.CAPEM(), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		restoreEnv := setenv(map[string]string{
+			"UTLS_MOCK_UPSTREAM":        mock.Addr(),
+			"UTLS_MOCK_CA_FILE":         caFile,
+			"UTLS_LOG_FILE":             filepath.Join(dir, "utls-proxy.log"),
+			"UTLS_ACCESS_LOG_FILE":      filepath.Join(dir, "access.log"),
+			"UTLS_LOG_LEVEL":            "warn",
+			"UTLS_MAX_RETRIES":          "1",
+			"UTLS_BASE_RETRY_DELAY_MS":  "1",
+			"UTLS_CIRCUIT_MIN_REQUESTS": "5",
+			"UTLS_STATE_FILE":           "off",
+			"UTLS_RANDOM_SEED":          "1",
+			"UTLS_DEFAULT_CLIENTS":      "2",
+		})
+		initProxy()
+		restoreEnv()
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/proxy", proxyHandler)
+		mux.HandleFunc("/batch", batchHandler)
+		mux.HandleFunc("/health", healthHandler)
+
+		mockServer = mock
+		mockProxy = httptest.NewServer(withForwardProxy(mux))
+	})
+	return mockServer, mockProxy
+}
+
+// 关闭共享的代理、模拟上游和日志文件，删除临时目录
+func stopMockProxy() {
+	if mockProxy != nil {
+		mockProxy.Close()
+		closeUpstreamClients()
+	}
+	if mockServer != nil {
+		mockServer.Close()
+	}
+	closeAccessLog()
+	if mainLog != nil {
+		logOutput.swap(os.Stdout)
+		mainLog.Close()
+	}
+	if mockDir != "" {
+		os.RemoveAll(mockDir)
+	}
+}
+
+// 设置环境变量，返回恢复原值的函数（配置只在 initProxy 中读取一次，读完即可恢复）
+func setenv(vars map[string]string) func() {
+	saved := make(map[string]*string, len(vars))
+	for key, value := range vars {
+		if old, ok := os.LookupEnv(key); ok {
+			saved[key] = &old
+		} else {
+			saved[key] = nil
+		}
+		os.Setenv(key, value)
+	}
+	return func() {
+		for key, old := range saved {
+			if old != nil {
+				os.Setenv(key, *old)
+			} else {
+				os.Unsetenv(key)
+			}
+		}
+	}
+}
+
+// 经模拟上游获取瓦片：kh.google.com 先刷新会话取得 Cookie，响应体与模拟上游生成的内容一致
+func TestProxyMockUpstream(t *testing.T) {
+	mock, proxy := startMockProxy(t)
+
+	const tile = "/rt/earth/NodeData/pb=!1m2!1s0!2u33"
+	resp, err := http.Get(proxy.URL + "/proxy?url=" + url.QueryEscape("https://kh.google.com"+tile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, mockupstream.Payload(tile, mock.Behavior().BodySize)) {
+		t.Errorf("状态码 %d，响应体 %d 字节", resp.StatusCode, len(body))
+	}
+	if stats := mock.Stats(); stats.CookiesIssued == 0 || stats.ByHost["kh.google.com"] == 0 {
+		t.Errorf("模拟上游统计: %+v", stats)
+	}
+}
@@ -0,0 +1,69 @@
+package mockupstream
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"zeromaps-utls-proxy/certauth"
+)
+
+// 子命令入口：utls-proxy mockupstream [flags]
+func Main(args []string) int {
+	defaults := DefaultBehavior()
+
+	fs := flag.NewFlagSet("mockupstream", flag.ContinueOnError)
+	addr := fs.String("listen", "127.0.0.1:8443", "监听地址")
+	caDir := fs.String("ca-dir", "./mockupstream-ca", "CA 证书目录（ca.pem 供代理信任）")
+	cookieTTL := fs.Duration("cookie-ttl", time.Duration(defaults.CookieTTLSeconds)*time.Second, "NID / 1P_JAR Cookie 有效期")
+	requireCookies := fs.Bool("require-cookies", defaults.RequireCookies, "kh.google.com 无有效 Cookie 时返回 403")
+	encoding := fs.String("encoding", defaults.Encoding, "响应压缩：identity / gzip / br")
+	delay := fs.Duration("delay", 0, "每个响应的延迟")
+	bodySize := fs.Int("body-size", defaults.BodySize, "kh.google.com 响应体大小（字节）")
+	retryAfter := fs.Int("retry-after", 1, "429 响应的 Retry-After（秒）")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	switch *encoding {
+	case "identity", "gzip", "br":
+	default:
+		fmt.Fprintf(os.Stderr, "无效的 -encoding: %s（identity / gzip / br）\n", *encoding)
+		return 2
+	}
+
+	behavior := defaults
+	behavior.CookieTTLSeconds = int(cookieTTL.Seconds())
+	behavior.RequireCookies = *requireCookies
+	behavior.Encoding = *encoding
+	behavior.DelayMs = int(delay.Milliseconds())
+	behavior.BodySize = *bodySize
+	behavior.RetryAfter = *retryAfter
+
+	server, err := New(Options{Addr: *addr, CADir: *caDir, Behavior: behavior})
+	if err != nil {
+		slog.Error("启动模拟上游失败", "error", err)
+		return 1
+	}
+	server.Start()
+
+	caFile, _ := filepath.Abs(filepath.Join(*caDir, certauth.CertFile))
+	slog.Info("模拟上游已启动", "addr", server.Addr(), "hosts", strings.Join(Hosts, ","), "ca_file", caFile)
+	fmt.Fprintf(os.Stderr, "\n代理配置：\n  UTLS_MOCK_UPSTREAM=%s UTLS_MOCK_CA_FILE=%s ./utls-proxy\n\n", server.Addr(), caFile)
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	<-sigChan
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+	return 0
+}
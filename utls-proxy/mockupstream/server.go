@@ -0,0 +1,528 @@
+// Package mockupstream 模拟 Google Earth 上游（earth.google.com / kh.google.com），
+// 用于在无法访问 Google 的环境（CI、离线开发）中对代理做集成测试。
+//
+// 模拟行为：
+//   - https://earth.google.com/web/ 返回页面并下发 NID / 1P_JAR Cookie（有效期可配置）
+//   - https://kh.google.com/rt/earth/... 返回按路径确定的二进制数据，带 ETag / Last-Modified，
+//     If-None-Match / If-Modified-Since 命中时返回 304
+//   - 任意域名的 /echo 以 JSON 返回收到的方法、请求头和请求体摘要（检查代理转发了什么）
+//   - 可按脚本注入故障：无 Cookie 返回 403、429 + Retry-After、连续 503、
+//     gzip / brotli 压缩、慢响应、重定向
+//
+// 控制接口（任意域名下）：
+//
+//	GET  /__mock/behavior   查看当前行为
+//	PUT  /__mock/behavior   修改行为（JSON，字段见 Behavior，未提供的字段保持不变）
+//	POST /__mock/reset      恢复启动时的行为并清空统计
+//	GET  /__mock/stats      请求统计
+//	GET  /__mock/ca.pem     CA 证书
+package mockupstream
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+
+	"zeromaps-utls-proxy/certauth"
+)
+
+// 模拟的域名
+var Hosts = []string{"earth.google.com", "kh.google.com", "www.google.com"}
+
+// 可脚本化的行为
+type Behavior struct {
+	CookieTTLSeconds int      `json:"cookieTTLSeconds"` // 下发的 Cookie 有效期（秒）
+	RequireCookies   bool     `json:"requireCookies"`   // kh.google.com 无有效 Cookie 时返回 403
+	RateLimitNext    int      `json:"rateLimitNext"`    // 接下来 N 个请求返回 429
+	RetryAfter       int      `json:"retryAfter"`       // 429 的 Retry-After（秒，0 = 不带）
+	UnavailableNext  int      `json:"unavailableNext"`  // 接下来 N 个请求返回 503（突发）
+	RedirectNext     int      `json:"redirectNext"`     // 接下来 N 个请求 302 重定向到同一路径
+	Encoding         string   `json:"encoding"`         // 响应压缩：identity / gzip / br
+	DelayMs          int      `json:"delayMs"`          // 每个响应的延迟（毫秒）
+	BodySize         int      `json:"bodySize"`         // kh.google.com 响应体大小（字节）
+	FaultHosts       []string `json:"faultHosts"`       // 故障注入生效的域名（空 = 全部）
+}
+
+// 默认行为：Cookie 1 小时有效，要求 Cookie，不注入故障
+func DefaultBehavior() Behavior {
+	return Behavior{
+		CookieTTLSeconds: 3600,
+		RequireCookies:   true,
+		Encoding:         "identity",
+		BodySize:         1024,
+	}
+}
+
+type Options struct {
+	Addr     string   // 监听地址（如 127.0.0.1:8443，端口 0 = 随机）
+	CADir    string   // CA 证书目录（空 = 仅内存）
+	Behavior Behavior // 初始行为
+}
+
+// 请求统计
+type Stats struct {
+	Requests      int64            `json:"requests"`
+	ByHost        map[string]int64 `json:"byHost"`
+	ByStatus      map[string]int64 `json:"byStatus"`
+	CookiesIssued int64            `json:"cookiesIssued"`
+}
+
+type Server struct {
+	ca       *certauth.CA
+	listener net.Listener
+	server   *http.Server
+	initial  Behavior
+
+	mu       sync.Mutex
+	behavior Behavior
+	cookies  map[string]time.Time // 已下发的 Cookie 值 -> 过期时间
+	stats    Stats
+}
+
+// 创建模拟服务器（加载或生成 CA 并签发证书）
+func New(opts Options) (*Server, error) {
+	ca, err := certauth.LoadOrCreate(opts.CADir, "zeromaps mock upstream CA")
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := ca.Issue(append(slices.Clone(Hosts), "localhost", "127.0.0.1", "::1"))
+	if err != nil {
+		return nil, fmt.Errorf("签发服务器证书失败: %w", err)
+	}
+
+	s := &Server{
+		ca:       ca,
+		initial:  opts.Behavior,
+		behavior: opts.Behavior,
+		cookies:  make(map[string]time.Time),
+	}
+	s.resetStats()
+
+	addr := opts.Addr
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// 与真实 Google 一样同时支持 h2 和 http/1.1
+	s.listener = tls.NewListener(ln, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	})
+	s.server = &http.Server{Handler: s, ReadHeaderTimeout: 10 * time.Second}
+
+	return s, nil
+}
+
+// 在后台开始服务
+func (s *Server) Start() {
+	go s.server.Serve(s.listener)
+}
+
+// 实际监听地址
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// CA 证书（PEM），代理需要信任它
+func (s *Server) CAPEM() []byte {
+	return s.ca.CertPEM()
+}
+
+func (s *Server) Close() error {
+	return s.server.Close()
+}
+
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
+
+func (s *Server) Behavior() Behavior {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.behavior
+}
+
+func (s *Server) SetBehavior(b Behavior) {
+	s.mu.Lock()
+	s.behavior = b
+	s.mu.Unlock()
+}
+
+func (s *Server) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := s.stats
+	out.ByHost = make(map[string]int64, len(s.stats.ByHost))
+	for k, v := range s.stats.ByHost {
+		out.ByHost[k] = v
+	}
+	out.ByStatus = make(map[string]int64, len(s.stats.ByStatus))
+	for k, v := range s.stats.ByStatus {
+		out.ByStatus[k] = v
+	}
+	return out
+}
+
+func (s *Server) resetStats() {
+	s.stats = Stats{ByHost: make(map[string]int64), ByStatus: make(map[string]int64)}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/__mock/") {
+		s.serveControl(w, r)
+		return
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	status := s.serveUpstream(w, r, host)
+
+	s.mu.Lock()
+	s.stats.Requests++
+	s.stats.ByHost[host]++
+	s.stats.ByStatus[strconv.Itoa(status)]++
+	s.mu.Unlock()
+}
+
+// 按当前行为处理上游请求，返回状态码
+func (s *Server) serveUpstream(w http.ResponseWriter, r *http.Request, host string) int {
+	// 取出本次请求要注入的故障（计数类故障各消耗一次）
+	s.mu.Lock()
+	b := s.behavior
+	fault := ""
+	if len(b.FaultHosts) == 0 || slices.Contains(b.FaultHosts, host) {
+		switch {
+		case s.behavior.UnavailableNext > 0:
+			s.behavior.UnavailableNext--
+			fault = "503"
+		case s.behavior.RateLimitNext > 0:
+			s.behavior.RateLimitNext--
+			fault = "429"
+		case s.behavior.RedirectNext > 0 && r.URL.Query().Get("mock_redirected") == "":
+			s.behavior.RedirectNext--
+			fault = "302"
+		}
+	}
+	s.mu.Unlock()
+
+	if b.DelayMs > 0 {
+		select {
+		case <-time.After(time.Duration(b.DelayMs) * time.Millisecond):
+		case <-r.Context().Done():
+			return 499
+		}
+	}
+
+	switch fault {
+	case "503":
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return http.StatusServiceUnavailable
+	case "429":
+		if b.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(b.RetryAfter))
+		}
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		return http.StatusTooManyRequests
+	case "302":
+		target := *r.URL
+		query := target.Query()
+		query.Set("mock_redirected", "1")
+		target.RawQuery = query.Encode()
+		http.Redirect(w, r, target.RequestURI(), http.StatusFound)
+		return http.StatusFound
+	}
+
+	if r.URL.Path == "/echo" {
+		return serveEcho(w, r, b)
+	}
+
+	switch host {
+	case "earth.google.com":
+		return s.serveEarth(w, r, b)
+	case "kh.google.com":
+		return s.serveKeyhole(w, r, b)
+	case "www.google.com", "localhost", "127.0.0.1", "::1":
+		return writeBody(w, r, b, http.StatusOK, "text/html; charset=UTF-8", []byte("<!doctype html><title>Google</title>"))
+	}
+
+	http.NotFound(w, r)
+	return http.StatusNotFound
+}
+
+// earth.google.com：/web/ 下发 Cookie
+func (s *Server) serveEarth(w http.ResponseWriter, r *http.Request, b Behavior) int {
+	if !strings.HasPrefix(r.URL.Path, "/web") {
+		http.NotFound(w, r)
+		return http.StatusNotFound
+	}
+
+	ttl := time.Duration(b.CookieTTLSeconds) * time.Second
+	expires := time.Now().Add(ttl)
+
+	for _, name := range []string{"NID", "1P_JAR"} {
+		value := randomToken()
+		s.mu.Lock()
+		if len(s.cookies) >= 100000 {
+			s.pruneCookies()
+		}
+		s.cookies[value] = expires
+		s.stats.CookiesIssued++
+		s.mu.Unlock()
+
+		cookie := &http.Cookie{
+			Name:     name,
+			Value:    value,
+			Path:     "/",
+			Domain:   ".google.com",
+			Secure:   true,
+			HttpOnly: name == "NID",
+			SameSite: http.SameSiteNoneMode,
+		}
+		if ttl > 0 {
+			cookie.Expires = expires
+		}
+		http.SetCookie(w, cookie)
+	}
+
+	page := []byte("<!doctype html><html><head><title>Google Earth</title></head><body></body></html>")
+	return writeBody(w, r, b, http.StatusOK, "text/html; charset=UTF-8", page)
+}
+
+// 清理已过期的 Cookie（调用方持有锁）
+func (s *Server) pruneCookies() {
+	now := time.Now()
+	for value, expires := range s.cookies {
+		if now.After(expires) {
+			delete(s.cookies, value)
+		}
+	}
+}
+
+// kh.google.com：/rt/earth/... 返回按路径确定的数据
+func (s *Server) serveKeyhole(w http.ResponseWriter, r *http.Request, b Behavior) int {
+	if !strings.HasPrefix(r.URL.Path, "/rt/earth/") {
+		http.NotFound(w, r)
+		return http.StatusNotFound
+	}
+
+	if b.RequireCookies && !s.hasValidCookie(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return http.StatusForbidden
+	}
+
+	etag := PayloadETag(r.URL.Path, b.BodySize)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", payloadModified.Format(http.TimeFormat))
+	if notModified(r, etag) {
+		return writeBody(w, r, b, http.StatusNotModified, "application/octet-stream", nil)
+	}
+
+	return writeBody(w, r, b, http.StatusOK, "application/octet-stream", Payload(r.URL.Path, b.BodySize))
+}
+
+// 模拟数据的最后修改时间（固定值，条件请求可以复现）
+var payloadModified = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Payload 对应的 ETag
+func PayloadETag(path string, size int) string {
+	sum := sha256.Sum256(Payload(path, size))
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// 条件请求是否命中：有 If-None-Match 时只比较 ETag，否则比较 If-Modified-Since（RFC 9110 13.2.2）
+func notModified(r *http.Request, etag string) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !payloadModified.After(since)
+}
+
+func (s *Server) hasValidCookie(r *http.Request) bool {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, cookie := range r.Cookies() {
+		if cookie.Name != "NID" && cookie.Name != "1P_JAR" {
+			continue
+		}
+		if expires, ok := s.cookies[cookie.Value]; ok && now.Before(expires) {
+			return true
+		}
+	}
+	return false
+}
+
+// 按路径生成确定的响应体（测试可据此校验代理返回的数据）
+func Payload(path string, size int) []byte {
+	out := make([]byte, 0, size+sha256.Size)
+	seed := sha256.Sum256([]byte(path))
+	var counter [8]byte
+	for i := uint64(0); len(out) < size; i++ {
+		binary.BigEndian.PutUint64(counter[:], i)
+		block := sha256.Sum256(append(seed[:], counter[:]...))
+		out = append(out, block[:]...)
+	}
+	return out[:size]
+}
+
+// /echo 的响应
+type Echo struct {
+	Method     string      `json:"method"`
+	Host       string      `json:"host"`
+	URI        string      `json:"uri"`
+	Header     http.Header `json:"header"`
+	BodyBytes  int         `json:"bodyBytes"`
+	BodySHA256 string      `json:"bodySha256"`
+}
+
+func serveEcho(w http.ResponseWriter, r *http.Request, b Behavior) int {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return http.StatusBadRequest
+	}
+	sum := sha256.Sum256(body)
+	data, _ := json.Marshal(Echo{
+		Method:     r.Method,
+		Host:       r.Host,
+		URI:        r.RequestURI,
+		Header:     r.Header,
+		BodyBytes:  len(body),
+		BodySHA256: hex.EncodeToString(sum[:]),
+	})
+	return writeBody(w, r, b, http.StatusOK, "application/json", data)
+}
+
+// 按配置压缩并写出响应体
+func writeBody(w http.ResponseWriter, r *http.Request, b Behavior, status int, contentType string, body []byte) int {
+	var buf bytes.Buffer
+	switch b.Encoding {
+	case "gzip":
+		zw := gzip.NewWriter(&buf)
+		zw.Write(body)
+		zw.Close()
+		body = buf.Bytes()
+		w.Header().Set("Content-Encoding", "gzip")
+	case "br":
+		bw := brotli.NewWriter(&buf)
+		bw.Write(body)
+		bw.Close()
+		body = buf.Bytes()
+		w.Header().Set("Content-Encoding", "br")
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	if status == http.StatusNotModified {
+		// 304 没有响应体，Content-Encoding 等表示头保持不变
+		w.WriteHeader(status)
+		return status
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+	return status
+}
+
+func randomToken() string {
+	var b [24]byte
+	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+		binary.BigEndian.PutUint64(b[:], uint64(time.Now().UnixNano()))
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// 控制接口
+func (s *Server) serveControl(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/__mock/behavior":
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			s.mu.Lock()
+			b := s.behavior
+			s.mu.Unlock()
+
+			// 在当前行为上合并，未提供的字段保持不变
+			if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&b); err != nil {
+				http.Error(w, "Invalid behavior: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if b.Encoding != "" && b.Encoding != "identity" && b.Encoding != "gzip" && b.Encoding != "br" {
+				http.Error(w, "Invalid encoding (identity/gzip/br)", http.StatusBadRequest)
+				return
+			}
+			s.SetBehavior(b)
+		default:
+			w.Header().Set("Allow", "GET, PUT, POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, s.Behavior())
+
+	case "/__mock/reset":
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.mu.Lock()
+		s.behavior = s.initial
+		s.cookies = make(map[string]time.Time)
+		s.resetStats()
+		s.mu.Unlock()
+		writeJSON(w, s.Behavior())
+
+	case "/__mock/stats":
+		writeJSON(w, s.Stats())
+
+	case "/__mock/ca.pem":
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		w.Write(s.CAPEM())
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(v)
+}
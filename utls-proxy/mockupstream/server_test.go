@@ -0,0 +1,192 @@
+package mockupstream
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 启动模拟服务器，返回把所有域名都连到它的客户端（带 Cookie jar，不自动解压）
+func startMock(t *testing.T) (*Server, *http.Client) {
+	t.Helper()
+	s, err := New(Options{Behavior: DefaultBehavior()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	t.Cleanup(func() { s.Close() })
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(s.CAPEM())
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	transport := &http.Transport{
+		TLSClientConfig:    &tls.Config{RootCAs: roots},
+		DisableCompression: true,
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, s.Addr())
+		},
+	}
+	t.Cleanup(transport.CloseIdleConnections)
+	jar, _ := cookiejar.New(nil)
+	return s, &http.Client{
+		Transport: transport,
+		Jar:       jar,
+		Timeout:   10 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func get(t *testing.T, client *http.Client, url string) (*http.Response, []byte) {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+// kh.google.com 没有 Cookie 时返回 403；访问 earth.google.com/web/ 取得 Cookie 后返回按路径确定的数据
+func TestCookieFlow(t *testing.T) {
+	s, client := startMock(t)
+	const tile = "https://kh.google.com/rt/earth/NodeData/pb=!1m2!1s0!2u1"
+
+	if resp, _ := get(t, client, tile); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("没有 Cookie: 状态码 %d", resp.StatusCode)
+	}
+
+	resp, _ := get(t, client, "https://earth.google.com/web/")
+	var names []string
+	for _, c := range resp.Cookies() {
+		names = append(names, c.Name)
+	}
+	if strings.Join(names, ",") != "NID,1P_JAR" {
+		t.Errorf("下发的 Cookie: %v", names)
+	}
+
+	resp, body := get(t, client, tile)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, Payload("/rt/earth/NodeData/pb=!1m2!1s0!2u1", 1024)) {
+		t.Errorf("有 Cookie: 状态码 %d，%d 字节", resp.StatusCode, len(body))
+	}
+
+	stats := s.Stats()
+	if stats.Requests != 3 || stats.ByHost["kh.google.com"] != 2 || stats.ByStatus["403"] != 1 || stats.CookiesIssued != 2 {
+		t.Errorf("统计: %+v", stats)
+	}
+}
+
+// 计数类故障按 503 → 429 → 302 的顺序各消耗一次，只作用于 FaultHosts
+func TestFaultInjection(t *testing.T) {
+	s, client := startMock(t)
+	b := s.Behavior()
+	b.RequireCookies = false
+	b.UnavailableNext = 1
+	b.RateLimitNext = 1
+	b.RetryAfter = 7
+	b.RedirectNext = 1
+	b.FaultHosts = []string{"kh.google.com"}
+	s.SetBehavior(b)
+
+	if resp, _ := get(t, client, "https://www.google.com/"); resp.StatusCode != http.StatusOK {
+		t.Errorf("FaultHosts 之外的域名: 状态码 %d", resp.StatusCode)
+	}
+
+	const tile = "https://kh.google.com/rt/earth/NodeData/pb=!1m2!1s0!2u2"
+	resp, _ := get(t, client, tile)
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("第 1 次: 状态码 %d", resp.StatusCode)
+	}
+	resp, _ = get(t, client, tile)
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "7" {
+		t.Errorf("第 2 次: 状态码 %d，Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	resp, _ = get(t, client, tile)
+	if resp.StatusCode != http.StatusFound || !strings.Contains(resp.Header.Get("Location"), "mock_redirected=1") {
+		t.Errorf("第 3 次: 状态码 %d，Location %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if resp, _ = get(t, client, tile); resp.StatusCode != http.StatusOK {
+		t.Errorf("故障用完后: 状态码 %d", resp.StatusCode)
+	}
+}
+
+// gzip 压缩与延迟
+func TestEncodingAndDelay(t *testing.T) {
+	s, client := startMock(t)
+	b := s.Behavior()
+	b.RequireCookies = false
+	b.Encoding = "gzip"
+	b.DelayMs = 50
+	s.SetBehavior(b)
+
+	start := time.Now()
+	resp, body := get(t, client, "https://kh.google.com/rt/earth/BulkMetadata/pb=!1m2!1s!2u3")
+	if time.Since(start) < 50*time.Millisecond {
+		t.Errorf("响应没有延迟: %v", time.Since(start))
+	}
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Content-Encoding %q", resp.Header.Get("Content-Encoding"))
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(zr)
+	if !bytes.Equal(data, Payload("/rt/earth/BulkMetadata/pb=!1m2!1s!2u3", 1024)) {
+		t.Errorf("解压后 %d 字节", len(data))
+	}
+}
+
+// 控制接口：PUT 合并修改行为，无效的压缩方式返回 400，reset 恢复初始行为并清空统计
+func TestControlEndpoints(t *testing.T) {
+	s, client := startMock(t)
+
+	put := func(body string) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPut, "https://kh.google.com/__mock/behavior", strings.NewReader(body))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := put(`{"bodySize": 16}`); code != http.StatusOK {
+		t.Fatalf("PUT: %d", code)
+	}
+	if b := s.Behavior(); b.BodySize != 16 || !b.RequireCookies || b.CookieTTLSeconds != 3600 {
+		t.Errorf("未提供的字段应保持不变: %+v", b)
+	}
+	if code := put(`{"encoding": "zstd"}`); code != http.StatusBadRequest || s.Behavior().Encoding != "identity" {
+		t.Errorf("无效的压缩方式: %d，%q", code, s.Behavior().Encoding)
+	}
+
+	resp, err := client.Post("https://kh.google.com/__mock/reset", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if b := s.Behavior(); b.BodySize != 1024 || s.Stats().Requests != 0 {
+		t.Errorf("reset 后: %+v，%+v", b, s.Stats())
+	}
+
+	resp, body := get(t, client, "https://kh.google.com/__mock/ca.pem")
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, s.CAPEM()) {
+		t.Errorf("ca.pem: 状态码 %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// 浏览器指纹库：默认使用内置的 profiles.json，UTLS_PROFILES_FILE 指定外部文件（格式相同）替换整个指纹库。
+// 增删指纹只需修改文件并重启，无需重新编译。
+//
+// clientHello 使用 uTLS 的 ClientHelloID 名称（ClientHelloID.Str()，如 "Chrome-133"、"Safari-16.0"、"iOS-14"），
+// 启动时在链接的 uTLS 版本中解析，不存在时拒绝启动。请求头按浏览器家族检查：
+//   - Chrome / Edge：必须有 Sec-Ch-Ua 和 Sec-Ch-Ua-Platform，User-Agent 含 Chrome/（Edge 含 Edg/）
+//   - Firefox：不能有 Sec-Ch-Ua，User-Agent 含 Firefox/
+//   - Safari / iOS：不能有 Sec-Ch-Ua，User-Agent 含 Version/ 和 Safari/，不含 Chrome/
+//
+// weight 为分配权重（默认 1），disabled 的指纹不参与分配，也不能被覆盖或提示选中
+
+//go:embed profiles.json
+var builtinProfiles []byte
+
+// 指纹库文件中的一项
+type catalogEntry struct {
+	Name            string   `json:"name"`
+	ClientHello     string   `json:"clientHello"`
+	Weight          *float64 `json:"weight,omitempty"`
+	Disabled        bool     `json:"disabled,omitempty"`
+	UserAgent       string   `json:"userAgent"`
+	SecChUa         string   `json:"secChUa,omitempty"`
+	SecChUaPlatform string   `json:"secChUaPlatform,omitempty"`
+	AcceptLanguage  string   `json:"acceptLanguage"`
+	Accept          string   `json:"accept"`
+}
+
+type profileCatalog struct {
+	source   string         // 文件路径，内置时为 "builtin"
+	entries  []catalogEntry // 包括停用的指纹
+	profiles []BrowserProfile
+}
+
+// 当前指纹库（启动时加载，之后只读）
+var catalog = mustBuiltinCatalog()
+
+func mustBuiltinCatalog() *profileCatalog {
+	c, _, err := parseProfileCatalog(builtinProfiles, "builtin")
+	if err != nil {
+		panic("内置指纹库无效: " + err.Error())
+	}
+	return c
+}
+
+// 加载 UTLS_PROFILES_FILE（为空时使用内置指纹库）
+func initProfileCatalog(file string) error {
+	data, source := builtinProfiles, "builtin"
+	if file != "" {
+		var err error
+		if data, err = os.ReadFile(file); err != nil {
+			return err
+		}
+		source = file
+	}
+
+	c, warnings, err := parseProfileCatalog(data, source)
+	if err != nil {
+		return err
+	}
+	for _, w := range warnings {
+		slog.Warn("指纹库", "source", source, "warning", w)
+	}
+	catalog, browserProfiles = c, c.profiles
+	return nil
+}
+
+// 解析并校验指纹库：返回所有错误（一次列出，便于修改），不影响使用的问题作为警告返回
+func parseProfileCatalog(data []byte, source string) (*profileCatalog, []string, error) {
+	var file struct {
+		Profiles []catalogEntry `json:"profiles"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", source, err)
+	}
+
+	c := &profileCatalog{source: source, entries: file.Profiles}
+	var errs []error
+	var warnings []string
+	seen := make(map[string]string)
+	for i, entry := range file.Profiles {
+		label := entry.Name
+		if label == "" {
+			label = fmt.Sprintf("#%d", i+1)
+		}
+
+		profile, entryWarnings, err := entry.resolve()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", label, err))
+			continue
+		}
+		for _, w := range entryWarnings {
+			warnings = append(warnings, label+": "+w)
+		}
+
+		// 名称按 findBrowserProfile 的规则比较
+		key := profileKey(entry.Name)
+		if other, ok := seen[key]; ok {
+			errs = append(errs, fmt.Errorf("%s: 与 %s 重名", label, other))
+			continue
+		}
+		seen[key] = entry.Name
+
+		if !entry.Disabled {
+			c.profiles = append(c.profiles, profile)
+		}
+	}
+	if len(errs) == 0 && len(c.profiles) == 0 {
+		errs = append(errs, errors.New("没有启用的指纹"))
+	}
+	if len(errs) > 0 {
+		return nil, nil, fmt.Errorf("%s: %w", source, errors.Join(errs...))
+	}
+	return c, warnings, nil
+}
+
+func (e catalogEntry) resolve() (BrowserProfile, []string, error) {
+	if e.Name == "" || e.UserAgent == "" || e.AcceptLanguage == "" || e.Accept == "" {
+		return BrowserProfile{}, nil, errors.New("name、userAgent、acceptLanguage、accept 不能为空")
+	}
+
+	weight := 1.0
+	if e.Weight != nil {
+		weight = *e.Weight
+	}
+	if !(weight > 0) || math.IsInf(weight, 0) {
+		return BrowserProfile{}, nil, fmt.Errorf("weight 必须大于 0（不使用的指纹设置 disabled）: %v", weight)
+	}
+
+	id, err := resolveClientHello(e.ClientHello)
+	if err != nil {
+		return BrowserProfile{}, nil, err
+	}
+	warnings, err := checkProfileHeaders(id, e)
+	if err != nil {
+		return BrowserProfile{}, nil, err
+	}
+
+	return BrowserProfile{
+		Name:            e.Name,
+		UserAgent:       e.UserAgent,
+		SecChUa:         e.SecChUa,
+		SecChUaPlatform: e.SecChUaPlatform,
+		AcceptLanguage:  e.AcceptLanguage,
+		Accept:          e.Accept,
+		ClientHello:     id,
+		Weight:          weight,
+	}, warnings, nil
+}
+
+// 按名称（"Chrome-133"）在链接的 uTLS 版本中查找 ClientHelloID
+func resolveClientHello(name string) (utls.ClientHelloID, error) {
+	i := strings.LastIndex(name, "-")
+	if i <= 0 || i == len(name)-1 {
+		return utls.ClientHelloID{}, fmt.Errorf("无效的 clientHello %q（格式如 Chrome-133）", name)
+	}
+	id := utls.ClientHelloID{Client: name[:i], Version: name[i+1:]}
+
+	// Golang、Custom 和随机指纹不是真实浏览器
+	switch {
+	case id.Client == utls.HelloGolang.Client, id.Client == utls.HelloCustom.Client,
+		strings.HasPrefix(id.Client, utls.HelloRandomized.Client):
+		return utls.ClientHelloID{}, fmt.Errorf("clientHello %s 不是浏览器指纹", name)
+	}
+	if _, err := utls.UTLSIdToSpec(id); err != nil {
+		return utls.ClientHelloID{}, fmt.Errorf("uTLS %s 不支持 clientHello %s", utlsVersion(), name)
+	}
+	return id, nil
+}
+
+// 检查请求头与 ClientHello 的浏览器家族是否一致；版本号不一致只作为警告
+func checkProfileHeaders(id utls.ClientHelloID, e catalogEntry) ([]string, error) {
+	ua := e.UserAgent
+	var uaVersion string // User-Agent 中与 ClientHello 对应的版本
+
+	switch id.Client {
+	case utls.HelloChrome_133.Client, utls.HelloEdge_106.Client:
+		if e.SecChUa == "" || e.SecChUaPlatform == "" {
+			return nil, fmt.Errorf("%s 必须设置 secChUa 和 secChUaPlatform", id.Client)
+		}
+		if !strings.Contains(ua, "Chrome/") {
+			return nil, fmt.Errorf("%s 的 userAgent 应包含 Chrome/", id.Client)
+		}
+		uaVersion = uaToken(ua, "Chrome/")
+		if id.Client == utls.HelloEdge_106.Client {
+			if !strings.Contains(ua, "Edg/") {
+				return nil, errors.New("Edge 的 userAgent 应包含 Edg/")
+			}
+			uaVersion = uaToken(ua, "Edg/")
+		}
+
+	case utls.HelloFirefox_120.Client:
+		if e.SecChUa != "" || e.SecChUaPlatform != "" {
+			return nil, errors.New("Firefox 不发送 Sec-Ch-Ua，secChUa 和 secChUaPlatform 必须为空")
+		}
+		if !strings.Contains(ua, "Firefox/") {
+			return nil, errors.New("Firefox 的 userAgent 应包含 Firefox/")
+		}
+		uaVersion = uaToken(ua, "Firefox/")
+
+	case utls.HelloSafari_16_0.Client, utls.HelloIOS_14.Client:
+		if e.SecChUa != "" || e.SecChUaPlatform != "" {
+			return nil, fmt.Errorf("%s 不发送 Sec-Ch-Ua，secChUa 和 secChUaPlatform 必须为空", id.Client)
+		}
+		if !strings.Contains(ua, "Version/") || !strings.Contains(ua, "Safari/") || strings.Contains(ua, "Chrome/") {
+			return nil, fmt.Errorf("%s 的 userAgent 应包含 Version/ 和 Safari/，且不含 Chrome/", id.Client)
+		}
+		uaVersion = uaToken(ua, "Version/")
+
+	default:
+		// 其他客户端（Android OkHttp、360、QQ 浏览器）不检查请求头
+		return nil, nil
+	}
+
+	if major(uaVersion) != major(id.Version) {
+		return []string{fmt.Sprintf("userAgent 版本 %s 与 clientHello %s 不一致", uaVersion, id.Str())}, nil
+	}
+	return nil, nil
+}
+
+// User-Agent 中 prefix 之后的版本号
+func uaToken(ua, prefix string) string {
+	_, rest, _ := strings.Cut(ua, prefix)
+	if i := strings.IndexByte(rest, ' '); i >= 0 {
+		rest = rest[:i]
+	}
+	return rest
+}
+
+// 主版本号（"16.0" -> "16"，"106" -> "106"）
+func major(version string) string {
+	if i := strings.IndexAny(version, "._"); i >= 0 {
+		return version[:i]
+	}
+	return version
+}
+
+// 链接的 uTLS 版本（来自构建信息）
+func utlsVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == "github.com/refraction-networking/utls" {
+				if dep.Replace != nil {
+					return dep.Replace.Version
+				}
+				return dep.Version
+			}
+		}
+	}
+	return "unknown"
+}
+
+// 指纹库中的一项（/profiles）
+type profileInfo struct {
+	Name            string  `json:"name"`
+	ClientHello     string  `json:"clientHello"`
+	Weight          float64 `json:"weight"`
+	Share           float64 `json:"share"` // 新地址分到该指纹的概率（停用为 0）
+	Disabled        bool    `json:"disabled,omitempty"`
+	Assigned        int64   `json:"assigned"` // 已分配的地址数（累计）
+	UserAgent       string  `json:"userAgent"`
+	SecChUa         string  `json:"secChUa,omitempty"`
+	SecChUaPlatform string  `json:"secChUaPlatform,omitempty"`
+	AcceptLanguage  string  `json:"acceptLanguage"`
+	Accept          string  `json:"accept"`
+}
+
+// GET /profiles：当前指纹库
+func profilesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, errorResponse{Code: codeNotAllowed, Message: "Method not allowed", Status: http.StatusMethodNotAllowed})
+		return
+	}
+
+	c := catalog
+	var total float64
+	for _, profile := range c.profiles {
+		total += profile.Weight
+	}
+
+	list := make([]profileInfo, 0, len(c.entries))
+	for _, entry := range c.entries {
+		info := profileInfo{
+			Name:            entry.Name,
+			ClientHello:     entry.ClientHello,
+			Weight:          1,
+			Disabled:        entry.Disabled,
+			UserAgent:       entry.UserAgent,
+			SecChUa:         entry.SecChUa,
+			SecChUaPlatform: entry.SecChUaPlatform,
+			AcceptLanguage:  entry.AcceptLanguage,
+			Accept:          entry.Accept,
+		}
+		if entry.Weight != nil {
+			info.Weight = *entry.Weight
+		}
+		if !entry.Disabled {
+			info.Share = math.Round(info.Weight/total*10000) / 10000
+		}
+		if count, ok := stats.browserUsage.Load(entry.Name); ok {
+			info.Assigned = count.(*atomic.Int64).Load()
+		}
+		list = append(list, info)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"source":      c.source,
+		"utlsVersion": utlsVersion(),
+		"assignment":  config.profileAssignment,
+		"active":      len(c.profiles),
+		"profiles":    list,
+	})
+}
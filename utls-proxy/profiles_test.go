@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestBuiltinCatalog(t *testing.T) {
+	c, warnings, err := parseProfileCatalog(builtinProfiles, "builtin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) > 0 {
+		t.Errorf("内置指纹库有警告: %v", warnings)
+	}
+	if len(c.profiles) != len(c.entries) {
+		t.Errorf("内置指纹库不应有停用的指纹")
+	}
+}
+
+// 无效的指纹库：每一项的错误都要报告出来
+func TestProfileCatalogValidation(t *testing.T) {
+	const firefoxUA = "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:120.0) Gecko/20100101 Firefox/120.0"
+	const safariUA = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.0 Safari/605.1.15"
+
+	entry := func(name, hello, ua, secChUa, extra string) string {
+		return fmt.Sprintf(`{"name":%q,"clientHello":%q,"userAgent":%q,"secChUa":%q,"secChUaPlatform":%q,"acceptLanguage":"en","accept":"*/*"%s}`,
+			name, hello, ua, secChUa, map[bool]string{true: `"Windows"`}[secChUa != ""], extra)
+	}
+	cases := []struct {
+		name, profiles, want string
+	}{
+		{"Firefox 发送 Sec-Ch-Ua", entry("ff", "Firefox-120", firefoxUA, `"Firefox";v="120"`, ""), "Sec-Ch-Ua"},
+		{"Safari 发送 Sec-Ch-Ua", entry("sf", "Safari-16.0", safariUA, `"Safari";v="16"`, ""), "Sec-Ch-Ua"},
+		{"Chrome 缺少 Sec-Ch-Ua", entry("ch", "Chrome-133", "Mozilla/5.0 Chrome/133.0.0.0 Safari/537.36", "", ""), "secChUa"},
+		{"未知的 ClientHello", entry("x", "Chrome-999", "Mozilla/5.0 Chrome/999.0 Safari/537.36", `"Chrome";v="999"`, ""), "不支持"},
+		{"随机指纹", entry("r", "Randomized-0", firefoxUA, "", ""), "不是浏览器指纹"},
+		{"权重为 0", entry("w", "Firefox-120", firefoxUA, "", `,"weight":0`), "weight"},
+		{"重名", entry("Firefox A", "Firefox-120", firefoxUA, "", "") + "," + entry("firefox-a", "Firefox-120", firefoxUA, "", ""), "重名"},
+		{"全部停用", entry("ff", "Firefox-120", firefoxUA, "", `,"disabled":true`), "没有启用的指纹"},
+		{"未知字段", `{"name":"ff","clientHelo":"Firefox-120"}`, "clientHelo"},
+	}
+	for _, tc := range cases {
+		_, _, err := parseProfileCatalog([]byte(`{"profiles":[`+tc.profiles+`]}`), "test")
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: 错误 %v，应包含 %q", tc.name, err, tc.want)
+		}
+	}
+
+	// User-Agent 版本与 ClientHello 不一致只警告
+	_, warnings, err := parseProfileCatalog([]byte(`{"profiles":[`+entry("ff", "Firefox-105", firefoxUA, "", "")+`]}`), "test")
+	if err != nil || len(warnings) != 1 {
+		t.Errorf("版本不一致: 错误 %v，警告 %v", err, warnings)
+	}
+}
+
+// 加权 rendezvous：分到各指纹的比例与权重成正比
+func TestWeightedRendezvous(t *testing.T) {
+	saved := browserProfiles
+	defer func() { browserProfiles = saved }()
+
+	browserProfiles = []BrowserProfile{{Name: "a", Weight: 1}, {Name: "b", Weight: 3}}
+	counts := make(map[string]int)
+	const n = 8000
+	for i := 0; i < n; i++ {
+		counts[rendezvousProfile(fmt.Sprintf("2001:db8::%x", i)).Name]++
+	}
+	if share := float64(counts["b"]) / n; share < 0.72 || share > 0.78 {
+		t.Errorf("权重 3:1 时 b 的比例为 %.3f", share)
+	}
+}
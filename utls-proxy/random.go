@@ -0,0 +1,40 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// 并发安全的伪随机数（rand.Rand 本身不能被多个 goroutine 同时使用）
+// 设置 UTLS_RANDOM_SEED 后指纹分配和请求头随机化的序列固定，便于在测试中复现
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+// seed 为 0 时使用当前时间
+func newLockedRand(seed int64) *lockedRand {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &lockedRand{r: rand.New(rand.NewSource(seed))}
+}
+
+func (l *lockedRand) Intn(n int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Intn(n)
+}
+
+func (l *lockedRand) Float64() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Float64()
+}
+
+func (l *lockedRand) Float32() float32 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Float32()
+}
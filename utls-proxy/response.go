@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// 返回给调用方的响应格式：
+//   - legacy（默认）：始终 200 + application/octet-stream，上游状态码在 X-Status-Code，
+//     上游响应头全部以 X-Origin-* 返回（现有 Node 客户端依赖这种格式）
+//   - mirror：沿用上游的状态码和响应头，去掉逐跳头、Set-Cookie（Cookie 属于代理维护的会话）
+//     和已失效的 Content-Encoding / Content-Length；正向代理始终使用这种格式
+//
+// 按请求选择：/proxy?...&response=mirror 或请求头 X-Utls-Response: mirror；全局默认值见 UTLS_RESPONSE_MODE
+//
+// 代理自身产生的错误（非上游响应）以 JSON 返回，并带 X-Utls-Error 错误码（见 errors.go）。
+// 重试用尽后仍是错误状态码的上游响应：mirror 模式原样返回上游最后一次的响应，legacy 模式返回 JSON 错误
+
+const (
+	responseLegacy = "legacy"
+	responseMirror = "mirror"
+)
+
+// 逐跳头（RFC 9110 7.6.1），不返回给调用方
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func validResponseMode(mode string) bool {
+	return mode == responseLegacy || mode == responseMirror
+}
+
+// 本次请求的响应格式：请求参数 > 请求头 > 全局配置，正向代理固定为 mirror
+func responseMode(r *http.Request, target proxyTarget) string {
+	if target.forward {
+		return responseMirror
+	}
+	if mode := strings.ToLower(r.URL.Query().Get("response")); validResponseMode(mode) {
+		return mode
+	}
+	if mode := strings.ToLower(r.Header.Get("X-Utls-Response")); validResponseMode(mode) {
+		return mode
+	}
+	return config.responseMode
+}
+
+// 按 Content-Encoding 解压响应体
+func decodeBody(data []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case "gzip":
+		return decompressGzip(data)
+	case "br":
+		return io.ReadAll(brotli.NewReader(bytes.NewReader(data)))
+	case "deflate":
+		// HTTP 的 deflate 是 zlib 格式，少数服务器发送不带 zlib 头的原始 deflate
+		if reader, err := zlib.NewReader(bytes.NewReader(data)); err == nil {
+			defer reader.Close()
+			return io.ReadAll(reader)
+		}
+		reader := flate.NewReader(bytes.NewReader(data))
+		defer reader.Close()
+		return io.ReadAll(reader)
+	}
+	return data, nil
+}
+
+// 按定义没有响应体的响应：HEAD 请求，或 204 / 304（RFC 9110 6.4.1）
+func bodylessResponse(resp *http.Response) bool {
+	if resp.Request != nil && resp.Request.Method == http.MethodHead {
+		return true
+	}
+	return resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified
+}
+
+// mirror 模式：上游的状态码和清理后的响应头
+func writeMirrorResponse(w http.ResponseWriter, resp *http.Response, body []byte, decoded bool) {
+	header := resp.Header.Clone()
+	for _, name := range strings.Split(header.Get("Connection"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			header.Del(name)
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+	header.Del("Set-Cookie")
+	if decoded {
+		header.Del("Content-Encoding")
+	}
+
+	// 没有响应体的响应沿用上游的 Content-Length，其余按实际返回的响应体
+	if !bodylessResponse(resp) {
+		header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	for key, values := range header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	w.Write(body)
+}
+
+// legacy 模式：200 + 上游状态码和响应头放在 X-Status-Code / X-Origin-*
+func writeLegacyResponse(w http.ResponseWriter, resp *http.Response, body []byte) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Status-Code", strconv.Itoa(resp.StatusCode))
+
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add("X-Origin-"+key, value)
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// 重试用尽后的上游 503：mirror 模式原样返回上游的响应，legacy 模式返回 JSON 错误
+func TestMirrorUpstreamFailure(t *testing.T) {
+	mock, proxy := startMockProxy(t)
+	saved := mock.Behavior()
+	defer mock.SetBehavior(saved)
+
+	tile := url.QueryEscape("https://kh.google.com/rt/earth/NodeData/pb=!1m2!1s0!2u39")
+	for _, mode := range []string{responseMirror, responseLegacy} {
+		b := saved
+		b.UnavailableNext = config.maxRetries + 1
+		b.FaultHosts = []string{"kh.google.com"}
+		mock.SetBehavior(b)
+		failed := stats.failedRequests.Load()
+
+		resp, err := http.Get(proxy.URL + "/proxy?response=" + mode + "&url=" + tile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("%s: 状态码 %d", mode, resp.StatusCode)
+		}
+		if stats.failedRequests.Load() != failed+1 {
+			t.Errorf("%s: 应计为一次失败", mode)
+		}
+		code := resp.Header.Get("X-Utls-Error")
+		if mode == responseMirror {
+			if code != "" || !strings.HasPrefix(string(body), "Service Unavailable") || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+				t.Errorf("mirror: X-Utls-Error %q，Content-Type %q，响应体 %q", code, resp.Header.Get("Content-Type"), body)
+			}
+			continue
+		}
+		var e errorResponse
+		if err := json.Unmarshal(body, &e); err != nil || code != codeUpstream5xx || e.UpstreamStatus != http.StatusServiceUnavailable {
+			t.Errorf("legacy: X-Utls-Error %q，响应体 %q", code, body)
+		}
+	}
+
+	// 没有上游响应（无法绑定的地址）：mirror 模式同样返回 JSON 错误
+	resp, err := http.Get(proxy.URL + "/proxy?response=mirror&ipv6=2001:db8::39&url=" + tile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("X-Utls-Error") == "" || resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("传输层失败: 状态码 %d，X-Utls-Error %q", resp.StatusCode, resp.Header.Get("X-Utls-Error"))
+	}
+}
+
+// mirror 模式沿用上游的状态码和响应头，去掉 Set-Cookie（Cookie 属于代理维护的会话）
+func TestMirrorResponseHeaders(t *testing.T) {
+	_, proxy := startMockProxy(t)
+
+	resp, err := http.Get(proxy.URL + "/proxy?response=mirror&url=" + url.QueryEscape("https://earth.google.com/web/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Errorf("状态码 %d，Content-Type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if resp.Header.Get("Set-Cookie") != "" {
+		t.Errorf("不应返回上游的 Set-Cookie: %q", resp.Header.Values("Set-Cookie"))
+	}
+	if !strings.Contains(string(body), "Google Earth") || resp.ContentLength != int64(len(body)) {
+		t.Errorf("响应体 %d 字节，Content-Length %d", len(body), resp.ContentLength)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// systemd 通知（Type=notify）：
+//   - 开始服务后发送 READY=1（交接启动的新进程同时发送 MAINPID）
+//   - 设置了 WatchdogSec 时每隔一半的间隔发送 WATCHDOG=1
+//   - 关闭时发送 STOPPING=1
+//
+// 未设置 NOTIFY_SOCKET 时（PM2 或直接运行）什么都不做
+
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+
+	// "@" 开头为抽象命名空间，net 包会自动转换
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		slog.Warn("sd_notify 失败", "state", state, "error", err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		slog.Warn("sd_notify 失败", "state", state, "error", err)
+	}
+}
+
+// systemd 要求的看门狗间隔（0 = 未启用）
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// 定期发送 WATCHDOG=1；事件循环卡死时 systemd 会重启服务
+func startWatchdog(ctx context.Context) {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	slog.Info("systemd 看门狗已启用", "interval", interval.String())
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sdNotify("WATCHDOG=1")
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// 测试用的 NOTIFY_SOCKET，返回读取下一条通知的函数
+func listenNotify(t *testing.T) func() string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "utls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "notify.sock")
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	return func() string {
+		t.Helper()
+		buf := make([]byte, 256)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	next := listenNotify(t)
+	sdNotify("READY=1")
+	sdNotify("STOPPING=1")
+	if got := next(); got != "READY=1" {
+		t.Errorf("第一条通知 %q", got)
+	}
+	if got := next(); got != "STOPPING=1" {
+		t.Errorf("第二条通知 %q", got)
+	}
+
+	// 未设置 NOTIFY_SOCKET 时什么都不做
+	t.Setenv("NOTIFY_SOCKET", "")
+	sdNotify("READY=1")
+}
+
+// WATCHDOG_PID 不是本进程时不启用看门狗
+func TestWatchdogInterval(t *testing.T) {
+	for _, tc := range []struct {
+		usec, pid string
+		want      time.Duration
+	}{
+		{"", "", 0},
+		{"abc", "", 0},
+		{"0", "", 0},
+		{"2000000", "", 2 * time.Second},
+		{"2000000", strconv.Itoa(os.Getpid()), 2 * time.Second},
+		{"2000000", strconv.Itoa(os.Getpid() + 1), 0},
+	} {
+		t.Setenv("WATCHDOG_USEC", tc.usec)
+		t.Setenv("WATCHDOG_PID", tc.pid)
+		if got := watchdogInterval(); got != tc.want {
+			t.Errorf("WATCHDOG_USEC=%q WATCHDOG_PID=%q: %v，应为 %v", tc.usec, tc.pid, got, tc.want)
+		}
+	}
+}
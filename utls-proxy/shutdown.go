@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 优雅关闭（SIGINT / SIGTERM）：
+//  1. 就绪探针立即返回 503，负载均衡据此摘除流量；等待 UTLS_SHUTDOWN_READY_DELAY_MS，期间照常处理请求
+//     （监听交给新进程后的关闭不等待）
+//  2. server.Shutdown：关闭监听和空闲连接，等待处理中的请求完成（最多 UTLS_SHUTDOWN_TIMEOUT 秒），超时后强制关闭连接；
+//     已接管的 CONNECT 隧道同时按同一截止时间关闭（隧道内处理中的请求完成后断开，新请求返回 503）
+//  3. 停止后台任务，导出剩余的 Span，关闭上游连接，写出状态快照和最终统计
+
+var (
+	draining   atomic.Bool    // 已收到关闭信号（就绪探针返回 503）
+	background sync.WaitGroup // 后台任务（资源清理、并发调整等）
+)
+
+// 启动后台任务，ctx 取消时任务应当返回
+func runBackground(ctx context.Context, task func(context.Context)) {
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		task(ctx)
+	}()
+}
+
+func shutdown(server *http.Server, stopBackground context.CancelFunc) {
+	draining.Store(true)
+	// 交接后主进程已是新进程，不能再通知 systemd 停止；监听仍在服务，也不需要等待摘除流量
+	if !handedOff.Load() {
+		sdNotify("STOPPING=1")
+	}
+	if config.shutdownReadyDelay > 0 && !handedOff.Load() {
+		slog.Info("已标记为未就绪，等待负载均衡摘除流量", "delay", config.shutdownReadyDelay.String())
+		time.Sleep(config.shutdownReadyDelay)
+	}
+
+	// 拒绝新请求（已接管的 CONNECT 隧道），关闭监听并等待活跃请求完成
+	shutdownFlag.Store(true)
+	slog.Info("停止接受新连接，等待活跃请求完成", "active", activeRequests.Load(), "timeout", config.shutdownTimeout.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.shutdownTimeout)
+	defer cancel()
+	if err := drainServers(ctx, server); err != nil {
+		slog.Warn("超时，仍有请求未完成，强制关闭", "active", activeRequests.Load(), "error", err)
+	} else {
+		slog.Info("所有请求已完成")
+	}
+
+	stopBackground()
+	background.Wait()
+
+	// 导出剩余的 Span
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+	shutdownTracing(flushCtx)
+	cancelFlush()
+
+	closeUpstreamClients()
+	writeStateSnapshot()
+
+	slog.Info("服务器已优雅关闭",
+		"uptime", time.Since(stats.startTime).Round(time.Second).String(),
+		"total_requests", stats.totalRequests.Load(),
+		"success", stats.successRequests.Load(),
+		"failed", stats.failedRequests.Load(),
+		"session_refreshes", stats.sessionRefreshCount.Load(),
+		"unfinished", activeRequests.Load())
+}
+
+// 同时关闭服务器和 CONNECT 隧道，等待处理中的请求完成，ctx 截止后强制关闭剩余连接
+func drainServers(ctx context.Context, server *http.Server) error {
+	tunnelErr := make(chan error, 1)
+	go func() {
+		tunnelErr <- tunnels.shutdown(ctx)
+	}()
+
+	err := server.Shutdown(ctx)
+	if err != nil {
+		server.Close()
+	}
+	if terr := <-tunnelErr; err == nil {
+		err = terr
+	}
+	return err
+}
+
+// 断开所有上游连接
+func closeUpstreamClients() {
+	closed := defaultClients.close()
+	ipv6ClientCache.Range(func(key, value interface{}) bool {
+		value.(*http.Client).CloseIdleConnections()
+		closed++
+		return true
+	})
+	slog.Info("上游连接已关闭", "clients", closed)
+}
+
+// 把最终状态（与 /health 相同）写入 UTLS_STATE_FILE，先写临时文件再改名
+func writeStateSnapshot() {
+	if config.stateFile == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(buildHealth(), "", "\t")
+	if err != nil {
+		slog.Error("生成状态快照失败", "error", err)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(config.stateFile), 0755); err != nil {
+		slog.Error("写入状态快照失败", "file", config.stateFile, "error", err)
+		return
+	}
+	tmp := config.stateFile + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		slog.Error("写入状态快照失败", "file", config.stateFile, "error", err)
+		return
+	}
+	if err := os.Rename(tmp, config.stateFile); err != nil {
+		os.Remove(tmp)
+		slog.Error("写入状态快照失败", "file", config.stateFile, "error", err)
+		return
+	}
+	slog.Info("状态快照已写入", "file", config.stateFile)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// 独立的代理服务器（共享的 stressProxy 不能被关闭）
+func startDrainServer(t *testing.T) (*http.Server, string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/proxy", proxyHandler)
+	server := &http.Server{Handler: withForwardProxy(mux)}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return server, "http://" + listener.Addr().String()
+}
+
+// 关闭时在同一截止时间内等待 /proxy 和 CONNECT 隧道内处理中的请求；超时后强制断开
+func TestDrainServers(t *testing.T) {
+	mock, _ := startMockProxy(t)
+	saved := mock.Behavior()
+	defer mock.SetBehavior(saved)
+
+	tile := "https://kh.google.com/rt/earth/NodeData/pb=!1m2!1s0!2u43"
+	for _, tc := range []struct {
+		name    string
+		delayMs int
+		timeout time.Duration
+	}{
+		{"完成", 300, 5 * time.Second},
+		{"超时", 1500, 200 * time.Millisecond},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ca := enableConnect(t)
+			b := saved
+			b.DelayMs = tc.delayMs
+			mock.SetBehavior(b)
+
+			server, base := startDrainServer(t)
+			tunnelClient := forwardClient(t, base, ca)
+			results := make(chan error, 2)
+			get := func(client *http.Client, target string) {
+				resp, err := client.Get(target)
+				if err == nil {
+					_, err = io.ReadAll(resp.Body)
+					resp.Body.Close()
+					if err == nil && resp.StatusCode != http.StatusOK {
+						err = errors.New(resp.Status)
+					}
+				}
+				results <- err
+			}
+			go get(http.DefaultClient, base+"/proxy?url="+url.QueryEscape(tile))
+			go get(tunnelClient, tile)
+			waitFor(t, "请求未开始", func() bool { return activeRequests.Load() >= 2 && connectActive.Load() > 0 })
+
+			ctx, cancel := context.WithTimeout(context.Background(), tc.timeout)
+			defer cancel()
+			start := time.Now()
+			err := drainServers(ctx, server)
+			elapsed := time.Since(start)
+
+			for range 2 {
+				select {
+				case reqErr := <-results:
+					if tc.delayMs < 1000 && reqErr != nil {
+						t.Errorf("处理中的请求未完成: %v", reqErr)
+					}
+					if tc.delayMs >= 1000 && reqErr == nil {
+						t.Error("超时后连接应被强制断开")
+					}
+				case <-time.After(2 * time.Second):
+					t.Fatal("drainServers 返回后请求仍未结束")
+				}
+			}
+
+			if tc.delayMs < 1000 {
+				if err != nil {
+					t.Errorf("drainServers: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, context.DeadlineExceeded) || elapsed > time.Second {
+				t.Errorf("drainServers 应在截止时间返回: %v，耗时 %v", err, elapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 并发压力测试，应在 -race 下运行：
+//
+//	go test -race -run Stress .
+//
+// 代理经 ::1 连接进程内的模拟上游，同时覆盖默认出口、绑定 ::1 的地址客户端、无法绑定的地址（触发熔断）、
+// 批量请求、会话刷新、资源清理、日志写入和 /health
+func TestStressConcurrentRequests(t *testing.T) {
+	mock, proxy := startMockProxy(t)
+
+	const (
+		workers    = 16
+		iterations = 24
+	)
+	tile := "https://kh.google.com/rt/earth/NodeData/pb=!1m2!1s0!2u1"
+	targets := []string{
+		"/proxy?url=" + url.QueryEscape(tile),
+		"/proxy?ipv6=::1&url=" + url.QueryEscape(tile),
+		"/proxy?ipv6=2001:db8::1&url=" + url.QueryEscape(tile), // 本机没有这个地址，连接失败后熔断
+		"/proxy?response=mirror&url=" + url.QueryEscape(tile),
+		"/batch",
+	}
+
+	var (
+		okDefault, okIPv6 atomic.Int64
+		profilesMu        sync.Mutex
+		defaultProfiles   = make(map[string]bool)
+	)
+
+	// 后台同时运行资源清理、/health 和模拟上游的故障注入
+	done := make(chan struct{})
+	var background sync.WaitGroup
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+			cleanupExpiredResources()
+			if resp, err := http.Get(proxy.URL + "/health"); err == nil {
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+			if i%10 == 0 {
+				b := mock.Behavior()
+				b.UnavailableNext = 2
+				mock.SetBehavior(b)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				target := targets[(w+i)%len(targets)]
+
+				var resp *http.Response
+				var err error
+				if target == "/batch" {
+					items := fmt.Sprintf(`[{"url":%q},{"url":%q,"ipv6":"::1"},{"url":"https://evil.example/"}]`, tile, tile)
+					resp, err = http.Post(proxy.URL+target, "application/json", strings.NewReader(items))
+				} else {
+					resp, err = http.Get(proxy.URL + target)
+				}
+				if err != nil {
+					t.Errorf("%s: %v", target, err)
+					return
+				}
+
+				if target == "/batch" {
+					checkBatchResponse(t, resp, 3)
+					continue
+				}
+
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					// mirror 模式下重试用尽的上游错误原样返回，其余错误由代理产生
+					if resp.Header.Get("X-Utls-Error") == "" && !strings.Contains(target, "response=mirror") {
+						t.Errorf("%s: 状态码 %d 没有 X-Utls-Error", target, resp.StatusCode)
+					}
+					continue
+				}
+				switch {
+				case strings.Contains(target, "ipv6=::1"):
+					okIPv6.Add(1)
+				case !strings.Contains(target, "ipv6="):
+					okDefault.Add(1)
+					profilesMu.Lock()
+					defaultProfiles[resp.Header.Get("X-Browser-Profile")] = true
+					profilesMu.Unlock()
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(done)
+	background.Wait()
+
+	if okDefault.Load() == 0 || okIPv6.Load() == 0 {
+		t.Fatalf("成功请求过少：默认出口 %d，::1 %d", okDefault.Load(), okIPv6.Load())
+	}
+	if len(defaultProfiles) != 1 {
+		t.Errorf("默认出口应当使用同一个指纹，实际: %v", defaultProfiles)
+	}
+	if !isCircuitOpen("2001:db8::1") {
+		t.Errorf("无法连接的地址应当已熔断")
+	}
+}
+
+// 批量结果：每一项一行，最后一行是 summary
+func checkBatchResponse(t *testing.T, resp *http.Response, items int) {
+	t.Helper()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("/batch: 状态码 %d", resp.StatusCode)
+		return
+	}
+
+	var results int
+	var summary *batchSummary
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 1<<20), 1<<20)
+	for scanner.Scan() {
+		var record struct {
+			batchResult
+			Summary *batchSummary `json:"summary"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Errorf("/batch: 无效的记录 %q: %v", scanner.Text(), err)
+			return
+		}
+		if record.Summary != nil {
+			summary = record.Summary
+			continue
+		}
+		results++
+	}
+
+	if summary == nil || results != items || summary.Items != items || summary.Succeeded+summary.Failed != items {
+		t.Errorf("/batch: 结果 %d 项，summary %+v", results, summary)
+	}
+}
+
+// 固定种子时指纹分配和请求头随机化可以复现
+func TestRandomSeedReproducible(t *testing.T) {
+	startMockProxy(t)
+
+	// random 策略下指纹分配同样依赖随机数
+	config.profileAssignment = assignRandom
+	defer func() { config.profileAssignment = assignHash }()
+
+	addrs := []string{"2001:db8::10", "2001:db8::11", "2001:db8::12", "2001:db8::13", "2001:db8::14"}
+	run := func() []string {
+		rng = newLockedRand(42)
+		for _, addr := range addrs {
+			browserProfileMap.Delete(addr)
+		}
+
+		var out []string
+		for _, addr := range addrs {
+			profile := getBrowserProfileForIPv6(addr)
+			req, _ := http.NewRequest(http.MethodGet, "https://kh.google.com/", nil)
+			setHeaders(req, profile, false)
+			out = append(out, profile.Name+"|"+req.Header.Get("DNT"))
+		}
+		return out
+	}
+
+	first, second := run(), run()
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("相同种子的结果不同:\n%v\n%v", first, second)
+		}
+	}
+}
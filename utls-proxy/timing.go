@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 请求各阶段耗时
+type timingPhase int
+
+const (
+	phaseQueue   timingPhase = iota // 并发控制排队
+	phaseSession                    // 会话刷新（refreshSession）
+	phaseDNS                        // DNS 解析
+	phaseConnect                    // TCP 连接（绑定 IPv6）
+	phaseTLS                        // uTLS 握手
+	phaseTTFB                       // 拿到连接到收到首字节
+	phaseBackoff                    // 重试等待
+	phaseBody                       // 读取并解压响应体
+	phaseTotal                      // 总耗时
+	numTimingPhases
+)
+
+var timingPhaseNames = [numTimingPhases]string{
+	"queue", "session", "dns", "connect", "tls", "ttfb", "backoff", "body", "total",
+}
+
+func (p timingPhase) String() string {
+	return timingPhaseNames[p]
+}
+
+// 单个请求的耗时明细（多次重试累加）
+type requestTiming struct {
+	start time.Time
+
+	mu         sync.Mutex
+	phases     [numTimingPhases]time.Duration
+	connReused int // 复用已有连接的次数
+	connNew    int // 新建连接的次数
+	tlsResumed int // 新建连接中恢复 TLS 会话（未做完整握手）的次数
+}
+
+func newRequestTiming() *requestTiming {
+	return &requestTiming{start: time.Now()}
+}
+
+func (t *requestTiming) add(phase timingPhase, d time.Duration) {
+	t.mu.Lock()
+	t.phases[phase] += d
+	t.mu.Unlock()
+}
+
+// 计时执行 fn，并把耗时计入指定阶段
+func (t *requestTiming) measure(phase timingPhase, fn func()) {
+	start := time.Now()
+	fn()
+	t.add(phase, time.Since(start))
+}
+
+// 重试前的退避等待（计入 backoff 阶段）
+func (t *requestTiming) sleep(d time.Duration) {
+	time.Sleep(d)
+	t.add(phaseBackoff, d)
+}
+
+// 记录阶段开始时间
+func (t *requestTiming) mark(ts *time.Time) {
+	t.mu.Lock()
+	*ts = time.Now()
+	t.mu.Unlock()
+}
+
+// 把从 ts 到现在的耗时计入阶段（ts 未记录时忽略）
+func (t *requestTiming) addSince(phase timingPhase, ts *time.Time) {
+	t.mu.Lock()
+	if !ts.IsZero() {
+		t.phases[phase] += time.Since(*ts)
+	}
+	t.mu.Unlock()
+}
+
+// 为一次上游请求挂载 httptrace
+// 回调可能在拨号 goroutine 中与请求并行执行，开始时间和统计一样由 t.mu 保护
+func (t *requestTiming) withTrace(ctx context.Context) context.Context {
+	var dnsStart, connectStart, tlsStart, gotConn time.Time
+
+	trace := &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { t.mark(&dnsStart) },
+		DNSDone:           func(httptrace.DNSDoneInfo) { t.addSince(phaseDNS, &dnsStart) },
+		ConnectStart:      func(network, addr string) { t.mark(&connectStart) },
+		ConnectDone:       func(network, addr string, err error) { t.addSince(phaseConnect, &connectStart) },
+		TLSHandshakeStart: func() { t.mark(&tlsStart) },
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			t.addSince(phaseTLS, &tlsStart)
+			if err == nil && state.DidResume {
+				t.mu.Lock()
+				t.tlsResumed++
+				t.mu.Unlock()
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			gotConn = time.Now()
+			if info.Reused {
+				t.connReused++
+			} else {
+				t.connNew++
+			}
+			t.mu.Unlock()
+		},
+		GotFirstResponseByte: func() { t.addSince(phaseTTFB, &gotConn) },
+	}
+
+	return httptrace.WithClientTrace(ctx, trace)
+}
+
+// 生成 Server-Timing 响应头
+func (t *requestTiming) serverTiming() string {
+	t.mu.Lock()
+	phases := t.phases
+	reused, fresh, resumed := t.connReused, t.connNew, t.tlsResumed
+	t.mu.Unlock()
+	phases[phaseTotal] = time.Since(t.start)
+
+	parts := make([]string, 0, numTimingPhases+1)
+	for i := timingPhase(0); i < numTimingPhases; i++ {
+		parts = append(parts, fmt.Sprintf("%s;dur=%.1f", i, float64(phases[i].Microseconds())/1000))
+	}
+	parts = append(parts, fmt.Sprintf(`conn;desc="reused=%d new=%d resumed=%d"`, reused, fresh, resumed))
+
+	return strings.Join(parts, ", ")
+}
+
+// 请求结束：记录各阶段耗时直方图
+func (t *requestTiming) observe() {
+	t.mu.Lock()
+	phases := t.phases
+	reused, fresh := t.connReused, t.connNew
+	t.mu.Unlock()
+	phases[phaseTotal] = time.Since(t.start)
+
+	for i := timingPhase(0); i < numTimingPhases; i++ {
+		timingHistograms[i].observe(phases[i])
+	}
+	connReusedCount.Add(int64(reused))
+	connNewCount.Add(int64(fresh))
+}
+
+// 写响应头前自动附加 Server-Timing，并记录状态码和字节数（用于访问日志）
+type timingResponseWriter struct {
+	http.ResponseWriter
+	timing      *requestTiming
+	wroteHeader bool
+	status      int   // 返回给调用方的状态码
+	bytes       int64 // 返回给调用方的字节数
+}
+
+func (w *timingResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.status = code
+		w.Header().Set("Server-Timing", w.timing.serverTiming())
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *timingResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// 流式输出时先写出响应头（带上 Server-Timing），再刷新底层连接
+func (w *timingResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// 供 http.ResponseController 访问底层连接（写超时、Hijack 等）
+func (w *timingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// 耗时直方图（毫秒桶）
+var latencyBucketsMs = []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+type latencyHistogram struct {
+	buckets []atomic.Int64 // len(latencyBucketsMs)+1，最后一个为 +Inf
+	count   atomic.Int64
+	sumUs   atomic.Int64
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{buckets: make([]atomic.Int64, len(latencyBucketsMs)+1)}
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	ms := float64(d) / float64(time.Millisecond)
+	i := 0
+	for i < len(latencyBucketsMs) && ms > latencyBucketsMs[i] {
+		i++
+	}
+	h.buckets[i].Add(1)
+	h.count.Add(1)
+	h.sumUs.Add(d.Microseconds())
+}
+
+type histogramSnapshot struct {
+	Count   int64            `json:"count"`
+	AvgMs   float64          `json:"avgMs"`
+	Buckets map[string]int64 `json:"buckets"` // 桶上限（ms）-> 累计计数
+}
+
+func (h *latencyHistogram) snapshot() histogramSnapshot {
+	s := histogramSnapshot{
+		Count:   h.count.Load(),
+		Buckets: make(map[string]int64, len(h.buckets)),
+	}
+	if s.Count > 0 {
+		s.AvgMs = float64(h.sumUs.Load()) / float64(s.Count) / 1000
+	}
+
+	var cumulative int64
+	for i := range h.buckets {
+		cumulative += h.buckets[i].Load()
+		le := "+Inf"
+		if i < len(latencyBucketsMs) {
+			le = fmt.Sprintf("%g", latencyBucketsMs[i])
+		}
+		s.Buckets[le] = cumulative
+	}
+	return s
+}
+
+var (
+	timingHistograms [numTimingPhases]*latencyHistogram
+	connReusedCount  atomic.Int64 // 复用连接次数
+	connNewCount     atomic.Int64 // 新建连接次数
+)
+
+func init() {
+	for i := range timingHistograms {
+		timingHistograms[i] = newLatencyHistogram()
+	}
+}
+
+// 耗时统计（用于 /health）
+type timingStats struct {
+	ConnReused int64                        `json:"connReused"`
+	ConnNew    int64                        `json:"connNew"`
+	Phases     map[string]histogramSnapshot `json:"phases"`
+}
+
+func timingSnapshot() timingStats {
+	s := timingStats{
+		ConnReused: connReusedCount.Load(),
+		ConnNew:    connNewCount.Load(),
+		Phases:     make(map[string]histogramSnapshot, numTimingPhases),
+	}
+	for i := timingPhase(0); i < numTimingPhases; i++ {
+		s.Phases[i.String()] = timingHistograms[i].snapshot()
+	}
+	return s
+}
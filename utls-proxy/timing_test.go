@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// 同一个 requestTiming 的 httptrace 回调与 Server-Timing 读取并发执行，应在 -race 下运行：
+//
+//	go test -race -run Timing .
+func TestRequestTimingConcurrent(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	// 每个请求新建连接：DNS、TCP、TLS 回调都会触发
+	transport := server.Client().Transport.(*http.Transport).Clone()
+	transport.DisableKeepAlives = true
+	transport.TLSClientConfig.ServerName = "example.com" // httptest 的证书
+	client := &http.Client{Transport: transport}
+	target := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+
+	timing := newRequestTiming()
+	ctx := timing.withTrace(context.Background())
+
+	const requests = 16
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				timing.serverTiming()
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	timing.mu.Lock()
+	defer timing.mu.Unlock()
+	if timing.connNew != requests || timing.connReused != 0 {
+		t.Errorf("新建连接 %d，复用 %d，应为 %d / 0", timing.connNew, timing.connReused, requests)
+	}
+	for _, phase := range []timingPhase{phaseConnect, phaseTLS, phaseTTFB} {
+		if timing.phases[phase] <= 0 {
+			t.Errorf("%s 阶段没有记录耗时", phase)
+		}
+	}
+}
+
+// 实际的上游拨号路径（upstreamDialer + uTLS 握手 + HTTP/2）：新连接上报 connect / tls / ttfb，复用的连接只有 ttfb
+func TestDialUTLSTiming(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	savedRoots, savedOverrides := upstreamRootCAs, hostOverrides
+	upstreamRootCAs = roots
+	hostOverrides = map[string]string{"example.com:443": server.Listener.Addr().String()}
+	defer func() { upstreamRootCAs, hostOverrides = savedRoots, savedOverrides }()
+
+	profile := BrowserProfile{Name: "Chrome", ClientHello: utls.HelloChrome_Auto}
+	client := newUTLSClient(newUpstreamDialer(nil), profile)
+	defer client.CloseIdleConnections()
+
+	for i, reused := range []bool{false, true} {
+		timing := newRequestTiming()
+		req, _ := http.NewRequestWithContext(timing.withTrace(context.Background()), http.MethodGet, "https://example.com/", nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.ProtoMajor != 2 {
+			t.Errorf("协议 %s，应为 HTTP/2", resp.Proto)
+		}
+
+		timing.mu.Lock()
+		phases, connNew, connReused := timing.phases, timing.connNew, timing.connReused
+		timing.mu.Unlock()
+		if reused {
+			if connReused != 1 || connNew != 0 || phases[phaseConnect] != 0 || phases[phaseTLS] != 0 {
+				t.Errorf("第 %d 次: 复用 %d，新建 %d，connect %v，tls %v", i+1, connReused, connNew, phases[phaseConnect], phases[phaseTLS])
+			}
+		} else if connNew != 1 || phases[phaseConnect] <= 0 || phases[phaseTLS] <= 0 {
+			t.Errorf("第 %d 次: 新建 %d，connect %v，tls %v", i+1, connNew, phases[phaseConnect], phases[phaseTLS])
+		}
+		if phases[phaseTTFB] <= 0 {
+			t.Errorf("第 %d 次: ttfb 没有记录耗时", i+1)
+		}
+	}
+}
+
+// 包装后的 ResponseWriter 仍支持 http.ResponseController（写超时、Flush），Flush 前先写出 Server-Timing
+func TestTimingResponseWriterController(t *testing.T) {
+	errs := make(chan error, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tw := &timingResponseWriter{ResponseWriter: w, timing: newRequestTiming()}
+		rc := http.NewResponseController(tw)
+		errs <- rc.SetWriteDeadline(time.Now().Add(time.Minute))
+		errs <- rc.Flush()
+		tw.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	for _, what := range []string{"SetWriteDeadline", "Flush"} {
+		if err := <-errs; err != nil {
+			t.Errorf("%s: %v", what, err)
+		}
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Server-Timing") == "" {
+		t.Errorf("状态码 %d，Server-Timing %q", resp.StatusCode, resp.Header.Get("Server-Timing"))
+	}
+}
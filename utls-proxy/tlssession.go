@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// TLS 会话复用（UTLS_TLS_SESSION_CACHE > 0 时启用）：
+//   - 每个客户端（即每个出口地址 + 指纹）有独立的有界 LRU 会话缓存，只复用自己的会话；
+//     客户端因指纹变更或资源清理重建时缓存随之丢弃
+//   - uTLS 的浏览器指纹不带 pre_shared_key 扩展，无法复用 TLS 1.3 会话：
+//     对恢复会话时会发送该扩展的浏览器（pskResumingClients），启用时在指纹末尾追加（与真实浏览器一致），
+//     没有可用会话时不发送（OmitEmptyPsk），首次握手的 ClientHello 与未启用时相同（见 verify.go 的 golden 比较）；
+//     其他指纹（QQ、360、Android 等）不追加也不复用会话，指纹本身带该扩展（*_PSK）时按原样复用
+//
+// 完整握手和恢复会话的次数见 /health 的 tlsSessions 字段，单个请求的情况见 Server-Timing 的 conn
+
+// 恢复 TLS 1.3 会话时在 ClientHello 末尾发送 pre_shared_key 的浏览器（ClientHelloID.Client）
+var pskResumingClients = map[string]bool{
+	utls.HelloChrome_133.Client:  true,
+	utls.HelloEdge_106.Client:    true,
+	utls.HelloFirefox_120.Client: true,
+	utls.HelloSafari_16_0.Client: true,
+	utls.HelloIOS_14.Client:      true,
+}
+
+var (
+	tlsFullHandshakes    atomic.Int64 // 完整握手次数
+	tlsResumedHandshakes atomic.Int64 // 恢复会话的握手次数
+)
+
+// 为一个客户端创建会话缓存（未启用时返回 nil）
+func newTLSSessionCache() utls.ClientSessionCache {
+	if config.tlsSessionCache <= 0 {
+		return nil
+	}
+	return utls.NewLRUClientSessionCache(config.tlsSessionCache)
+}
+
+// 按指纹创建 uTLS 连接；sessions 不为 nil 时可以恢复其中的会话
+func newUConn(conn net.Conn, tlsConfig *utls.Config, hello utls.ClientHelloID, sessions utls.ClientSessionCache) (*utls.UConn, error) {
+	if sessions == nil {
+		return utls.UClient(conn, tlsConfig, hello), nil
+	}
+
+	// 每个连接生成新的 spec（Chrome 的扩展顺序在这里随机打乱）
+	spec, err := utls.UTLSIdToSpec(hello)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case hasExtension[utls.PreSharedKeyExtension](spec):
+		// 指纹自带 pre_shared_key
+	case !pskResumingClients[hello.Client]:
+		// 无法确认真实浏览器会发送该扩展，不复用会话，保持原样的 ClientHello
+		return utls.UClient(conn, tlsConfig, hello), nil
+	case hasExtension[*utls.PSKKeyExchangeModesExtension](spec):
+		// 有 psk_key_exchange_modes 说明支持 TLS 1.3；pre_shared_key 必须是最后一个扩展
+		spec.Extensions = append(spec.Extensions, &utls.UtlsPreSharedKeyExtension{})
+	}
+
+	tlsConfig.ClientSessionCache = sessions
+	tlsConfig.OmitEmptyPsk = true
+	tlsConfig.PreferSkipResumptionOnNilExtension = true // 指纹不支持时放弃复用，而不是 panic
+
+	uconn := utls.UClient(conn, tlsConfig, utls.HelloCustom)
+	if err := uconn.ApplyPreset(&spec); err != nil {
+		return nil, err
+	}
+	return uconn, nil
+}
+
+func hasExtension[T any](spec utls.ClientHelloSpec) bool {
+	for _, ext := range spec.Extensions {
+		if _, ok := ext.(T); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func recordHandshake(resumed bool) {
+	if resumed {
+		tlsResumedHandshakes.Add(1)
+	} else {
+		tlsFullHandshakes.Add(1)
+	}
+}
+
+// 会话复用统计（用于 /health）
+type tlsSessionStats struct {
+	CacheSize  int     `json:"cacheSize"` // 每个客户端的会话缓存大小（0 = 未启用）
+	Full       int64   `json:"fullHandshakes"`
+	Resumed    int64   `json:"resumedHandshakes"`
+	ResumeRate float64 `json:"resumeRate"`
+}
+
+func tlsSessionSnapshot() tlsSessionStats {
+	s := tlsSessionStats{
+		CacheSize: config.tlsSessionCache,
+		Full:      tlsFullHandshakes.Load(),
+		Resumed:   tlsResumedHandshakes.Load(),
+	}
+	if total := s.Full + s.Resumed; total > 0 {
+		s.ResumeRate = float64(s.Resumed) / float64(total)
+	}
+	return s
+}
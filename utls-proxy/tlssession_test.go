@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+
+	"zeromaps-utls-proxy/certauth"
+)
+
+const (
+	extensionPadding      uint16 = 21
+	extensionPreSharedKey uint16 = 41
+)
+
+// 启用会话缓存后：首次握手的 ClientHello 仍与 golden 一致，之后的握手恢复同一个缓存里的会话，
+// 恢复时的 ClientHello 只在末尾多出 pre_shared_key；其他客户端的缓存不受影响
+func TestTLSSessionResumption(t *testing.T) {
+	saved := config.tlsSessionCache
+	config.tlsSessionCache = 8
+	defer func() { config.tlsSessionCache = saved }()
+
+	golden, source, err := loadGolden("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	profiles := mustBuiltinCatalog().profiles
+	for _, result := range verifyProfiles(profiles, golden, source).Results {
+		if result.Status != "ok" {
+			t.Errorf("%s: %s %s\n\t%s", result.Profile, result.Status, result.Error, strings.Join(result.Diff, "\n\t"))
+		}
+	}
+
+	const serverName = "kh.google.com"
+	ca, err := certauth.LoadOrCreate("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := ca.Issue([]string{serverName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		serverConfig := &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2", "http/1.1"}}
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				rec := &recordingConn{Conn: conn}
+				server := tls.Server(rec, serverConfig)
+				server.SetDeadline(time.Now().Add(5 * time.Second))
+				// 握手后写一个字节：客户端读到它之前会先处理会话票据
+				if server.Handshake() == nil {
+					server.Write([]byte{0})
+				}
+				server.Close()
+				received <- rec.bytes()
+			}()
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.CertPEM())
+	handshake := func(profile BrowserProfile, sessions utls.ClientSessionCache) (bool, []uint16) {
+		t.Helper()
+		conn, err := net.DialTimeout("tcp", ln.Addr().String(), 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tlsConfig := upstreamTLSConfig(serverName)
+		tlsConfig.RootCAs = roots
+		client, err := newUConn(conn, tlsConfig, profile.ClientHello, sessions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		if err := client.Handshake(); err != nil {
+			t.Fatalf("%s: %v", profile.Name, err)
+		}
+		client.Read(make([]byte, 1))
+		resumed := client.ConnectionState().DidResume
+		client.Close()
+
+		hello, err := parseClientHello(<-received)
+		if err != nil {
+			t.Fatalf("%s: %v", profile.Name, err)
+		}
+		return resumed, hello.extensions
+	}
+
+	goldenExtensions := make(map[string][]string)
+	for _, fp := range golden.Profiles {
+		goldenExtensions[fp.Profile] = fp.Extensions
+	}
+	// 扩展集合（部分指纹每个连接打乱顺序），GREASE 的值每个连接不同
+	extensionSet := func(exts []uint16) []string {
+		return slices.Sorted(slices.Values(names(withoutGREASE(exts), extensionName)))
+	}
+	pskName := extensionName(extensionPreSharedKey)
+
+	for _, profile := range profiles {
+		sessions := newTLSSessionCache()
+		resumed, first := handshake(profile, sessions)
+		if resumed {
+			t.Errorf("%s: 空缓存不应恢复会话", profile.Name)
+		}
+		want := slices.DeleteFunc(slices.Clone(goldenExtensions[profile.Name]), func(name string) bool { return name == "GREASE" })
+		slices.Sort(want)
+		if got := extensionSet(first); !slices.Equal(got, want) {
+			t.Errorf("%s: 首次握手的扩展与 golden 不一致\n\tgot  %v\n\twant %v", profile.Name, got, want)
+		}
+
+		resumed, second := handshake(profile, sessions)
+		if !resumed {
+			t.Errorf("%s: 第二次握手没有恢复会话", profile.Name)
+		}
+		// padding 按 ClientHello 长度决定是否发送，带上 pre_shared_key 后可能不再需要
+		withoutPadding := func(exts []uint16) []string {
+			return extensionSet(slices.DeleteFunc(slices.Clone(exts), func(v uint16) bool { return v == extensionPadding }))
+		}
+		want = withoutPadding(append(slices.Clone(first), extensionPreSharedKey))
+		if got := withoutPadding(second); !slices.Equal(got, want) || second[len(second)-1] != extensionPreSharedKey {
+			t.Errorf("%s: 恢复会话的扩展应只在末尾多出 %s\n\tgot  %v\n\twant %v", profile.Name, pskName, names(second, extensionName), want)
+		}
+
+		if resumed, _ := handshake(profile, newTLSSessionCache()); resumed {
+			t.Errorf("%s: 恢复了其他客户端缓存的会话", profile.Name)
+		}
+	}
+
+	// 恢复会话时不发送 pre_shared_key 的指纹：不追加扩展，也不复用会话
+	qq := BrowserProfile{Name: "QQ 11.1", ClientHello: utls.HelloQQ_11_1}
+	sessions := newTLSSessionCache()
+	for range 2 {
+		if resumed, exts := handshake(qq, sessions); resumed || slices.Contains(exts, extensionPreSharedKey) {
+			t.Errorf("%s: 不应复用会话（恢复 %v，扩展 %v）", qq.Name, resumed, names(exts, extensionName))
+		}
+	}
+
+	// 未启用时不复用会话
+	config.tlsSessionCache = 0
+	sessions = newTLSSessionCache()
+	if sessions != nil {
+		t.Fatal("未启用时不应创建会话缓存")
+	}
+	for range 2 {
+		if resumed, _ := handshake(profiles[0], sessions); resumed {
+			t.Error("未启用会话缓存时恢复了会话")
+		}
+	}
+}
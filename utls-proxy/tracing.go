@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 轻量级 OpenTelemetry 兼容追踪：
+// 解析 W3C traceparent，按父级/比例采样，以 OTLP/HTTP JSON 批量导出
+
+// Span 类型（与 OTLP SpanKind 数值一致）
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// Span 状态（与 OTLP StatusCode 数值一致）
+const (
+	spanStatusOK    = 1
+	spanStatusError = 2
+)
+
+type spanAttr struct {
+	key   string
+	value interface{} // string / int64 / bool
+}
+
+// 追踪 Span（nil 表示未采样，所有方法均可安全调用）
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+
+	mu         sync.Mutex
+	end        time.Time
+	attrs      []spanAttr
+	statusCode int
+	statusMsg  string
+	ended      bool
+}
+
+type spanContextKey struct{}
+
+// 从 context 获取当前 Span
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanContextKey{}).(*span)
+	return s
+}
+
+// 开始一个子 Span；父 Span 不存在（未采样或未开启追踪）时返回 nil
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	parent := spanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+
+	s := &span{
+		traceID:  parent.traceID,
+		parentID: parent.spanID,
+		name:     name,
+		kind:     kind,
+		start:    time.Now(),
+	}
+	randomBytes(s.spanID[:])
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+// 开始请求的根 Span：有 traceparent 时沿用上游的 trace，否则按比例采样新建 trace
+func startServerSpan(r *http.Request, name string) (context.Context, *span) {
+	ctx := r.Context()
+	if !config.tracingEnabled {
+		return ctx, nil
+	}
+
+	s := &span{name: name, kind: spanKindServer, start: time.Now()}
+
+	if traceID, parentID, sampled, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		if !sampled {
+			return ctx, nil
+		}
+		s.traceID = traceID
+		s.parentID = parentID
+	} else {
+		randomBytes(s.traceID[:])
+		if !sampleTrace(s.traceID) {
+			return ctx, nil
+		}
+	}
+
+	randomBytes(s.spanID[:])
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+// 解析 W3C traceparent：00-<trace-id>-<parent-id>-<flags>
+func parseTraceparent(header string) (traceID [16]byte, parentID [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil {
+		return
+	}
+	if traceID == [16]byte{} || parentID == [8]byte{} {
+		return
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return
+	}
+	return traceID, parentID, flags&0x01 == 1, true
+}
+
+// 按 trace-id 做比例采样（同一 trace 的决定稳定）
+func sampleTrace(traceID [16]byte) bool {
+	ratio := config.traceSampleRatio
+	if ratio >= 1 {
+		return true
+	}
+	if ratio <= 0 {
+		return false
+	}
+	bound := uint64(ratio * math.MaxUint64)
+	return binary.BigEndian.Uint64(traceID[8:]) < bound
+}
+
+func randomBytes(b []byte) {
+	if _, err := crand.Read(b); err != nil {
+		binary.BigEndian.PutUint64(b[len(b)-8:], uint64(time.Now().UnixNano()))
+	}
+}
+
+func (s *span) setAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	switch v := value.(type) {
+	case int:
+		value = int64(v)
+	case time.Duration:
+		value = v.Milliseconds()
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, spanAttr{key: key, value: value})
+	s.mu.Unlock()
+}
+
+// 标记错误：error.type 属性 + ERROR 状态
+func (s *span) setError(class string, err error) {
+	if s == nil {
+		return
+	}
+	s.setAttr("error.type", class)
+	s.mu.Lock()
+	s.statusCode = spanStatusError
+	if err != nil {
+		s.statusMsg = err.Error()
+	} else {
+		s.statusMsg = class
+	}
+	s.mu.Unlock()
+}
+
+func (s *span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	if s.statusCode == 0 {
+		s.statusCode = spanStatusOK
+	}
+	s.mu.Unlock()
+
+	tracer.enqueue(s)
+}
+
+// ========== OTLP/HTTP JSON 导出 ==========
+
+type spanExporter struct {
+	queue   chan *span
+	done    chan struct{}
+	stopped chan struct{}
+	client  *http.Client
+	started atomic.Bool
+
+	exported atomic.Int64
+	dropped  atomic.Int64
+	failed   atomic.Int64
+}
+
+var tracer = newSpanExporter()
+
+func newSpanExporter() *spanExporter {
+	return &spanExporter{
+		queue:   make(chan *span, 4096),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+const traceExportBatchSize = 512
+
+// 启动后台导出任务
+func startTracing() {
+	if !config.tracingEnabled {
+		return
+	}
+	tracer.started.Store(true)
+	go tracer.run()
+	slog.Info("链路追踪已启用", "endpoint", config.otlpEndpoint, "sample_ratio", config.traceSampleRatio)
+}
+
+// 导出剩余 Span 并停止
+func shutdownTracing(ctx context.Context) {
+	if !tracer.started.Load() {
+		return
+	}
+	close(tracer.done)
+	select {
+	case <-tracer.stopped:
+	case <-ctx.Done():
+	}
+}
+
+func (e *spanExporter) enqueue(s *span) {
+	select {
+	case e.queue <- s:
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+func (e *spanExporter) run() {
+	defer close(e.stopped)
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	batch := make([]*span, 0, traceExportBatchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			e.export(batch)
+			batch = batch[:0]
+		}
+	}
+
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) >= traceExportBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-e.done:
+			for {
+				select {
+				case s := <-e.queue:
+					batch = append(batch, s)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *spanExporter) export(batch []*span) {
+	body, err := json.Marshal(buildOTLPRequest(batch))
+	if err != nil {
+		e.failed.Add(int64(len(batch)))
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, config.otlpEndpoint, bytes.NewReader(body))
+	if err != nil {
+		e.failed.Add(int64(len(batch)))
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		e.failed.Add(int64(len(batch)))
+		slog.Warn("导出 Span 失败", "spans", len(batch), "error", err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		e.failed.Add(int64(len(batch)))
+		slog.Warn("导出 Span 失败", "spans", len(batch), "status", resp.StatusCode)
+		return
+	}
+	e.exported.Add(int64(len(batch)))
+}
+
+// OTLP JSON 编码（字段名遵循 opentelemetry-proto 的 JSON 映射）
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string                 `json:"traceId"`
+	SpanID            string                 `json:"spanId"`
+	ParentSpanID      string                 `json:"parentSpanId,omitempty"`
+	Name              string                 `json:"name"`
+	Kind              int                    `json:"kind"`
+	StartTimeUnixNano string                 `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string                 `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue         `json:"attributes,omitempty"`
+	Status            map[string]interface{} `json:"status"`
+}
+
+func otlpValue(v interface{}) map[string]interface{} {
+	switch val := v.(type) {
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(val, 10)}
+	case bool:
+		return map[string]interface{}{"boolValue": val}
+	case float64:
+		return map[string]interface{}{"doubleValue": val}
+	case string:
+		return map[string]interface{}{"stringValue": val}
+	}
+	return map[string]interface{}{"stringValue": ""}
+}
+
+func buildOTLPRequest(batch []*span) map[string]interface{} {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		s.mu.Lock()
+		out := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Status:            map[string]interface{}{"code": s.statusCode},
+		}
+		if s.parentID != [8]byte{} {
+			out.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		if s.statusMsg != "" {
+			out.Status["message"] = s.statusMsg
+		}
+		for _, attr := range s.attrs {
+			out.Attributes = append(out.Attributes, otlpKeyValue{Key: attr.key, Value: otlpValue(attr.value)})
+		}
+		s.mu.Unlock()
+		spans = append(spans, out)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpKeyValue{
+						{Key: "service.name", Value: otlpValue(config.traceServiceName)},
+					},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "zeromaps-utls-proxy"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+}
+
+// 追踪导出统计
+type tracingStats struct {
+	Enabled     bool    `json:"enabled"`
+	SampleRatio float64 `json:"sampleRatio"`
+	Exported    int64   `json:"exported"`
+	Dropped     int64   `json:"dropped"`
+	Failed      int64   `json:"failed"`
+}
+
+func tracingSnapshot() tracingStats {
+	return tracingStats{
+		Enabled:     config.tracingEnabled,
+		SampleRatio: config.traceSampleRatio,
+		Exported:    tracer.exported.Load(),
+		Dropped:     tracer.dropped.Load(),
+		Failed:      tracer.failed.Load(),
+	}
+}
+
+// 把 Span 挂到新的 context 上（Span 为 nil 时原样返回）
+func contextWithSpan(ctx context.Context, s *span) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanContextKey{}, s)
+}
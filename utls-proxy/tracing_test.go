@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// OTLP/HTTP 导出请求（只解析测试需要的字段）
+type otlpExportRequest struct {
+	ResourceSpans []struct {
+		Resource struct {
+			Attributes []otlpKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []struct {
+			Spans []otlpSpan `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+func otlpAttr(attrs []otlpKeyValue, key string) interface{} {
+	for _, attr := range attrs {
+		if attr.Key == key {
+			for _, v := range attr.Value {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+// 请求带 traceparent 时根 Span 沿用调用方的 trace，导出到 OTLP 收集器的 Span 带有关键属性
+func TestTracingExport(t *testing.T) {
+	_, proxy := startMockProxy(t)
+
+	var (
+		mu       sync.Mutex
+		spans    []otlpSpan
+		resource []otlpKeyValue
+	)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var export otlpExportRequest
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("导出请求: %s %s %s", r.Method, r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&export); err != nil {
+			t.Errorf("导出内容无效: %v", err)
+		}
+		mu.Lock()
+		for _, rs := range export.ResourceSpans {
+			resource = rs.Resource.Attributes
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+		mu.Unlock()
+	}))
+	defer collector.Close()
+
+	saved, savedTracer := config, tracer
+	defer func() {
+		config.tracingEnabled, config.otlpEndpoint, config.traceSampleRatio = saved.tracingEnabled, saved.otlpEndpoint, saved.traceSampleRatio
+		tracer = savedTracer
+	}()
+	config.tracingEnabled = true
+	config.otlpEndpoint = collector.URL + "/v1/traces"
+	config.traceSampleRatio = 0 // 只导出调用方已采样的 trace
+	tracer = newSpanExporter()
+	startTracing()
+
+	const traceID, parentID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/proxy?url="+url.QueryEscape("https://kh.google.com/rt/earth/NodeData/pb=!1m2!1s0!2u28"), nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-01")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// 根 Span 在处理函数返回前结束
+	for deadline := time.Now().Add(5 * time.Second); activeRequests.Load() > 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	shutdownTracing(ctx)
+
+	mu.Lock()
+	defer mu.Unlock()
+	var root *otlpSpan
+	for i := range spans {
+		if spans[i].Name == "proxy" {
+			root = &spans[i]
+		}
+	}
+	if root == nil {
+		t.Fatalf("没有收到根 Span，收到 %d 个 Span", len(spans))
+	}
+	if root.TraceID != traceID || root.ParentSpanID != parentID || root.Kind != spanKindServer {
+		t.Errorf("根 Span trace %s，parent %s，kind %d", root.TraceID, root.ParentSpanID, root.Kind)
+	}
+	for key, want := range map[string]interface{}{
+		"http.response.status_code": "200",
+		"http.request.method":       http.MethodGet,
+		"server.address":            "kh.google.com",
+		"utls.profile":              resp.Header.Get("X-Browser-Profile"),
+		"utls.request_id":           resp.Header.Get("X-Request-Id"),
+	} {
+		if got := otlpAttr(root.Attributes, key); got != want {
+			t.Errorf("属性 %s = %v，应为 %v", key, got, want)
+		}
+	}
+
+	var attempts int
+	for _, s := range spans {
+		if s.Name == "upstream.attempt" && s.ParentSpanID == root.SpanID {
+			attempts++
+			if s.TraceID != traceID || s.Kind != spanKindClient {
+				t.Errorf("upstream.attempt trace %s，kind %d", s.TraceID, s.Kind)
+			}
+		}
+	}
+	if attempts == 0 {
+		t.Error("没有 upstream.attempt 子 Span")
+	}
+	if got := otlpAttr(resource, "service.name"); got != config.traceServiceName {
+		t.Errorf("service.name = %v", got)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http/httptrace"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 上游连接目标与证书校验（同时作用于绑定 IPv6 的客户端和默认客户端）：
+//   - UTLS_RESOLVE      静态解析覆盖，类似 curl --resolve（host:port:address[:port]）
+//   - UTLS_DNS_SERVERS  DNS 服务器（设置后启用内置解析器，见 dns.go；默认系统解析）
+//   - UTLS_CA_FILE      额外信任的根证书（PEM，可包含多个）
+//
+// UTLS_MOCK_UPSTREAM / UTLS_MOCK_CA_FILE 是指向模拟上游（utls-proxy mockupstream）的简写：
+// 相当于把所有允许的域名的 443 端口覆盖到模拟上游，并信任它的 CA
+
+var (
+	upstreamRootCAs *x509.CertPool    // 上游证书校验使用的根证书（nil = 系统根证书）
+	hostOverrides   map[string]string // host:port -> 实际连接的 ip:port
+	edgePinCount    atomic.Int64      // 固定边缘 IP 的次数
+	edgeUnpinCount  atomic.Int64      // 固定的边缘 IP 失效（重新解析）的次数
+)
+
+func initUpstream() error {
+	overrides, err := parseResolveOverrides(config.resolveOverrides)
+	if err != nil {
+		return err
+	}
+	if config.mockUpstream != "" {
+		for host := range allowedDomains {
+			key := net.JoinHostPort(host, "443")
+			if _, ok := overrides[key]; !ok {
+				overrides[key] = config.mockUpstream
+			}
+		}
+		slog.Warn("上游已指向模拟服务器（仅用于测试）", "mock_upstream", config.mockUpstream)
+	}
+	hostOverrides = overrides
+	for from, to := range hostOverrides {
+		slog.Info("上游解析覆盖", "host", from, "address", to)
+	}
+
+	var caFiles []string
+	for _, file := range []string{config.caFile, config.mockCAFile} {
+		if file != "" {
+			caFiles = append(caFiles, file)
+		}
+	}
+	if len(caFiles) > 0 {
+		pool, err := loadRootCAs(caFiles)
+		if err != nil {
+			return err
+		}
+		upstreamRootCAs = pool
+		slog.Info("已加载额外根证书", "files", caFiles)
+	}
+
+	resolver = nil
+	if strings.TrimSpace(config.dnsServers) != "" {
+		resolver = newDNSResolver(strings.Split(config.dnsServers, ","))
+		slog.Info("内置 DNS 解析器已启用", "servers", resolver.servers, "min_ttl", config.dnsMinTTL.String(),
+			"max_ttl", config.dnsMaxTTL.String())
+	}
+	if config.dnsPinEdge {
+		slog.Info("已开启边缘 IP 固定")
+	}
+
+	return nil
+}
+
+// 解析 UTLS_RESOLVE：逗号分隔的 host:port:address，address 可以是 IP 或 IP:port（IPv6 用方括号）
+//
+//	kh.google.com:443:127.0.0.1:8443,earth.google.com:443:[2001:db8::1]
+func parseResolveOverrides(spec string) (map[string]string, error) {
+	overrides := make(map[string]string)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("无效的解析覆盖 %q（格式 host:port:address）", entry)
+		}
+		host, port, target := strings.ToLower(parts[0]), parts[1], parts[2]
+
+		// address 带端口时使用其端口，否则沿用原端口
+		if targetHost, targetPort, err := net.SplitHostPort(target); err == nil && net.ParseIP(targetHost) != nil {
+			target = net.JoinHostPort(targetHost, targetPort)
+		} else if ip := net.ParseIP(strings.Trim(target, "[]")); ip != nil {
+			target = net.JoinHostPort(ip.String(), port)
+		} else {
+			return nil, fmt.Errorf("无效的解析覆盖 %q：地址必须是 IP 或 IP:port", entry)
+		}
+
+		overrides[net.JoinHostPort(host, port)] = target
+	}
+	return overrides, nil
+}
+
+// 系统根证书 + 额外的 CA 文件
+func loadRootCAs(caFiles []string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+
+	for _, caFile := range caFiles {
+		pemData, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("读取 CA 文件失败: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("CA 文件中没有有效证书: %s", caFile)
+		}
+	}
+	return pool, nil
+}
+
+// 固定的边缘 IP：出口地址 + host:port -> ip:port
+// 按出口地址而不是按 Dialer 记录，同一会话的多个客户端（如默认客户端组）连到同一个边缘
+var edgePins sync.Map
+
+// 上游连接的 Dialer：解析覆盖 → DNS 解析 → 按顺序尝试各个 IP
+// 开启 UTLS_DNS_PIN_EDGE 时，同一出口地址固定使用首次连上的边缘 IP
+type upstreamDialer struct {
+	dialer  *net.Dialer
+	network string // tcp（默认出口）/ tcp6（绑定 IPv6）
+	exit    string // 出口地址（空 = 默认出口），固定边缘 IP 的 key 前缀
+}
+
+// localAddr 为绑定的出口地址，nil = 系统默认
+func newUpstreamDialer(localAddr net.Addr) *upstreamDialer {
+	d := &upstreamDialer{
+		dialer: &net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+			LocalAddr: localAddr,
+		},
+		network: "tcp",
+	}
+	if localAddr != nil {
+		d.network = "tcp6"
+		d.exit = localAddr.String()
+	}
+	return d
+}
+
+func (d *upstreamDialer) pinKey(addr string) string {
+	return d.exit + " " + addr
+}
+
+func (d *upstreamDialer) dial(ctx context.Context, addr string) (net.Conn, error) {
+	if target, ok := hostOverrides[strings.ToLower(addr)]; ok {
+		return d.dialer.DialContext(ctx, d.network, target)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return d.dialer.DialContext(ctx, d.network, addr)
+	}
+
+	if config.dnsPinEdge {
+		if pinned, ok := edgePins.Load(d.pinKey(addr)); ok {
+			conn, err := d.dialer.DialContext(ctx, d.network, pinned.(string))
+			if err == nil {
+				return conn, nil
+			}
+			// 固定的边缘 IP 不可用，重新解析（其他客户端可能已经换了新的边缘）
+			if edgePins.CompareAndDelete(d.pinKey(addr), pinned) {
+				edgeUnpinCount.Add(1)
+			}
+			slog.Warn("固定的边缘 IP 连接失败，重新解析", "host", addr, "edge", pinned, "error", err)
+		}
+	}
+
+	ips, err := lookupUpstream(ctx, d.network, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, ip := range ips {
+		target := net.JoinHostPort(ip.String(), port)
+		conn, err := d.dialer.DialContext(ctx, d.network, target)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if config.dnsPinEdge {
+			if _, loaded := edgePins.LoadOrStore(d.pinKey(addr), target); !loaded {
+				edgePinCount.Add(1)
+			}
+		}
+		return conn, nil
+	}
+	return nil, lastErr
+}
+
+// 设置了 UTLS_DNS_SERVERS 时用内置解析器，否则用系统解析
+// 系统解析由 net 包触发 httptrace 的 DNSStart / DNSDone，内置解析器在这里触发
+func lookupUpstream(ctx context.Context, network, host string) ([]net.IP, error) {
+	if resolver == nil {
+		ipNetwork := "ip"
+		switch network {
+		case "tcp6":
+			ipNetwork = "ip6"
+		case "tcp4":
+			ipNetwork = "ip4"
+		}
+		return net.DefaultResolver.LookupIP(ctx, ipNetwork, host)
+	}
+
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.DNSStart != nil {
+		trace.DNSStart(httptrace.DNSStartInfo{Host: host})
+	}
+	ips, err := resolver.lookupHost(ctx, network, host)
+	if trace != nil && trace.DNSDone != nil {
+		addrs := make([]net.IPAddr, 0, len(ips))
+		for _, ip := range ips {
+			addrs = append(addrs, net.IPAddr{IP: ip})
+		}
+		trace.DNSDone(httptrace.DNSDoneInfo{Addrs: addrs, Err: err})
+	}
+	return ips, err
+}
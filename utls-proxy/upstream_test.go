@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// UTLS_RESOLVE：address 不带端口时沿用原端口，域名不区分大小写，格式错误时报错
+func TestParseResolveOverrides(t *testing.T) {
+	got, err := parseResolveOverrides(" KH.google.com:443:127.0.0.1:8443, earth.google.com:443:[2001:db8::1] ,,www.google.com:443:::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"kh.google.com:443":    "127.0.0.1:8443",
+		"earth.google.com:443": "[2001:db8::1]:443",
+		"www.google.com:443":   "[::1]:443",
+	}
+	if len(got) != len(want) {
+		t.Errorf("解析结果: %v", got)
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("%s -> %q，应为 %q", key, got[key], value)
+		}
+	}
+
+	for _, spec := range []string{
+		"kh.google.com:443",
+		"kh.google.com::127.0.0.1",
+		"kh.google.com:443:upstream.example",
+		"kh.google.com:443:127.0.0.1:8443:1",
+	} {
+		if _, err := parseResolveOverrides(spec); err == nil {
+			t.Errorf("%q 应返回错误", spec)
+		}
+	}
+}
+
+// 解析覆盖的目标直接连接，不经过 DNS
+func TestUpstreamDialerOverride(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	saved := hostOverrides
+	hostOverrides = map[string]string{"override.invalid:443": ln.Addr().String()}
+	defer func() { hostOverrides = saved }()
+
+	conn, err := newUpstreamDialer(nil).dial(context.Background(), "Override.invalid:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != ln.Addr().String() {
+		t.Errorf("连接到 %s，应为 %s", conn.RemoteAddr(), ln.Addr())
+	}
+}
+
+// UTLS_CA_FILE：文件不存在或没有证书时报错
+func TestLoadRootCAs(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.pem")
+	if err := os.WriteFile(empty, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range []string{filepath.Join(dir, "missing.pem"), empty} {
+		if _, err := loadRootCAs([]string{file}); err == nil {
+			t.Errorf("%s 应返回错误", filepath.Base(file))
+		}
+	}
+}
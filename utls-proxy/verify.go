@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	_ "embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"zeromaps-utls-proxy/certauth"
+)
+
+// 指纹自检：每个启用的指纹与进程内的 TLS 服务器握手，记录实际发出的 ClientHello，
+// 与 golden 文件（默认为编译进程序的 profiles.golden.json）比较。升级 uTLS 后运行：
+//
+//	utls-proxy profiles verify                                    # 有差异时列出并以 1 退出
+//	utls-proxy profiles verify -update -golden profiles.golden.json  # 确认差异后更新 golden 文件
+//
+// 运行中的代理通过 GET /profiles/verify 执行同样的检查。
+// Chrome 106 起每个连接随机打乱扩展顺序：这类指纹的扩展列表按编号排序记录，不比较 JA3（比较 JA3N 和 JA4）
+
+//go:embed profiles.golden.json
+var builtinGolden []byte
+
+// golden 文件
+type goldenFile struct {
+	UTLSVersion string               `json:"utlsVersion"` // 生成时链接的 uTLS 版本
+	Profiles    []profileFingerprint `json:"profiles"`
+}
+
+// 一个指纹实际发出的 ClientHello
+type profileFingerprint struct {
+	Profile             string   `json:"profile"`
+	ClientHello         string   `json:"clientHello"`
+	JA3                 string   `json:"ja3,omitempty"` // 扩展顺序随机时为空
+	JA3N                string   `json:"ja3n"`
+	JA4                 string   `json:"ja4"`
+	TLSVersions         []string `json:"tlsVersions"`
+	ALPN                []string `json:"alpn"`
+	Ciphers             []string `json:"ciphers"`
+	Extensions          []string `json:"extensions"`
+	ShuffledExtensions  bool     `json:"shuffledExtensions,omitempty"`
+	Groups              []string `json:"groups"`
+	KeyShares           []string `json:"keyShares"`
+	SignatureAlgorithms []string `json:"signatureAlgorithms"`
+}
+
+// 自检结果
+type verifyReport struct {
+	UTLSVersion   string         `json:"utlsVersion"`
+	Golden        string         `json:"golden"` // golden 文件路径，内置时为 "builtin"
+	GoldenVersion string         `json:"goldenUtlsVersion"`
+	OK            bool           `json:"ok"`
+	Results       []verifyResult `json:"results"`
+}
+
+type verifyResult struct {
+	Profile     string              `json:"profile"`
+	Status      string              `json:"status"` // ok / drift / new（golden 中没有）/ missing（指纹库中已没有）/ error
+	Handshake   string              `json:"handshake,omitempty"`
+	Diff        []string            `json:"diff,omitempty"`
+	Error       string              `json:"error,omitempty"`
+	Fingerprint *profileFingerprint `json:"fingerprint,omitempty"`
+}
+
+// 读取 golden 文件（空路径使用内置的）
+func loadGolden(path string) (*goldenFile, string, error) {
+	data, source := builtinGolden, "builtin"
+	if path != "" {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, path, err
+		}
+		source = path
+	}
+	var golden goldenFile
+	if err := json.Unmarshal(data, &golden); err != nil {
+		return nil, source, fmt.Errorf("%s: %w", source, err)
+	}
+	return &golden, source, nil
+}
+
+// 对指纹库中每个启用的指纹抓取 ClientHello 并与 golden 比较
+func verifyProfiles(profiles []BrowserProfile, golden *goldenFile, source string) verifyReport {
+	report := verifyReport{UTLSVersion: utlsVersion(), Golden: source, GoldenVersion: golden.UTLSVersion, OK: true}
+
+	expected := make(map[string]profileFingerprint, len(golden.Profiles))
+	for _, fp := range golden.Profiles {
+		expected[fp.Profile] = fp
+	}
+
+	ca, err := certauth.LoadOrCreate("", "utls-proxy profiles verify")
+	if err != nil {
+		report.OK = false
+		report.Results = append(report.Results, verifyResult{Status: "error", Error: err.Error()})
+		return report
+	}
+
+	for _, profile := range profiles {
+		result := verifyResult{Profile: profile.Name}
+		fp, handshake, err := fingerprintProfile(profile, ca)
+		switch {
+		case err != nil:
+			result.Status, result.Error = "error", err.Error()
+		default:
+			result.Fingerprint, result.Handshake = fp, handshake
+			if want, ok := expected[profile.Name]; !ok {
+				result.Status = "new"
+			} else if result.Diff = diffFingerprints(want, *fp); len(result.Diff) > 0 {
+				result.Status = "drift"
+			} else {
+				result.Status = "ok"
+			}
+		}
+		delete(expected, profile.Name)
+		report.OK = report.OK && result.Status == "ok"
+		report.Results = append(report.Results, result)
+	}
+
+	for _, fp := range golden.Profiles {
+		if _, ok := expected[fp.Profile]; ok {
+			report.OK = false
+			report.Results = append(report.Results, verifyResult{Profile: fp.Profile, Status: "missing"})
+		}
+	}
+	return report
+}
+
+// 抓取两次 ClientHello：扩展顺序不同说明该指纹每个连接随机打乱扩展
+func fingerprintProfile(profile BrowserProfile, ca *certauth.CA) (*profileFingerprint, string, error) {
+	first, handshake, err := captureClientHello(profile, ca)
+	if err != nil {
+		return nil, "", err
+	}
+	second, _, err := captureClientHello(profile, ca)
+	if err != nil {
+		return nil, "", err
+	}
+	shuffled := !slices.Equal(withoutGREASE(first.extensions), withoutGREASE(second.extensions))
+
+	fp := &profileFingerprint{
+		Profile:             profile.Name,
+		ClientHello:         profile.ClientHello.Str(),
+		JA3N:                ja3Hash(first, true),
+		JA4:                 ja4(first),
+		TLSVersions:         names(first.supportedVersions, versionName),
+		ALPN:                first.alpn,
+		Ciphers:             names(first.ciphers, cipherName),
+		Groups:              names(first.groups, groupName),
+		KeyShares:           names(first.keyShares, groupName),
+		SignatureAlgorithms: names(first.signatureAlgorithms, signatureName),
+		ShuffledExtensions:  shuffled,
+	}
+	if shuffled {
+		// 按编号排序，GREASE（每个连接的值不同）放在最后
+		exts := slices.Sorted(slices.Values(withoutGREASE(first.extensions)))
+		fp.Extensions = names(exts, extensionName)
+		for range len(first.extensions) - len(exts) {
+			fp.Extensions = append(fp.Extensions, "GREASE")
+		}
+	} else {
+		fp.JA3 = ja3Hash(first, false)
+		fp.Extensions = names(first.extensions, extensionName)
+	}
+	return fp, handshake, nil
+}
+
+// 与进程内的 TLS 服务器握手一次，返回服务器收到的 ClientHello 和握手结果
+func captureClientHello(profile BrowserProfile, ca *certauth.CA) (*clientHello, string, error) {
+	const serverName = "kh.google.com"
+	cert, err := ca.Issue([]string{serverName})
+	if err != nil {
+		return nil, "", err
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, "", err
+	}
+	defer ln.Close()
+
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		rec := &recordingConn{Conn: conn}
+		server := tls.Server(rec, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{"h2", "http/1.1"},
+		})
+		server.SetDeadline(time.Now().Add(5 * time.Second))
+		server.Handshake()
+		server.Close()
+		received <- rec.bytes()
+	}()
+
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), 5*time.Second)
+	if err != nil {
+		return nil, "", err
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.CertPEM())
+	tlsConfig := upstreamTLSConfig(serverName)
+	tlsConfig.RootCAs = roots
+
+	// 与 dialUTLS 相同的方式创建连接：启用会话复用时首次握手的 ClientHello 也要与 golden 一致
+	client, err := newUConn(conn, tlsConfig, profile.ClientHello, newTLSSessionCache())
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	var handshake string
+	if err := client.Handshake(); err != nil {
+		handshake = "failed: " + err.Error()
+	} else {
+		state := client.ConnectionState()
+		handshake = strings.Join([]string{tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite), state.NegotiatedProtocol}, " ")
+	}
+	client.Close()
+
+	data := <-received
+	ch, err := parseClientHello(data)
+	if err != nil {
+		return nil, "", fmt.Errorf("解析 ClientHello 失败: %w", err)
+	}
+	return ch, strings.TrimSpace(handshake), nil
+}
+
+// 记录读到的所有字节
+type recordingConn struct {
+	net.Conn
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.mu.Lock()
+	c.buf.Write(p[:n])
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *recordingConn) bytes() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return bytes.Clone(c.buf.Bytes())
+}
+
+// 逐字段比较，返回可读的差异
+func diffFingerprints(want, got profileFingerprint) []string {
+	var diff []string
+	diffString := func(field, a, b string) {
+		if a != b {
+			diff = append(diff, fmt.Sprintf("%s: %s -> %s", field, orNone(a), orNone(b)))
+		}
+	}
+	diffList := func(field string, a, b []string) {
+		if slices.Equal(a, b) {
+			return
+		}
+		var changes []string
+		for _, v := range a {
+			if !slices.Contains(b, v) {
+				changes = append(changes, "-"+v)
+			}
+		}
+		for _, v := range b {
+			if !slices.Contains(a, v) {
+				changes = append(changes, "+"+v)
+			}
+		}
+		if len(changes) == 0 {
+			changes = append(changes, "顺序变化 ["+strings.Join(a, ", ")+"] -> ["+strings.Join(b, ", ")+"]")
+		}
+		diff = append(diff, field+": "+strings.Join(changes, " "))
+	}
+
+	diffString("clientHello", want.ClientHello, got.ClientHello)
+	diffString("ja3", want.JA3, got.JA3)
+	diffString("ja3n", want.JA3N, got.JA3N)
+	diffString("ja4", want.JA4, got.JA4)
+	diffString("shuffledExtensions", fmt.Sprint(want.ShuffledExtensions), fmt.Sprint(got.ShuffledExtensions))
+	diffList("tlsVersions", want.TLSVersions, got.TLSVersions)
+	diffList("alpn", want.ALPN, got.ALPN)
+	diffList("ciphers", want.Ciphers, got.Ciphers)
+	diffList("extensions", want.Extensions, got.Extensions)
+	diffList("groups", want.Groups, got.Groups)
+	diffList("keyShares", want.KeyShares, got.KeyShares)
+	diffList("signatureAlgorithms", want.SignatureAlgorithms, got.SignatureAlgorithms)
+	return diff
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "(无)"
+	}
+	return s
+}
+
+// 子命令入口：utls-proxy profiles verify [flags]
+func profilesCommand(args []string) int {
+	if len(args) == 0 || args[0] != "verify" {
+		fmt.Fprintln(os.Stderr, "用法: utls-proxy profiles verify [-golden 文件] [-update] [-json]")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("profiles verify", flag.ContinueOnError)
+	goldenPath := fs.String("golden", os.Getenv("UTLS_PROFILES_GOLDEN"), "golden 文件（空 = 内置）")
+	update := fs.Bool("update", false, "把当前结果写入 golden 文件（未指定 -golden 时写入 profiles.golden.json）")
+	asJSON := fs.Bool("json", false, "以 JSON 输出结果")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	if err := initProfileCatalog(os.Getenv("UTLS_PROFILES_FILE")); err != nil {
+		fmt.Fprintf(os.Stderr, "指纹库无效: %v\n", err)
+		return 1
+	}
+
+	golden := &goldenFile{}
+	source := *goldenPath
+	if !*update {
+		var err error
+		if golden, source, err = loadGolden(*goldenPath); err != nil {
+			fmt.Fprintf(os.Stderr, "读取 golden 文件失败: %v\n", err)
+			return 1
+		}
+	}
+	report := verifyProfiles(browserProfiles, golden, source)
+
+	if *update {
+		return writeGolden(report, *goldenPath)
+	}
+
+	if *asJSON {
+		out, _ := json.MarshalIndent(report, "", "\t")
+		fmt.Println(string(out))
+	} else {
+		printVerifyReport(report)
+	}
+	if !report.OK {
+		return 1
+	}
+	return 0
+}
+
+func writeGolden(report verifyReport, path string) int {
+	if path == "" {
+		path = "profiles.golden.json"
+	}
+	golden := goldenFile{UTLSVersion: report.UTLSVersion}
+	for _, result := range report.Results {
+		if result.Fingerprint == nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", result.Profile, result.Error)
+			return 1
+		}
+		golden.Profiles = append(golden.Profiles, *result.Fingerprint)
+	}
+
+	out, _ := json.MarshalIndent(golden, "", "\t")
+	if err := os.WriteFile(path, append(out, '\n'), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "写入 golden 文件失败: %v\n", err)
+		return 1
+	}
+	fmt.Printf("已写入 %s（%d 个指纹，uTLS %s）\n", path, len(golden.Profiles), golden.UTLSVersion)
+	return 0
+}
+
+func printVerifyReport(report verifyReport) {
+	fmt.Printf("uTLS %s，golden: %s（uTLS %s）\n\n", report.UTLSVersion, report.Golden, report.GoldenVersion)
+	for _, result := range report.Results {
+		mark := map[string]string{"ok": "✓", "drift": "✗", "new": "+", "missing": "-", "error": "!"}[result.Status]
+		line := fmt.Sprintf("%s %-26s %-8s", mark, result.Profile, result.Status)
+		if fp := result.Fingerprint; fp != nil {
+			line += fmt.Sprintf(" %s  %s", fp.JA4, result.Handshake)
+		}
+		fmt.Println(strings.TrimRight(line, " "))
+		if result.Error != "" {
+			fmt.Println("    " + result.Error)
+		}
+		for _, d := range result.Diff {
+			fmt.Println("    " + d)
+		}
+	}
+	if report.OK {
+		fmt.Println("\n所有指纹与 golden 文件一致")
+	} else {
+		fmt.Println("\n与 golden 文件不一致；确认变化符合预期后用 -update 更新")
+	}
+}
+
+var (
+	verifyGolden       *goldenFile // /profiles/verify 使用的 golden 文件（启动时加载）
+	verifyGoldenSource string
+	verifyMu           sync.Mutex // 同一时间只运行一次自检
+)
+
+// 加载 UTLS_PROFILES_GOLDEN（为空时使用内置的）
+func initProfileGolden(path string) error {
+	golden, source, err := loadGolden(path)
+	if err != nil {
+		return err
+	}
+	verifyGolden, verifyGoldenSource = golden, source
+	return nil
+}
+
+// GET /profiles/verify：对当前指纹库运行自检
+func profilesVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, errorResponse{Code: codeNotAllowed, Message: "Method not allowed", Status: http.StatusMethodNotAllowed})
+		return
+	}
+
+	verifyMu.Lock()
+	report := verifyProfiles(browserProfiles, verifyGolden, verifyGoldenSource)
+	verifyMu.Unlock()
+	writeJSON(w, http.StatusOK, report)
+}
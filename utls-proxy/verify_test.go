@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"zeromaps-utls-proxy/certauth"
+)
+
+// 内置指纹库实际发出的 ClientHello 与 profiles.golden.json 一致。
+// 升级 uTLS 后失败时，确认差异后运行 go run . profiles verify -update -golden profiles.golden.json
+func TestProfilesMatchGolden(t *testing.T) {
+	golden, source, err := loadGolden("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := verifyProfiles(mustBuiltinCatalog().profiles, golden, source)
+	for _, result := range report.Results {
+		switch result.Status {
+		case "ok":
+		case "error":
+			t.Errorf("%s: %s", result.Profile, result.Error)
+		default:
+			t.Errorf("%s: %s\n\t%s", result.Profile, result.Status, strings.Join(result.Diff, "\n\t"))
+		}
+	}
+}
+
+func TestParseClientHello(t *testing.T) {
+	ca, err := certauth.LoadOrCreate("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile := mustBuiltinCatalog().profiles[0]
+
+	ch, _, err := captureClientHello(profile, ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch.serverName != "kh.google.com" || len(ch.ciphers) == 0 || len(ch.alpn) == 0 {
+		t.Errorf("解析结果不完整: %+v", ch)
+	}
+
+	// 截断的记录或字段不能被当作完整的 ClientHello
+	for _, data := range [][]byte{nil, {22, 3, 1, 0, 10, 1, 0}, {23, 3, 3, 0, 0}, {22, 3, 1, 0, 8, 1, 0, 0, 4, 3, 3, 0, 0}} {
+		if _, err := parseClientHello(data); err == nil {
+			t.Errorf("%v: 应当返回错误", data)
+		}
+	}
+}